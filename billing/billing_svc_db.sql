@@ -1,58 +1,192 @@
 CREATE DATABASE billing_svc_db;
 USE billing_svc_db;
 
--- Attributes of the table (card_id, card_number, card_expiry, cvv, card_balance, user_id)
+-- Attributes of the table (card_id, gateway_token, brand, last_four, card_expiry, is_default, removed_at, user_id)
+-- Card numbers and CVVs are never stored; the payment gateway's token is used to charge the card.
+-- Removed cards are kept for the payments made with them.
 CREATE TABLE card (
     card_id INT PRIMARY KEY AUTO_INCREMENT,
-    card_number VARCHAR(16) NOT NULL,
+    gateway_token VARCHAR(64) NOT NULL UNIQUE,
+    brand VARCHAR(20) NOT NULL,
+    last_four CHAR(4) NOT NULL,
     card_expiry VARCHAR(5) NOT NULL,
-    cvv VARCHAR(3) NOT NULL,
-    card_balance DECIMAL(10, 2) NOT NULL, 
-    user_id INT NOT NULL
+    is_default BOOLEAN NOT NULL DEFAULT FALSE, -- the card charged when none is chosen
+    removed_at DATETIME NULL,
+    user_id INT NOT NULL,
+    INDEX idx_card_user (user_id)
 );
--- Attributes of the table (invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status)
+-- Attributes of the table (invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id, charge_key)
 CREATE TABLE invoice (
     invoice_id INT AUTO_INCREMENT PRIMARY KEY,
-    booking_id INT NOT NULL,
+    booking_id INT NULL, -- not set for membership invoices
     user_id INT NOT NULL,
     issue_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    base_cost DECIMAL(5, 2) NOT NULL,
+    base_cost DECIMAL(10, 2) NOT NULL,
     promo_code VARCHAR(20), 
-    discount_applied DECIMAL(5, 2) DEFAULT 0.00,  
-    total_amount DECIMAL(5, 2) NOT NULL, 
+    discount_applied DECIMAL(10, 2) DEFAULT 0.00,  
+    total_amount DECIMAL(10, 2) NOT NULL, 
     details TEXT,  
-	status ENUM('Pending', 'Paid') DEFAULT 'Pending'  
+	status ENUM('Pending', 'Processing', 'Paid', 'PartiallyRefunded', 'Refunded', 'Void') DEFAULT 'Pending',
+    invoice_type ENUM('Booking', 'Supplementary', 'Final', 'Membership') NOT NULL DEFAULT 'Booking', -- Supplementary invoices charge the extra cost of a changed booking, Final invoices bill the actual usage of a trip, Membership invoices charge a membership subscription or renewal
+    parent_invoice_id INT NULL, -- Booking invoice a supplementary or final invoice belongs to
+    charge_key VARCHAR(255) NULL UNIQUE, -- Idempotency-Key of the membership charge that issued it, so a retried charge reuses the invoice
+    FOREIGN KEY (parent_invoice_id) REFERENCES invoice(invoice_id)
 );
 
--- Attributes of the table (billing_id, invoice_id, card_id, transaction_amount, transaction_date)
+-- Attributes of the table (line_item_id, invoice_id, item_type, description, quantity, unit_price, amount)
+-- Discounts and payments already made are recorded with negative amounts; an invoice's total_amount is the sum of its lines
+CREATE TABLE invoice_line_item (
+    line_item_id INT AUTO_INCREMENT PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    item_type ENUM('Rental', 'Membership', 'Discount', 'Fee', 'Tax', 'Adjustment') NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    quantity DECIMAL(10, 2) NOT NULL DEFAULT 1.00,
+    unit_price DECIMAL(10, 4) NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(invoice_id)
+);
+
+-- Attributes of the table (billing_id, invoice_id, card_id, transaction_amount, wallet_amount, transaction_date)
 CREATE TABLE billing (
     billing_id INT AUTO_INCREMENT PRIMARY KEY,
     invoice_id INT NOT NULL,  -- Reference to invoice
-    card_id INT NOT NULL,  -- Payment card used
-    transaction_amount DECIMAL(5, 2) NOT NULL,
+    card_id INT NULL,  -- Payment card used, not set when the wallet paid it all
+    transaction_amount DECIMAL(10, 2) NOT NULL,
+    wallet_amount DECIMAL(10, 2) NOT NULL DEFAULT 0.00,  -- Part of the amount paid from the wallet
     transaction_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  -- Payment timestamp
     FOREIGN KEY (invoice_id) REFERENCES invoice(invoice_id),  -- Reference to the invoice
     FOREIGN KEY (card_id) REFERENCES card(card_id)  -- Reference to payment card
 );
 
+-- Attributes of the table (saga_id, invoice_id, booking_id, user_id, card_id, amount, wallet_amount, state, billing_id, gateway_reference, attempts, last_error, created_at, updated_at)
+-- Tracks each payment through reserve -> confirm booking -> capture, or the refund when the booking cannot be confirmed
+CREATE TABLE payment_saga (
+    saga_id INT AUTO_INCREMENT PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    booking_id INT NOT NULL,
+    user_id INT NOT NULL,
+    card_id INT NULL, -- not set when the wallet pays it all
+    amount DECIMAL(10, 2) NOT NULL,
+    wallet_amount DECIMAL(10, 2) NOT NULL DEFAULT 0.00, -- part of the amount taken from the wallet
+    state ENUM('Started', 'Charging', 'PaymentReserved', 'BookingConfirmed', 'PaymentCaptured', 'Compensating', 'Refunded', 'Failed') NOT NULL DEFAULT 'Started',
+    billing_id INT NULL,
+    gateway_reference VARCHAR(64) NULL, -- reference the card is charged under, recorded before calling the gateway
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (invoice_id) REFERENCES invoice(invoice_id),
+    FOREIGN KEY (card_id) REFERENCES card(card_id)
+);
+
 -- Attributes of the table (receipt_id, billing_id, card_id, amount, date, description)
 CREATE TABLE receipt (
     receipt_id INT AUTO_INCREMENT PRIMARY KEY,   
     billing_id INT NOT NULL,
-    card_id INT NOT NULL, 
-    amount DECIMAL(5, 2) NOT NULL,              
+    card_id INT NULL, -- not set when the wallet paid it all
+    amount DECIMAL(10, 2) NOT NULL,              
     date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,                     
     description TEXT,                            
     FOREIGN KEY (billing_id) REFERENCES billing(billing_id),
     FOREIGN KEY (card_id) REFERENCES card(card_id)
 );
 
--- Insert cards for the three users
-INSERT INTO card (card_number, card_expiry, cvv, card_balance, user_id)
+-- Attributes of the table (credit_note_id, invoice_id, billing_id, amount, wallet_amount, refund_percentage, reason, issue_date, refund_status)
+CREATE TABLE credit_note (
+    credit_note_id INT AUTO_INCREMENT PRIMARY KEY,
+    invoice_id INT NOT NULL,
+    billing_id INT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    wallet_amount DECIMAL(10, 2) NOT NULL DEFAULT 0, -- part of the amount refunded to the wallet, the rest goes to the cards
+    refund_percentage DECIMAL(5, 2) NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    issue_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    refund_status ENUM('Pending', 'Settled') NOT NULL DEFAULT 'Pending', -- Pending until the cards' share is refunded through the gateway
+    FOREIGN KEY (invoice_id) REFERENCES invoice(invoice_id),
+    FOREIGN KEY (billing_id) REFERENCES billing(billing_id)
+);
+
+-- Attributes of the table (credit_note_id, billing_id, card_id, amount, status)
+-- The cards' share of a credit note, split by the payment it goes back to
+CREATE TABLE credit_note_card_refund (
+    credit_note_id INT NOT NULL,
+    billing_id INT NOT NULL, -- payment refunded, to the card it was made with
+    card_id INT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    status ENUM('Pending', 'Refunded') NOT NULL DEFAULT 'Pending',
+    PRIMARY KEY (credit_note_id, billing_id),
+    FOREIGN KEY (credit_note_id) REFERENCES credit_note(credit_note_id),
+    FOREIGN KEY (billing_id) REFERENCES billing(billing_id),
+    FOREIGN KEY (card_id) REFERENCES card(card_id)
+);
+
+-- Attributes of the table (user_id, created_at)
+-- One row per user with a wallet, locked while its balance is checked and changed
+CREATE TABLE wallet (
+    user_id INT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Attributes of the table (transaction_id, user_id, transaction_type, invoice_id, card_id, description, reference, created_at)
+-- Append-only: wallet transactions are never changed, only corrected by later ones
+CREATE TABLE ledger_transaction (
+    transaction_id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    transaction_type ENUM('TopUp', 'Charge', 'Refund', 'Adjustment') NOT NULL,
+    invoice_id INT NULL, -- invoice paid or refunded
+    card_id INT NULL, -- card a top-up came from
+    description VARCHAR(255) NOT NULL,
+    reference VARCHAR(64) NULL UNIQUE, -- what the transaction is for, e.g. a payment saga, so it is only recorded once
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES wallet(user_id),
+    FOREIGN KEY (invoice_id) REFERENCES invoice(invoice_id),
+    FOREIGN KEY (card_id) REFERENCES card(card_id)
+);
+
+-- Attributes of the table (entry_id, transaction_id, account, user_id, amount)
+-- Double-entry: the entries of a transaction sum to zero. A wallet's balance is the sum of its entries.
+CREATE TABLE ledger_entry (
+    entry_id INT AUTO_INCREMENT PRIMARY KEY,
+    transaction_id INT NOT NULL,
+    account ENUM('Wallet', 'Card', 'Revenue', 'Adjustment') NOT NULL,
+    user_id INT NULL, -- set for wallet entries
+    amount DECIMAL(10, 2) NOT NULL, -- positive adds to the account
+    FOREIGN KEY (transaction_id) REFERENCES ledger_transaction(transaction_id),
+    INDEX idx_ledger_entry_account (account, user_id)
+);
+
+-- Attributes of the table (top_up_id, user_id, card_id, amount, description, status, created_at)
+-- Wallet top-ups, recorded before the card is charged under the reference wallet-top-up-<top_up_id>
+CREATE TABLE wallet_top_up (
+    top_up_id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    card_id INT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    status ENUM('Pending', 'Completed', 'Declined') NOT NULL DEFAULT 'Pending', -- Completed once posted to the ledger
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (card_id) REFERENCES card(card_id)
+);
+
+-- Attributes of the table (scope, idempotency_key, request_hash, status_code, content_type, response_body, created_at)
+-- Responses to requests sent with an Idempotency-Key, replayed when the request is retried
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(20) NOT NULL, -- user id of the caller, or 'service'
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL, -- SHA-256 of the method, path and body
+    status_code INT NULL, -- not set while the first request is still running
+    content_type VARCHAR(100) NULL,
+    response_body MEDIUMBLOB NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, idempotency_key)
+);
+
+-- Insert cards for the three users, as tokenized by the fake payment gateway
+INSERT INTO card (gateway_token, brand, last_four, card_expiry, is_default, user_id)
 VALUES 
-('1234567812345678', '12/25', '123', 2000.00, 1), -- Card for John Doe
-('2345678923456789', '11/25', '456', 3000.50, 2), -- Card for Jane Smith
-('3456789034567890', '10/26', '789', 5500.75, 3); -- Card for Alice Johnson
+('tok_fake_seed_john_doe', 'Visa', '5678', '12/25', TRUE, 1), -- Card for John Doe
+('tok_fake_seed_jane_smith', 'Mastercard', '6789', '11/25', TRUE, 2), -- Card for Jane Smith
+('tok_fake_seed_alice_johnson', 'American Express', '7890', '10/26', TRUE, 3); -- Card for Alice Johnson
 
 -- Invoice for Booking 1: John Doe
 INSERT INTO invoice (booking_id, user_id, base_cost, promo_code, discount_applied, total_amount, details, status)
@@ -89,6 +223,23 @@ INSERT INTO invoice (booking_id, user_id, base_cost, discount_applied, total_amo
 VALUES 
 (7, 3, 240.00, 48.00, 192.00, 'Reserved the Mercedes C-Class on 2024-11-20 from 04:00 PM to 08:00 PM', 'Paid');
 
+-- Line items of the invoices above, matching each invoice's details, base cost and discounts
+INSERT INTO invoice_line_item (invoice_id, item_type, description, quantity, unit_price, amount)
+VALUES
+(1, 'Rental', 'Rental of the Toyota Corolla on 2024-12-04 from 08:00:00 to 12:00:00', 4.00, 20.00, 80.00),
+(1, 'Discount', 'Promotion discount (DECEMBERHOLIDAY)', 1.00, -16.00, -16.00),
+(2, 'Rental', 'Rental of the Toyota Corolla on 2024-12-10 from 18:00:00 to 22:00:00', 4.00, 20.00, 80.00),
+(3, 'Rental', 'Rental of the Honda CR-V on 2024-12-18 from 08:00:00 to 20:00:00', 12.00, 30.00, 360.00),
+(3, 'Discount', 'Promotion discount (CHRISTMAS15)', 1.00, -54.00, -54.00),
+(4, 'Rental', 'Rental of the BMW 5 Series on 2024-12-20 from 16:00:00 to 22:00:00', 6.00, 50.00, 300.00),
+(4, 'Discount', 'Membership discount', 1.00, -30.00, -30.00),
+(5, 'Rental', 'Rental of the BMW 5 Series on 2024-12-22 from 16:00:00 to 18:00:00', 2.00, 150.00, 300.00),
+(5, 'Discount', 'Membership discount', 1.00, -30.00, -30.00),
+(5, 'Discount', 'Promotion discount (CHRISTMAS15)', 1.00, -40.50, -40.50),
+(6, 'Rental', 'Rental of the Volkswagen Golf on 2024-11-16 from 08:00:00 to 20:00:00', 12.00, 40.00, 480.00),
+(6, 'Discount', 'Membership discount', 1.00, -96.00, -96.00),
+(7, 'Rental', 'Rental of the Mercedes C-Class on 2024-11-20 from 16:00:00 to 20:00:00', 4.00, 60.00, 240.00),
+(7, 'Discount', 'Membership discount', 1.00, -48.00, -48.00);
 
 -- Billing for Booking 1: John Doe (card_id = 1)
 INSERT INTO billing (invoice_id, card_id, transaction_amount)
@@ -183,4 +334,25 @@ BEGIN
     );
 END$$
 
+-- The ledger is append-only
+CREATE TRIGGER before_ledger_transaction_update
+BEFORE UPDATE ON ledger_transaction
+FOR EACH ROW
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Ledger transactions cannot be changed'$$
+
+CREATE TRIGGER before_ledger_transaction_delete
+BEFORE DELETE ON ledger_transaction
+FOR EACH ROW
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Ledger transactions cannot be deleted'$$
+
+CREATE TRIGGER before_ledger_entry_update
+BEFORE UPDATE ON ledger_entry
+FOR EACH ROW
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Ledger entries cannot be changed'$$
+
+CREATE TRIGGER before_ledger_entry_delete
+BEFORE DELETE ON ledger_entry
+FOR EACH ROW
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Ledger entries cannot be deleted'$$
+
 DELIMITER ;
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Settle the difference when a confirmed booking is repriced (called by the vehicle service).
+// A higher price issues a supplementary invoice, a lower price refunds the difference as a credit note.
+func adjustBooking(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message    string      `json:"message"`
+		Type       string      `json:"type"`
+		Invoice    *Invoice    `json:"invoice"`
+		CreditNote *CreditNote `json:"credit_note"`
+	}
+
+	// Get the user_id and booking_id from the request
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["booking_id"]
+
+	// New total of the booking and a description of the change
+	var adjustRequest struct {
+		TotalAmount money.Money `json:"total_amount"`
+		Details     string      `json:"details"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&adjustRequest)
+	if err != nil || adjustRequest.TotalAmount < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid adjustment request"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Find the paid booking invoice and its payment, locking it against concurrent adjustments
+	query := `
+		SELECT i.invoice_id, i.user_id, b.billing_id
+		FROM invoice i
+		INNER JOIN billing b ON b.invoice_id = i.invoice_id
+		WHERE i.booking_id = ? AND i.user_id = ? AND i.invoice_type = 'Booking' AND i.status IN ('Paid', 'PartiallyRefunded')
+		ORDER BY b.billing_id
+		LIMIT 1
+		FOR UPDATE`
+	var invoiceId, ownerId, billingId int
+	err = tx.QueryRow(query, bookingId, userId).Scan(&invoiceId, &ownerId, &billingId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{Message: "No paid invoice found for booking"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A payment in flight would be charged against the old price
+	var processing int
+	err = tx.QueryRow("SELECT COUNT(*) FROM invoice WHERE booking_id = ? AND status = 'Processing'", bookingId).Scan(&processing)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if processing > 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "A payment for this booking is in progress"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Unpaid supplementary invoices are replaced by the new adjustment
+	_, err = tx.Exec("UPDATE invoice SET status = 'Void' WHERE booking_id = ? AND invoice_type = 'Supplementary' AND status = 'Pending'", bookingId)
+	if err != nil {
+		http.Error(w, "Error voiding supplementary invoices", http.StatusInternalServerError)
+		return
+	}
+
+	// Compare the new total, with tax, with what has been charged so far, net of refunds
+	charged, refunded, err := bookingCharges(tx, bookingId)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	items := addTaxLineItem([]LineItem{{ItemType: lineItemRental, Description: "Repriced booking: " + adjustRequest.Details, Quantity: 1, UnitPrice: adjustRequest.TotalAmount.Float64(), Amount: adjustRequest.TotalAmount}})
+	_, _, newTotal := invoiceTotals(items)
+	netPaid := charged - refunded
+	difference := newTotal - netPaid
+
+	switch {
+	case difference > 0:
+		// Charge the difference with a supplementary invoice, itemised as the new price less what was paid
+		items = append(items, LineItem{ItemType: lineItemAdjustment, Description: "Paid for booking", Quantity: 1, UnitPrice: -netPaid.Float64(), Amount: -netPaid})
+		baseCost, discount, totalAmount := invoiceTotals(items)
+		query = "INSERT INTO invoice (booking_id, user_id, base_cost, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id) VALUES (?, ?, ?, ?, ?, ?, 'Pending', 'Supplementary', ?)"
+		result, err := tx.Exec(query, bookingId, userId, baseCost, discount, totalAmount, adjustRequest.Details, invoiceId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Error inserting supplementary invoice", http.StatusInternalServerError)
+			return
+		}
+		supplementaryId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(w, "Error getting invoice id", http.StatusInternalServerError)
+			return
+		}
+		if err := insertLineItems(tx, supplementaryId, items); err != nil {
+			fmt.Println(err)
+			http.Error(w, "Error inserting line items", http.StatusInternalServerError)
+			return
+		}
+		invoice, err := getInvoiceByID(tx, supplementaryId)
+		if err != nil {
+			http.Error(w, "Error querying invoice", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+		if err != nil {
+			http.Error(w, "Error querying line items", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		response := Response{Message: "Supplementary invoice issued", Type: "SupplementaryInvoice", Invoice: invoice}
+		json.NewEncoder(w).Encode(response)
+
+	case difference < 0:
+		// Refund the difference, splitting it between the wallet and the cards as the booking was paid.
+		// The cards' share is refunded once the credit note is committed.
+		amount := -difference
+		walletShare, cardRefunds, err := splitRefund(tx, bookingId, amount)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		percentage := 100.0
+		if netPaid > 0 {
+			// Share of what was paid, as a percentage with two decimals
+			percentage = math.Round(float64(amount)*10000/float64(netPaid)) / 100
+		}
+		creditNoteId, err := insertCreditNote(tx, ownerId, invoiceId, billingId, amount, walletShare, cardRefunds, percentage, "Adjustment")
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Error inserting credit note", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec("UPDATE invoice SET status = 'PartiallyRefunded' WHERE invoice_id = ?", invoiceId)
+		if err != nil {
+			http.Error(w, "Error updating invoice status", http.StatusInternalServerError)
+			return
+		}
+		creditNote, err := getCreditNoteByID(tx, creditNoteId)
+		if err != nil {
+			http.Error(w, "Error querying credit note", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		finishCreditNote(creditNote)
+		w.WriteHeader(http.StatusOK)
+		response := Response{Message: "Difference refunded", Type: "CreditNote", CreditNote: creditNote}
+		json.NewEncoder(w).Encode(response)
+
+	default:
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		response := Response{Message: "No price difference", Type: "None"}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Total charged and refunded across all invoices of a booking
+func bookingCharges(tx *sql.Tx, bookingId string) (money.Money, money.Money, error) {
+	var charged, refunded money.Money
+	query := `SELECT COALESCE(SUM(total_amount), 0) FROM invoice WHERE booking_id = ? AND status <> 'Void'`
+	if err := tx.QueryRow(query, bookingId).Scan(&charged); err != nil {
+		return 0, 0, err
+	}
+	query = `SELECT COALESCE(SUM(cn.amount), 0) FROM credit_note cn INNER JOIN invoice i ON cn.invoice_id = i.invoice_id WHERE i.booking_id = ?`
+	if err := tx.QueryRow(query, bookingId).Scan(&refunded); err != nil {
+		return 0, 0, err
+	}
+	return charged, refunded, nil
+}
+
+// Get an invoice by id within a transaction
+func getInvoiceByID(tx *sql.Tx, invoiceId int64) (*Invoice, error) {
+	var invoice Invoice
+	query := "SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id FROM invoice WHERE invoice_id = ?"
+	err := tx.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status, &invoice.InvoiceType, &invoice.ParentInvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// Get a credit note by id within a transaction
+func getCreditNoteByID(tx *sql.Tx, creditNoteId int64) (*CreditNote, error) {
+	var creditNote CreditNote
+	query := "SELECT credit_note_id, invoice_id, billing_id, amount, wallet_amount, refund_percentage, reason, issue_date, refund_status FROM credit_note WHERE credit_note_id = ?"
+	err := tx.QueryRow(query, creditNoteId).Scan(&creditNote.CreditNoteID, &creditNote.InvoiceID, &creditNote.BillingID, &creditNote.Amount, &creditNote.WalletAmount, &creditNote.RefundPercentage, &creditNote.Reason, &creditNote.IssueDate, &creditNote.RefundStatus)
+	if err != nil {
+		return nil, err
+	}
+	creditNote.CardRefunds, err = getCardRefunds(tx, creditNote.CreditNoteID)
+	if err != nil {
+		return nil, err
+	}
+	return &creditNote, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Everything shown on a printable invoice or receipt
+type BillingDocument struct {
+	Title         string
+	Number        string
+	IssueDate     string
+	Invoice       Invoice
+	Receipt       *Receipt
+	PaymentMethod string
+}
+
+// Template of the HTML documents; it only uses stored data so the same document always renders the same
+const billingDocumentTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} {{.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; margin: 40px; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ccc; padding: 6px; text-align: left; }
+td.amount, th.amount { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Electric Car Sharing - {{.Title}}</h1>
+<p><strong>{{.Title}} No:</strong> {{.Number}}<br>
+<strong>Date:</strong> {{.IssueDate}}<br>
+<strong>Invoice ID:</strong> {{.Invoice.InvoiceID}}<br>
+{{if .Invoice.BookingID}}<strong>Booking ID:</strong> {{.Invoice.BookingID}}<br>{{end}}
+<strong>Status:</strong> {{.Invoice.Status}}</p>
+<p><strong>Booking details:</strong> {{.Invoice.Details}}</p>
+<table>
+<tr><th>Description</th><th class="amount">Quantity</th><th class="amount">Unit price</th><th class="amount">Amount</th></tr>
+{{- range .Invoice.LineItems}}
+<tr><td>{{.Description}}</td><td class="amount">{{quantity .Quantity}}</td><td class="amount">{{decimal .UnitPrice}}</td><td class="amount">{{money .Amount}}</td></tr>
+{{- end}}
+</table>
+<p><strong>Total before discounts:</strong> ${{money .Invoice.BaseCost}}<br>
+{{- if .Invoice.PromotionCode}}
+<strong>Promo code:</strong> {{.Invoice.PromotionCode}}<br>
+{{- end}}
+<strong>Total discount:</strong> ${{money .Invoice.DiscountApplied}}<br>
+<strong>Total:</strong> ${{money .Invoice.TotalAmount}}</p>
+{{- range .Invoice.CreditNotes}}
+<p><strong>Refund ({{.Reason}}, {{decimal .RefundPercentage}}%):</strong> ${{money .Amount}} on {{.IssueDate}}</p>
+{{- end}}
+{{- if .Receipt}}
+<p><strong>Amount paid:</strong> ${{money .Receipt.Amount}} on {{.Receipt.Date}}<br>
+<strong>Description:</strong> {{.Receipt.Description}}</p>
+{{- end}}
+{{- if .PaymentMethod}}
+<p><strong>Paid with:</strong> {{.PaymentMethod}}</p>
+{{- end}}
+</body>
+</html>
+`
+
+var billingDocumentHTML = template.Must(template.New("document").Funcs(template.FuncMap{
+	"money":    formatMoney,
+	"decimal":  formatDecimal,
+	"quantity": formatQuantity,
+}).Parse(billingDocumentTemplate))
+
+// Format an amount with two decimals
+func formatMoney(amount money.Money) string {
+	return amount.String()
+}
+
+// Format a unit price or percentage with two decimals
+func formatDecimal(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// Format a quantity without trailing zeros
+func formatQuantity(quantity float64) string {
+	return strconv.FormatFloat(quantity, 'f', -1, 64)
+}
+
+// Load an invoice with its line items, credit notes and the card it was paid with
+func loadInvoiceDocument(invoiceId int) (*BillingDocument, error) {
+	var invoice Invoice
+	query := "SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id FROM invoice WHERE invoice_id = ?"
+	err := db.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status, &invoice.InvoiceType, &invoice.ParentInvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	creditNotes, err := getCreditNotesByUserID(strconv.Itoa(invoice.UserID))
+	if err != nil {
+		return nil, err
+	}
+	invoice.CreditNotes = creditNotes[invoice.InvoiceID]
+
+	// Unpaid invoices have no payment yet
+	var lastFour string
+	var walletAmount money.Money
+	query = "SELECT COALESCE(c.last_four, ''), b.wallet_amount FROM billing b LEFT JOIN card c ON b.card_id = c.card_id WHERE b.invoice_id = ? ORDER BY b.billing_id LIMIT 1"
+	err = db.QueryRow(query, invoice.InvoiceID).Scan(&lastFour, &walletAmount)
+	paid := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	document := &BillingDocument{
+		Title:     "Invoice",
+		Number:    fmt.Sprintf("INV-%06d", invoice.InvoiceID),
+		IssueDate: invoice.IssueDate,
+		Invoice:   invoice,
+	}
+	if paid {
+		document.PaymentMethod = paymentMethodLabel(lastFour, walletAmount)
+	}
+	return document, nil
+}
+
+// Load a receipt together with the invoice it pays
+func loadReceiptDocument(billingId int) (*BillingDocument, error) {
+	var receipt Receipt
+	var lastFour string
+	var invoiceId int
+	query := `
+		SELECT r.receipt_id, r.billing_id, r.card_id, r.amount, b.wallet_amount, r.date, r.description, COALESCE(c.last_four, ''), b.invoice_id
+		FROM receipt r
+		LEFT JOIN card c ON r.card_id = c.card_id
+		INNER JOIN billing b ON r.billing_id = b.billing_id
+		WHERE r.billing_id = ?
+	`
+	err := db.QueryRow(query, billingId).Scan(&receipt.ReceiptID, &receipt.BillingID, &receipt.CardID, &receipt.Amount, &receipt.WalletAmount, &receipt.Date, &receipt.Description, &lastFour, &invoiceId)
+	if err != nil {
+		return nil, err
+	}
+	document, err := loadInvoiceDocument(invoiceId)
+	if err != nil {
+		return nil, err
+	}
+	receipt.PaymentMethod = paymentMethodLabel(lastFour, receipt.WalletAmount)
+	document.Title = "Receipt"
+	document.Number = fmt.Sprintf("RCT-%06d", receipt.ReceiptID)
+	document.IssueDate = receipt.Date
+	document.Receipt = &receipt
+	document.PaymentMethod = receipt.PaymentMethod
+	return document, nil
+}
+
+// Render the document as HTML
+func renderDocumentHTML(document *BillingDocument) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := billingDocumentHTML.Execute(&buffer, document); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Render the document as PDF. The PDF dates are taken from the document so repeated renders are identical.
+func renderDocumentPDF(document *BillingDocument) ([]byte, error) {
+	issued, err := time.Parse("2006-01-02 15:04:05", document.IssueDate)
+	if err != nil {
+		issued = time.Unix(0, 0).UTC()
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetCreationDate(issued)
+	pdf.SetModificationDate(issued)
+	pdf.SetCatalogSort(true)
+	pdf.SetTitle(document.Title+" "+document.Number, true)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	// Heading
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, tr("Electric Car Sharing - "+document.Title), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	invoice := document.Invoice
+	header := []string{
+		document.Title + " No: " + document.Number,
+		"Date: " + document.IssueDate,
+		"Invoice ID: " + strconv.Itoa(invoice.InvoiceID),
+	}
+	if invoice.BookingID != nil {
+		header = append(header, "Booking ID: "+strconv.Itoa(*invoice.BookingID))
+	}
+	header = append(header, "Status: "+invoice.Status)
+	for _, line := range header {
+		pdf.CellFormat(0, 6, tr(line), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(2)
+	pdf.MultiCell(0, 6, tr("Booking details: "+invoice.Details), "", "L", false)
+	pdf.Ln(2)
+
+	// Line items
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(100, 7, "Description", "B", 0, "L", false, 0, "")
+	pdf.CellFormat(25, 7, "Quantity", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 7, "Unit price", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(35, 7, "Amount", "B", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	for _, item := range invoice.LineItems {
+		pdf.CellFormat(100, 6, tr(item.Description), "", 0, "L", false, 0, "")
+		pdf.CellFormat(25, 6, formatQuantity(item.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 6, formatDecimal(item.UnitPrice), "", 0, "R", false, 0, "")
+		pdf.CellFormat(35, 6, formatMoney(item.Amount), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	// Totals, refunds and payment
+	pdf.SetFont("Helvetica", "", 10)
+	lines := []string{"Total before discounts: $" + formatMoney(invoice.BaseCost)}
+	if invoice.PromotionCode != nil {
+		lines = append(lines, "Promo code: "+*invoice.PromotionCode)
+	}
+	lines = append(lines, "Total discount: $"+formatMoney(invoice.DiscountApplied), "Total: $"+formatMoney(invoice.TotalAmount))
+	for _, creditNote := range invoice.CreditNotes {
+		lines = append(lines, fmt.Sprintf("Refund (%s, %s%%): $%s on %s", creditNote.Reason, formatDecimal(creditNote.RefundPercentage), formatMoney(creditNote.Amount), creditNote.IssueDate))
+	}
+	if document.Receipt != nil {
+		lines = append(lines, "Amount paid: $"+formatMoney(document.Receipt.Amount)+" on "+document.Receipt.Date, "Description: "+document.Receipt.Description)
+	}
+	if document.PaymentMethod != "" {
+		lines = append(lines, "Paid with: "+document.PaymentMethod)
+	}
+	for _, line := range lines {
+		pdf.MultiCell(0, 6, tr(line), "", "L", false)
+	}
+
+	var buffer bytes.Buffer
+	if err := pdf.Output(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Write the document in the requested format (?format=html, the default, or ?format=pdf)
+func writeDocument(w http.ResponseWriter, r *http.Request, document *BillingDocument) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "html"
+	}
+
+	var body []byte
+	var err error
+	switch format {
+	case "html":
+		body, err = renderDocumentHTML(document)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case "pdf":
+		body, err = renderDocumentPDF(document)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", document.Number+".pdf"))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Message string `json:"message"`
+		}{"Format must be html or pdf"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error rendering document", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Get a printable invoice by invoice_id
+func getInvoiceDocument(w http.ResponseWriter, r *http.Request) {
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Get the invoice_id from the request
+	invoiceId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid invoice id"})
+		return
+	}
+
+	document, err := loadInvoiceDocument(invoiceId)
+	// Only the owner of the invoice may view it
+	if err == sql.ErrNoRows || (err == nil && !auth.OwnsResource(r, document.Invoice.UserID)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{"Invoice not found"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error querying invoice", http.StatusInternalServerError)
+		return
+	}
+	writeDocument(w, r, document)
+}
+
+// Get a printable receipt by billing_id
+func getReceiptDocument(w http.ResponseWriter, r *http.Request) {
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Get the billing_id from the request
+	billingId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid billing id"})
+		return
+	}
+
+	document, err := loadReceiptDocument(billingId)
+	// Only the owner of the receipt may view it
+	if err == sql.ErrNoRows || (err == nil && !auth.OwnsResource(r, document.Invoice.UserID)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{"Receipt not found"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error querying receipt", http.StatusInternalServerError)
+		return
+	}
+	writeDocument(w, r, document)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Rewrite the golden files with: go test -run TestRender -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// An invoice with a membership and a promotion discount, partly refunded
+func discountedInvoiceDocument() *BillingDocument {
+	bookingId := 5
+	promoCode := "CHRISTMAS15"
+	return &BillingDocument{
+		Title:     "Invoice",
+		Number:    "INV-000005",
+		IssueDate: "2024-12-01 09:30:00",
+		Invoice: Invoice{
+			InvoiceID:       5,
+			BookingID:       &bookingId,
+			UserID:          2,
+			IssueDate:       "2024-12-01 09:30:00",
+			BaseCost:        300_00,
+			PromotionCode:   &promoCode,
+			DiscountApplied: 70_50,
+			TotalAmount:     229_50,
+			Details:         "Reserved the BMW 5 Series on 2024-12-22 from 04:00 PM to 06:00 PM",
+			Status:          "Paid",
+			InvoiceType:     "Booking",
+			LineItems: []LineItem{
+				{LineItemID: 8, InvoiceID: 5, ItemType: "Rental", Description: "Rental of the BMW 5 Series on 2024-12-22 from 16:00:00 to 18:00:00", Quantity: 2, UnitPrice: 150, Amount: 300_00},
+				{LineItemID: 9, InvoiceID: 5, ItemType: "Discount", Description: "Membership discount", Quantity: 1, UnitPrice: -30, Amount: -30_00},
+				{LineItemID: 10, InvoiceID: 5, ItemType: "Discount", Description: "Promotion discount (CHRISTMAS15)", Quantity: 1, UnitPrice: -40.5, Amount: -40_50},
+			},
+			CreditNotes: []CreditNote{
+				{CreditNoteID: 1, InvoiceID: 5, BillingID: 5, Amount: 114_75, RefundPercentage: 50, Reason: "Cancellation", IssueDate: "2024-12-21 10:00:00"},
+			},
+		},
+		PaymentMethod: "**** **** **** 5678",
+	}
+}
+
+// A receipt for an invoice paid partly from the wallet
+func receiptDocument() *BillingDocument {
+	document := discountedInvoiceDocument()
+	document.Invoice.CreditNotes = nil
+	document.Title = "Receipt"
+	document.Number = "RCT-000005"
+	document.IssueDate = "2024-12-01 09:31:12"
+	document.Receipt = &Receipt{
+		ReceiptID:     5,
+		BillingID:     5,
+		Amount:        229_50,
+		WalletAmount:  29_50,
+		Date:          "2024-12-01 09:31:12",
+		Description:   "Payment for booking 5: BMW 5 Series, 2024-12-22, 04:00 PM to 06:00 PM",
+		PaymentMethod: "**** **** **** 5678 and wallet ($29.50)",
+	}
+	document.PaymentMethod = document.Receipt.PaymentMethod
+	return document
+}
+
+// Compare a render with its golden file in testdata, or rewrite the file with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match the render (%d bytes, want %d); rerun with -update if the change is intended", path, len(got), len(want))
+	}
+}
+
+func TestRenderDocumentHTML(t *testing.T) {
+	tests := []struct {
+		golden   string
+		document *BillingDocument
+	}{
+		{"invoice_discounted.html", discountedInvoiceDocument()},
+		{"receipt.html", receiptDocument()},
+	}
+	for _, tt := range tests {
+		got, err := renderDocumentHTML(tt.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tt.golden, got)
+	}
+}
+
+func TestRenderDocumentPDF(t *testing.T) {
+	tests := []struct {
+		golden   string
+		document *BillingDocument
+	}{
+		{"invoice_discounted.pdf", discountedInvoiceDocument()},
+		{"receipt.pdf", receiptDocument()},
+	}
+	for _, tt := range tests {
+		got, err := renderDocumentPDF(tt.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The same document renders to the same bytes every time
+		again, err := renderDocumentPDF(tt.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, again) {
+			t.Errorf("%s: two renders of the same document differ", tt.golden)
+		}
+		checkGolden(t, tt.golden, got)
+	}
+}
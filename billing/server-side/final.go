@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+)
+
+// Completed booking with its actual pickup and return (response from the vehicle service)
+type TripDetails struct {
+	VehicleBookingDetails
+	ActualStart *string `json:"actual_start"`
+	ActualEnd   *string `json:"actual_end"`
+}
+
+// Charges for returning a vehicle after the booked end time, configurable through the environment
+var (
+	// Overtime is charged per minute at the vehicle's hourly rate times this multiplier
+	overtimeRateMultiplier = getEnvFloat("OVERTIME_RATE_MULTIPLIER", 1.5)
+	// Returns within the grace period are not charged
+	lateReturnGrace = getEnvDuration("LATE_RETURN_GRACE", 15*time.Minute)
+	// Flat penalty added to any return later than the grace period
+	lateReturnPenalty = getEnvMoney("LATE_RETURN_PENALTY", 20_00)
+)
+
+// Returned by getTripDetails when the booking is not completed yet
+var errTripNotCompleted = errors.New("trip not completed")
+
+// Get the completed booking and its actual usage from the vehicle service
+func getTripDetails(userId string, bookingId string) (*TripDetails, error) {
+	// Struct for response from the vehicle service
+	type Response struct {
+		Message string      `json:"message"`
+		Trip    TripDetails `json:"trip"`
+	}
+
+	// URL of the vehicle service
+	tripServiceURL := vehicleServiceURL + "/api/v1/trip-details/" + userId + "/" + bookingId
+
+	// Send GET request to the vehicle service to get the trip
+	resp, err := auth.ServiceGet(tripServiceURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trip data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Create a Response object to hold the data returned from the vehicle service
+	var response Response
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Decode the response into the Response struct
+		err := json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode trip data: %v", err)
+		}
+		return &response.Trip, nil
+
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("booking not found")
+
+	case http.StatusConflict:
+		return nil, errTripNotCompleted
+
+	default:
+		return nil, fmt.Errorf("failed to get trip data, status code: %d", resp.StatusCode)
+	}
+}
+
+// Price the actual usage of a trip as line items: the booked rental and its discounts,
+// then any overtime and late-return penalty
+func finalLineItems(trip *TripDetails, membershipDiscount float64) ([]LineItem, error) {
+	// The booked rental, as priced when it was booked
+	items, err := bookingLineItems(&trip.VehicleBookingDetails)
+	if err != nil {
+		return nil, err
+	}
+	bookedEnd, err := time.Parse("2006-01-02 15:04:05", trip.ScheduleDate+" "+trip.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overtime and penalty for a return later than the grace period; a trip that was never picked up has no return time
+	if trip.ActualEnd != nil {
+		actualEnd, err := time.Parse("2006-01-02 15:04:05", *trip.ActualEnd)
+		if err != nil {
+			return nil, err
+		}
+		lateBy := actualEnd.Sub(bookedEnd)
+		if lateBy > lateReturnGrace {
+			minutes := math.Ceil(lateBy.Minutes())
+			perMinute := trip.HourlyRate.Float64() / 60 * overtimeRateMultiplier
+			overtime := trip.HourlyRate.MulDiv(int64(minutes)*int64(math.Round(overtimeRateMultiplier*100)), 60*100)
+			items = append(items, LineItem{ItemType: lineItemFee, Description: fmt.Sprintf("Overtime until %s (%.0f min at %gx the hourly rate)", actualEnd.Format("15:04"), minutes, overtimeRateMultiplier), Quantity: minutes, UnitPrice: perMinute, Amount: overtime})
+
+			// Members keep their discount on the overtime, but not on the penalty
+			if membershipDiscount > 0 {
+				discount := overtime.Percent(membershipDiscount)
+				items = append(items, LineItem{ItemType: lineItemDiscount, Description: fmt.Sprintf("Membership discount on overtime (%g%%)", membershipDiscount), Quantity: 1, UnitPrice: -discount.Float64(), Amount: -discount})
+			}
+			if lateReturnPenalty > 0 {
+				items = append(items, LineItem{ItemType: lineItemFee, Description: "Late return penalty", Quantity: 1, UnitPrice: lateReturnPenalty.Float64(), Amount: lateReturnPenalty})
+			}
+		}
+	}
+	return items, nil
+}
+
+// Issue the final invoice of a completed booking, billing its actual usage.
+// Called by the vehicle service when a trip ends, and by the user if that call did not get through.
+func finalInvoice(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string   `json:"message"`
+		Invoice *Invoice `json:"invoice"`
+	}
+
+	// Get the user_id and booking_id from the request
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["booking_id"]
+
+	// Get the actual usage from the vehicle service
+	trip, err := getTripDetails(userId, bookingId)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, errTripNotCompleted) {
+			w.WriteHeader(http.StatusConflict)
+			response := Response{"Booking is not completed yet", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Booking not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The user's membership discount also applies to overtime
+	user, err := validateUser(userId)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		response := Response{"Failed to get user details", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	membership, err := getMembershipDetails(user.MembershipId)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		response := Response{"Failed to get membership details", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Find the paid booking invoice, locking it against concurrent adjustments
+	query := `
+		SELECT invoice_id
+		FROM invoice
+		WHERE booking_id = ? AND user_id = ? AND invoice_type = 'Booking' AND status IN ('Paid', 'PartiallyRefunded')
+		FOR UPDATE`
+	var bookingInvoiceId int
+	err = tx.QueryRow(query, bookingId, userId).Scan(&bookingInvoiceId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"No paid invoice found for booking", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A booking has a single final invoice, so return the existing one on retries
+	var finalInvoiceId int64
+	err = tx.QueryRow("SELECT invoice_id FROM invoice WHERE booking_id = ? AND invoice_type = 'Final'", bookingId).Scan(&finalInvoiceId)
+	if err == nil {
+		invoice, err := getInvoiceByID(tx, finalInvoiceId)
+		if err != nil {
+			http.Error(w, "Error querying invoice", http.StatusInternalServerError)
+			return
+		}
+		invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+		if err != nil {
+			http.Error(w, "Error querying line items", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		response := Response{"Final invoice already issued", invoice}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != sql.ErrNoRows {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A payment in flight would be missed by the final invoice
+	var processing int
+	err = tx.QueryRow("SELECT COUNT(*) FROM invoice WHERE booking_id = ? AND status = 'Processing'", bookingId).Scan(&processing)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if processing > 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"A payment for this booking is in progress", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Unpaid supplementary invoices are settled by the final invoice instead
+	_, err = tx.Exec("UPDATE invoice SET status = 'Void' WHERE booking_id = ? AND invoice_type = 'Supplementary' AND status = 'Pending'", bookingId)
+	if err != nil {
+		http.Error(w, "Error voiding supplementary invoices", http.StatusInternalServerError)
+		return
+	}
+
+	// Price the usage against what was paid so far
+	charged, refunded, err := bookingCharges(tx, bookingId)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	items, err := finalLineItems(trip, membership.HourlyRateDiscount)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error pricing trip", http.StatusInternalServerError)
+		return
+	}
+	items = addTaxLineItem(items)
+
+	// Deduct what the user already paid for the booking, net of refunds
+	prepaid := charged - refunded
+	if prepaid > 0 {
+		items = append(items, LineItem{ItemType: lineItemAdjustment, Description: "Paid for booking", Quantity: 1, UnitPrice: -prepaid.Float64(), Amount: -prepaid})
+	}
+	baseCost, discount, totalAmount := invoiceTotals(items)
+
+	// Nothing is owed when the vehicle was returned on time
+	status := "Pending"
+	if totalAmount <= 0 {
+		status = "Paid"
+	}
+	details := "Final invoice for the " + trip.Brand + " " + trip.Model + " on " + trip.ScheduleDate
+	if trip.ActualEnd != nil {
+		details += ", returned at " + *trip.ActualEnd
+	}
+	query = "INSERT INTO invoice (booking_id, user_id, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'Final', ?)"
+	result, err := tx.Exec(query, bookingId, userId, baseCost, trip.PromotionCode, discount, totalAmount, details, status, bookingInvoiceId)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error inserting invoice", http.StatusInternalServerError)
+		return
+	}
+	finalInvoiceId, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Error getting invoice id", http.StatusInternalServerError)
+		return
+	}
+	if err := insertLineItems(tx, finalInvoiceId, items); err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error inserting line items", http.StatusInternalServerError)
+		return
+	}
+	invoice, err := getInvoiceByID(tx, finalInvoiceId)
+	if err != nil {
+		http.Error(w, "Error querying invoice", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+	if err != nil {
+		http.Error(w, "Error querying line items", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the user know the final invoice was issued
+	go notifyUser(userId, "invoice", invoiceNotification(invoice))
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Final invoice issued", invoice}
+	json.NewEncoder(w).Encode(response)
+}
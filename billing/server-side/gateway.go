@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/money"
+)
+
+// Card details as entered by the user. They are handed straight to the payment gateway and never stored.
+type CardDetails struct {
+	CardNumber string `json:"card_number"`
+	CardExpiry string `json:"card_expiry"`
+	CVV        string `json:"cvv"`
+}
+
+// What the gateway returns for a card: a token to charge it with later and the details that are safe to keep
+type TokenizedCard struct {
+	Token      string
+	Brand      string
+	LastFour   string
+	CardExpiry string
+}
+
+// Processes card payments, e.g. a card processor's API or a local stand-in during development.
+// Charges and refunds carry a reference; repeating a reference does not move the money twice.
+type PaymentGateway interface {
+	Tokenize(card CardDetails) (*TokenizedCard, error)
+	Charge(token string, amount money.Money, reference string) error
+	Refund(token string, amount money.Money, reference string) error
+}
+
+var (
+	// The card details were rejected when tokenizing
+	errInvalidCard = errors.New("invalid card details")
+	// The gateway refused to charge the card
+	errCardDeclined = errors.New("card declined")
+)
+
+// Gateway used for all card payments, configurable through the environment
+var paymentGateway = newPaymentGateway("PAYMENT_GATEWAY", "fake")
+
+// Create the gateway named by the environment variable; only "fake" exists so far.
+// An unknown name stops the service rather than taking payments through the wrong gateway.
+func newPaymentGateway(key string, defaultValue string) PaymentGateway {
+	name := os.Getenv(key)
+	if name == "" {
+		name = defaultValue
+	}
+	switch name {
+	case "fake":
+		return newFakeGateway()
+	default:
+		log.Fatalf("Unknown %s %q, must be \"fake\"", key, name)
+		return nil
+	}
+}
+
+// Card number the fake gateway accepts but declines every charge to, like a card processor's test cards
+const fakeDeclinedCardNumber = "4000000000000002"
+
+// Token prefixes issued by the fake gateway
+const (
+	fakeTokenPrefix         = "tok_fake_"
+	fakeDeclinedTokenPrefix = "tok_fake_declined_"
+)
+
+// Approves charges and refunds without moving any money, standing in for a real gateway.
+// Cards tokenized from fakeDeclinedCardNumber are declined instead. Like a real gateway, it
+// remembers each reference and answers a repeated one with the first outcome.
+type fakeGateway struct {
+	mu       sync.Mutex
+	charged  map[string]error // outcome of each charge, by reference
+	refunded map[string]error // outcome of each refund, by reference
+}
+
+func newFakeGateway() *fakeGateway {
+	return &fakeGateway{charged: make(map[string]error), refunded: make(map[string]error)}
+}
+
+func (g *fakeGateway) Tokenize(card CardDetails) (*TokenizedCard, error) {
+	number := strings.ReplaceAll(card.CardNumber, " ", "")
+	if !validCardNumber(number) || !validCVV(card.CVV) {
+		return nil, errInvalidCard
+	}
+	expired, err := cardExpired(card.CardExpiry, time.Now())
+	if err != nil || expired {
+		return nil, errInvalidCard
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	prefix := fakeTokenPrefix
+	if number == fakeDeclinedCardNumber {
+		prefix = fakeDeclinedTokenPrefix
+	}
+	return &TokenizedCard{
+		Token:      prefix + hex.EncodeToString(random),
+		Brand:      cardBrand(number),
+		LastFour:   number[len(number)-4:],
+		CardExpiry: card.CardExpiry,
+	}, nil
+}
+
+func (g *fakeGateway) Charge(token string, amount money.Money, reference string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if outcome, ok := g.charged[reference]; ok {
+		return outcome
+	}
+	var outcome error
+	if strings.HasPrefix(token, fakeDeclinedTokenPrefix) {
+		outcome = errCardDeclined
+	}
+	g.charged[reference] = outcome
+	return outcome
+}
+
+func (g *fakeGateway) Refund(token string, amount money.Money, reference string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if outcome, ok := g.refunded[reference]; ok {
+		return outcome
+	}
+	g.refunded[reference] = nil
+	return nil
+}
+
+// Check the length and Luhn checksum of a card number
+func validCardNumber(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range number {
+		digit := int(number[len(number)-1-i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+func validCVV(cvv string) bool {
+	if len(cvv) < 3 || len(cvv) > 4 {
+		return false
+	}
+	for _, c := range cvv {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Card network, from the leading digits of the number
+func cardBrand(number string) string {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return "Visa"
+	case number[:2] >= "51" && number[:2] <= "55", number[:4] >= "2221" && number[:4] <= "2720":
+		return "Mastercard"
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		return "American Express"
+	default:
+		return "Card"
+	}
+}
+
+// Check whether a card with an MM/YY expiry has expired; cards are valid until the end of the month
+func cardExpired(expiry string, now time.Time) (bool, error) {
+	month, err := time.Parse("01/06", expiry)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(month.AddDate(0, 1, 0)), nil
+}
+
+// Charge a stored card through the gateway
+func chargeCard(q queryRower, cardID int, amount money.Money, reference string) error {
+	var token string
+	if err := q.QueryRow("SELECT gateway_token FROM card WHERE card_id = ?", cardID).Scan(&token); err != nil {
+		return err
+	}
+	return paymentGateway.Charge(token, amount, reference)
+}
+
+// Refund an amount to a stored card through the gateway
+func refundCard(q queryRower, cardID int, amount money.Money, reference string) error {
+	var token string
+	if err := q.QueryRow("SELECT gateway_token FROM card WHERE card_id = ?", cardID).Scan(&token); err != nil {
+		return err
+	}
+	return paymentGateway.Refund(token, amount, reference)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"shared/money"
+)
+
+// A gateway call seen by recordingGateway
+type gatewayCall struct {
+	token     string
+	amount    money.Money
+	reference string
+}
+
+// The fake gateway, recording the charges and refunds it made. Repeated references are not recorded again.
+type recordingGateway struct {
+	*fakeGateway
+	charges []gatewayCall
+	refunds []gatewayCall
+}
+
+func (g *recordingGateway) Charge(token string, amount money.Money, reference string) error {
+	g.mu.Lock()
+	_, repeated := g.charged[reference]
+	g.mu.Unlock()
+	if !repeated {
+		g.charges = append(g.charges, gatewayCall{token, amount, reference})
+	}
+	return g.fakeGateway.Charge(token, amount, reference)
+}
+
+func (g *recordingGateway) Refund(token string, amount money.Money, reference string) error {
+	g.mu.Lock()
+	_, repeated := g.refunded[reference]
+	g.mu.Unlock()
+	if !repeated {
+		g.refunds = append(g.refunds, gatewayCall{token, amount, reference})
+	}
+	return g.fakeGateway.Refund(token, amount, reference)
+}
+
+// Point the service at a mock database and a recording fake gateway for the test
+func setUpGatewayTest(t *testing.T) (sqlmock.Sqlmock, *recordingGateway) {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := &recordingGateway{fakeGateway: newFakeGateway()}
+	previousDB, previousGateway := db, paymentGateway
+	db, paymentGateway = mockDB, gateway
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db, paymentGateway = previousDB, previousGateway
+		mockDB.Close()
+	})
+	return mock, gateway
+}
+
+func expectCardToken(mock sqlmock.Sqlmock, cardID int, token string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT gateway_token FROM card WHERE card_id = ?")).
+		WithArgs(cardID).
+		WillReturnRows(sqlmock.NewRows([]string{"gateway_token"}).AddRow(token))
+}
+
+func TestFakeGatewayDeclinedCard(t *testing.T) {
+	gateway := newFakeGateway()
+
+	declined, err := gateway.Tokenize(CardDetails{CardNumber: fakeDeclinedCardNumber, CardExpiry: "12/45", CVV: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Charge(declined.Token, 10_00, "ref-1"); !errors.Is(err, errCardDeclined) {
+		t.Errorf("charge to the declined test card: %v, want %v", err, errCardDeclined)
+	}
+
+	accepted, err := gateway.Tokenize(CardDetails{CardNumber: "4242 4242 4242 4242", CardExpiry: "12/45", CVV: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.LastFour != "4242" || accepted.Brand != "Visa" {
+		t.Errorf("tokenized card is %s ending %s, want Visa ending 4242", accepted.Brand, accepted.LastFour)
+	}
+	if err := gateway.Charge(accepted.Token, 10_00, "ref-2"); err != nil {
+		t.Errorf("charge to a good card: %v", err)
+	}
+	if err := gateway.Refund(accepted.Token, 10_00, "ref-2-refund"); err != nil {
+		t.Errorf("refund to a good card: %v", err)
+	}
+
+	// A repeated reference gets the first outcome, even for another card
+	if err := gateway.Charge(declined.Token, 10_00, "ref-2"); err != nil {
+		t.Errorf("charge repeating an approved reference: %v", err)
+	}
+	if err := gateway.Charge(accepted.Token, 10_00, "ref-1"); !errors.Is(err, errCardDeclined) {
+		t.Errorf("charge repeating a declined reference: %v, want %v", err, errCardDeclined)
+	}
+
+	if _, err := gateway.Tokenize(CardDetails{CardNumber: "4242 4242 4242 4241", CardExpiry: "12/45", CVV: "123"}); !errors.Is(err, errInvalidCard) {
+		t.Errorf("card failing the checksum: %v, want %v", err, errInvalidCard)
+	}
+}
+
+// A declined card fails the saga, gives the wallet's part back and releases the invoice
+func TestPaymentSagaDeclinedCard(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	saga := &PaymentSaga{
+		SagaID:       7,
+		InvoiceID:    3,
+		BookingID:    5,
+		UserID:       2,
+		CardID:       sql.NullInt64{Int64: 4, Valid: true},
+		Amount:       30_00,
+		WalletAmount: 5_00,
+		State:        sagaCharging,
+		Reference:    sql.NullString{String: "saga-7", Valid: true},
+	}
+
+	expectCardToken(mock, 4, fakeDeclinedTokenPrefix+"abc")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET attempts = attempts + 1")).
+		WithArgs(errCardDeclined.Error(), saga.SagaID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET state = ? WHERE saga_id = ? AND state = ?")).
+		WithArgs(sagaFailed, saga.SagaID, sagaCharging).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO wallet")).WithArgs(saga.UserID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM wallet WHERE user_id = ? FOR UPDATE")).
+		WithArgs(saga.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(saga.UserID))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(amount), 0) FROM ledger_entry")).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("0.00"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ledger_transaction")).
+		WithArgs(saga.UserID, ledgerRefund, saga.InvoiceID, nil, "Refund for invoice 3", "saga-7-refund").
+		WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ledger_entry")).
+		WithArgs(11, accountWallet, saga.UserID, "5.00", 11, accountRevenue, "-5.00").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE invoice SET status = 'Pending' WHERE invoice_id = ?")).
+		WithArgs(saga.InvoiceID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := runPaymentSaga(saga); !errors.Is(err, errCardDeclined) {
+		t.Errorf("runPaymentSaga: %v, want %v", err, errCardDeclined)
+	}
+	if saga.State != sagaFailed {
+		t.Errorf("saga state = %s, want %s", saga.State, sagaFailed)
+	}
+	want := []gatewayCall{{fakeDeclinedTokenPrefix + "abc", 25_00, "saga-7"}}
+	if len(gateway.charges) != 1 || gateway.charges[0] != want[0] {
+		t.Errorf("charges = %v, want %v", gateway.charges, want)
+	}
+	if len(gateway.refunds) != 0 {
+		t.Errorf("refunds = %v, want none for a declined charge", gateway.refunds)
+	}
+}
+
+// A booking the vehicle service refused is refunded to the card under the saga's own refund reference
+func TestPaymentSagaRefundsCard(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	saga := &PaymentSaga{
+		SagaID:    8,
+		InvoiceID: 4,
+		BookingID: 6,
+		UserID:    2,
+		CardID:    sql.NullInt64{Int64: 4, Valid: true},
+		Amount:    42_50,
+		State:     sagaCompensating,
+		Reference: sql.NullString{String: "saga-8", Valid: true},
+	}
+
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET state = ? WHERE saga_id = ? AND state = ?")).
+		WithArgs(sagaRefunded, saga.SagaID, sagaCompensating).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE invoice SET status = 'Pending' WHERE invoice_id = ?")).
+		WithArgs(saga.InvoiceID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := runPaymentSaga(saga); !errors.Is(err, errBookingNotConfirmed) {
+		t.Errorf("runPaymentSaga: %v, want %v", err, errBookingNotConfirmed)
+	}
+	if saga.State != sagaRefunded {
+		t.Errorf("saga state = %s, want %s", saga.State, sagaRefunded)
+	}
+	want := gatewayCall{fakeTokenPrefix + "abc", 42_50, "saga-8-refund"}
+	if len(gateway.refunds) != 1 || gateway.refunds[0] != want {
+		t.Errorf("refunds = %v, want %v", gateway.refunds, []gatewayCall{want})
+	}
+	if len(gateway.charges) != 0 {
+		t.Errorf("charges = %v, want none while compensating", gateway.charges)
+	}
+}
+
+// A saga resumed in Charging after losing the result of its charge charges the card once
+func TestPaymentSagaRetriedChargeChargesOnce(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	saga := &PaymentSaga{
+		SagaID:    9,
+		InvoiceID: 6,
+		BookingID: 7,
+		UserID:    2,
+		CardID:    sql.NullInt64{Int64: 4, Valid: true},
+		Amount:    30_00,
+		State:     sagaCharging,
+		Reference: sql.NullString{String: "saga-9", Valid: true},
+	}
+
+	// The first run charges the card but fails to record it
+	lost := errors.New("connection lost")
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET state = ? WHERE saga_id = ? AND state = ?")).
+		WithArgs(sagaPaymentReserved, saga.SagaID, sagaCharging).
+		WillReturnError(lost)
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET attempts = attempts + 1")).
+		WithArgs(lost.Error(), saga.SagaID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The recovery loop runs it again from Charging, and another worker has since finished it
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_saga SET state = ? WHERE saga_id = ? AND state = ?")).
+		WithArgs(sagaPaymentReserved, saga.SagaID, sagaCharging).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT saga_id, invoice_id, booking_id, user_id, card_id, amount, wallet_amount, state, billing_id, gateway_reference FROM payment_saga")).
+		WithArgs(saga.SagaID).
+		WillReturnRows(sqlmock.NewRows([]string{"saga_id", "invoice_id", "booking_id", "user_id", "card_id", "amount", "wallet_amount", "state", "billing_id", "gateway_reference"}).
+			AddRow(9, 6, 7, 2, 4, "30.00", "0.00", sagaPaymentCaptured, 12, "saga-9"))
+
+	if err := runPaymentSaga(saga); !errors.Is(err, lost) {
+		t.Fatalf("first run: %v, want %v", err, lost)
+	}
+	if err := runPaymentSaga(saga); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	want := gatewayCall{fakeTokenPrefix + "abc", 30_00, "saga-9"}
+	if len(gateway.charges) != 1 || gateway.charges[0] != want {
+		t.Errorf("charges = %v, want %v", gateway.charges, []gatewayCall{want})
+	}
+}
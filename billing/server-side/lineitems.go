@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"shared/money"
+)
+
+// Kinds of invoice lines
+const (
+	lineItemRental     = "Rental"
+	lineItemDiscount   = "Discount"
+	lineItemFee        = "Fee"
+	lineItemTax        = "Tax"
+	lineItemAdjustment = "Adjustment"
+	lineItemMembership = "Membership"
+)
+
+// Line of an invoice, amounts are negative for discounts and payments already made.
+// The unit price is informational and may have more than two decimals, e.g. a per-minute rate;
+// the amount is what is charged.
+type LineItem struct {
+	LineItemID  int         `json:"line_item_id"`
+	InvoiceID   int         `json:"invoice_id"`
+	ItemType    string      `json:"item_type"`
+	Description string      `json:"description"`
+	Quantity    float64     `json:"quantity"`
+	UnitPrice   float64     `json:"unit_price"`
+	Amount      money.Money `json:"amount"`
+}
+
+// Returned by insertLineItems when an invoice total is not the sum of its line items
+var errInvoiceTotalMismatch = errors.New("invoice total does not match its line items")
+
+// Tax charged on rentals and fees after discounts, as a percentage (e.g. 9 for 9% GST)
+var taxRate = getEnvFloat("TAX_RATE", 0)
+
+// Line items of a booking as priced by the vehicle service: the rental time and its discounts
+func bookingLineItems(booking *VehicleBookingDetails) ([]LineItem, error) {
+	start, err := time.Parse("15:04:05", booking.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse("15:04:05", booking.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	description := "Rental of the " + booking.Brand + " " + booking.Model + " on " + booking.ScheduleDate + " from " + booking.StartTime + " to " + booking.EndTime
+	items := []LineItem{{ItemType: lineItemRental, Description: description, Quantity: end.Sub(start).Hours(), UnitPrice: booking.HourlyRate.Float64(), Amount: booking.BaseCost}}
+	if booking.MembershipDiscount > 0 {
+		items = append(items, LineItem{ItemType: lineItemDiscount, Description: "Membership discount", Quantity: 1, UnitPrice: -booking.MembershipDiscount.Float64(), Amount: -booking.MembershipDiscount})
+	}
+	if booking.PromotionDiscount > 0 {
+		promoDescription := "Promotion discount"
+		if booking.PromotionCode != nil {
+			promoDescription += " (" + *booking.PromotionCode + ")"
+		}
+		items = append(items, LineItem{ItemType: lineItemDiscount, Description: promoDescription, Quantity: 1, UnitPrice: -booking.PromotionDiscount.Float64(), Amount: -booking.PromotionDiscount})
+	}
+	return items, nil
+}
+
+// Add the tax on the rentals, memberships, fees and discounts among the items, if a tax rate is configured
+func addTaxLineItem(items []LineItem) []LineItem {
+	if taxRate <= 0 {
+		return items
+	}
+	var taxable money.Money
+	for _, item := range items {
+		if item.ItemType == lineItemRental || item.ItemType == lineItemMembership || item.ItemType == lineItemFee || item.ItemType == lineItemDiscount {
+			taxable += item.Amount
+		}
+	}
+	if taxable <= 0 {
+		return items
+	}
+	tax := taxable.Percent(taxRate)
+	return append(items, LineItem{ItemType: lineItemTax, Description: fmt.Sprintf("Tax (%g%%)", taxRate), Quantity: taxable.Float64(), UnitPrice: taxRate / 100, Amount: tax})
+}
+
+// Sum the items into the invoice's base cost (rentals, memberships and fees), discount applied and total
+func invoiceTotals(items []LineItem) (money.Money, money.Money, money.Money) {
+	var baseCost, discount, total money.Money
+	for _, item := range items {
+		switch item.ItemType {
+		case lineItemRental, lineItemMembership, lineItemFee:
+			baseCost += item.Amount
+		case lineItemDiscount:
+			discount -= item.Amount
+		}
+		total += item.Amount
+	}
+	return baseCost, discount, total
+}
+
+// Record the line items of an invoice, checking that the stored total is exactly their sum
+func insertLineItems(tx *sql.Tx, invoiceId int64, items []LineItem) error {
+	query := "INSERT INTO invoice_line_item (invoice_id, item_type, description, quantity, unit_price, amount) VALUES (?, ?, ?, ?, ?, ?)"
+	for _, item := range items {
+		if _, err := tx.Exec(query, invoiceId, item.ItemType, item.Description, item.Quantity, item.UnitPrice, item.Amount); err != nil {
+			return err
+		}
+	}
+
+	var total, sum money.Money
+	query = "SELECT i.total_amount, COALESCE(SUM(li.amount), 0) FROM invoice i LEFT JOIN invoice_line_item li ON li.invoice_id = i.invoice_id WHERE i.invoice_id = ? GROUP BY i.invoice_id, i.total_amount"
+	if err := tx.QueryRow(query, invoiceId).Scan(&total, &sum); err != nil {
+		return err
+	}
+	if total != sum {
+		return fmt.Errorf("%w: total %s, line items %s", errInvoiceTotalMismatch, total, sum)
+	}
+	return nil
+}
+
+// Get the line items of an invoice
+func getLineItemsByInvoiceID(invoiceId int) ([]LineItem, error) {
+	query := "SELECT line_item_id, invoice_id, item_type, description, quantity, unit_price, amount FROM invoice_line_item WHERE invoice_id = ? ORDER BY line_item_id"
+	rows, err := db.Query(query, invoiceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []LineItem
+	for rows.Next() {
+		var item LineItem
+		if err := rows.Scan(&item.LineItemID, &item.InvoiceID, &item.ItemType, &item.Description, &item.Quantity, &item.UnitPrice, &item.Amount); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Get the line items of the user's invoices, keyed by invoice_id
+func getLineItemsByUserID(userId string) (map[int][]LineItem, error) {
+	query := `
+		SELECT li.line_item_id, li.invoice_id, li.item_type, li.description, li.quantity, li.unit_price, li.amount
+		FROM invoice_line_item li
+		INNER JOIN invoice i ON li.invoice_id = i.invoice_id
+		WHERE i.user_id = ?
+		ORDER BY li.line_item_id`
+	rows, err := db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lineItems := make(map[int][]LineItem)
+	for rows.Next() {
+		var item LineItem
+		if err := rows.Scan(&item.LineItemID, &item.InvoiceID, &item.ItemType, &item.Description, &item.Quantity, &item.UnitPrice, &item.Amount); err != nil {
+			return nil, err
+		}
+		lineItems[item.InvoiceID] = append(lineItems[item.InvoiceID], item)
+	}
+	return lineItems, rows.Err()
+}
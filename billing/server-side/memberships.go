@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Charge a membership subscription or renewal to the user's card, issuing a paid membership invoice.
+// Called by the user service, which works out the (prorated) amount.
+func chargeMembership(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message   string   `json:"message"`
+		Invoice   *Invoice `json:"invoice"`
+		BillingID int64    `json:"billing_id,omitempty"`
+	}
+
+	// Struct for the request body
+	var chargeRequest struct {
+		CardID       int         `json:"card_id"`
+		MembershipID string      `json:"membership_id"`
+		Amount       money.Money `json:"amount"`
+		Description  string      `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&chargeRequest); err != nil || chargeRequest.MembershipID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid membership charge data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	amount := chargeRequest.Amount
+	if amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Membership charge must be positive"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Get the user_id from the request
+	userId := auth.UserID(r)
+	userIdInt, err := strconv.Atoi(userId)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid user id"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The card must be one of the user's payment methods; without one, the default is charged
+	card, err := getPaymentMethod(db, userIdInt, chargeRequest.CardID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{Message: "Card not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if expired, err := cardExpired(card.CardExpiry, time.Now()); err != nil || expired {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Card expired"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Itemise the charge and add the tax
+	description := chargeRequest.Description
+	if description == "" {
+		description = chargeRequest.MembershipID + " membership"
+	}
+	items := addTaxLineItem([]LineItem{{ItemType: lineItemMembership, Description: description, Quantity: 1, UnitPrice: amount.Float64(), Amount: amount}})
+	baseCost, discount, totalAmount := invoiceTotals(items)
+
+	// Record the invoice as processing first, so the charge has a reference that stays the same if it is
+	// retried. A charge sent again under the same Idempotency-Key after a failure picks up the same invoice.
+	invoiceId, err := startMembershipInvoice(userIdInt, r.Header.Get("Idempotency-Key"), baseCost, discount, totalAmount, description, items)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error inserting invoice", http.StatusInternalServerError)
+		return
+	}
+
+	// Charge the card outside any transaction. A declined card voids the invoice and frees the key,
+	// so a later attempt under the same key issues a new invoice rather than repeating the declined charge.
+	err = chargeCard(db, card.CardID, totalAmount, fmt.Sprintf("invoice-%d", invoiceId))
+	if errors.Is(err, errCardDeclined) {
+		if _, err := db.Exec("UPDATE invoice SET status = 'Void', charge_key = NULL WHERE invoice_id = ? AND status = 'Processing'", invoiceId); err != nil {
+			fmt.Println(err)
+		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		response := Response{Message: "Card declined"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error charging card", http.StatusInternalServerError)
+		return
+	}
+
+	// Record the payment; the billing trigger marks the invoice paid and writes the receipt
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	billingId, err := recordMembershipPayment(tx, invoiceId, card.CardID, totalAmount)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error recording payment", http.StatusInternalServerError)
+		return
+	}
+	invoice, err := getInvoiceByID(tx, invoiceId)
+	if err != nil {
+		http.Error(w, "Error querying invoice", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+	if err != nil {
+		http.Error(w, "Error querying line items", http.StatusInternalServerError)
+		return
+	}
+
+	// Send the receipt for the charge
+	go notifyUser(userId, "receipt", map[string]interface{}{"InvoiceID": invoiceId, "BillingID": billingId, "Amount": totalAmount})
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Membership charged", invoice, billingId}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Insert a processing membership invoice with its line items, or return the one already issued for chargeKey
+func startMembershipInvoice(userId int, chargeKey string, baseCost, discount, totalAmount money.Money, description string, items []LineItem) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var key sql.NullString
+	if chargeKey != "" {
+		key = sql.NullString{String: chargeKey, Valid: true}
+		var invoiceId int64
+		err := tx.QueryRow("SELECT invoice_id FROM invoice WHERE charge_key = ? AND user_id = ? FOR UPDATE", chargeKey, userId).Scan(&invoiceId)
+		if err == nil {
+			return invoiceId, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	query := "INSERT INTO invoice (booking_id, user_id, base_cost, discount_applied, total_amount, details, status, invoice_type, charge_key) VALUES (NULL, ?, ?, ?, ?, ?, 'Processing', 'Membership', ?)"
+	result, err := tx.Exec(query, userId, baseCost, discount, totalAmount, description, key)
+	if err != nil {
+		return 0, err
+	}
+	invoiceId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := insertLineItems(tx, invoiceId, items); err != nil {
+		return 0, err
+	}
+	return invoiceId, tx.Commit()
+}
+
+// Record the payment of a charged membership invoice, once: a retry after the payment was recorded gets its billing id
+func recordMembershipPayment(tx *sql.Tx, invoiceId int64, cardId int, totalAmount money.Money) (int64, error) {
+	var status string
+	if err := tx.QueryRow("SELECT status FROM invoice WHERE invoice_id = ? FOR UPDATE", invoiceId).Scan(&status); err != nil {
+		return 0, err
+	}
+	var billingId int64
+	if status == "Paid" {
+		err := tx.QueryRow("SELECT billing_id FROM billing WHERE invoice_id = ? ORDER BY billing_id LIMIT 1", invoiceId).Scan(&billingId)
+		return billingId, err
+	}
+	query := "INSERT INTO billing (invoice_id, card_id, transaction_amount, transaction_date) VALUES (?, ?, ?, ?)"
+	result, err := tx.Exec(query, invoiceId, cardId, totalAmount, time.Now().Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
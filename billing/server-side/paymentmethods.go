@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+)
+
+// Implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Get one of the user's payment methods, or their default one when cardId is 0.
+// Removed methods are not returned.
+func getPaymentMethod(q queryRower, userId int, cardId int) (*Card, error) {
+	query := "SELECT card_id, brand, last_four, card_expiry, is_default, user_id FROM card WHERE user_id = ? AND removed_at IS NULL"
+	args := []interface{}{userId}
+	if cardId == 0 {
+		query += " AND is_default"
+	} else {
+		query += " AND card_id = ?"
+		args = append(args, cardId)
+	}
+	var card Card
+	err := q.QueryRow(query, args...).Scan(&card.CardID, &card.Brand, &card.LastFour, &card.CardExpiry, &card.IsDefault, &card.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+// Make a payment method the user's default, and no other
+func setDefaultPaymentMethod(tx *sql.Tx, userId int, cardId int) error {
+	_, err := tx.Exec("UPDATE card SET is_default = (card_id = ?) WHERE user_id = ? AND removed_at IS NULL", cardId, userId)
+	return err
+}
+
+// List the user's payment methods, the default first
+func listPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message        string `json:"message"`
+		PaymentMethods []Card `json:"payment_methods"`
+	}
+
+	// Get the user_id from the access token
+	userId := auth.UserID(r)
+
+	query := "SELECT card_id, brand, last_four, card_expiry, is_default, user_id FROM card WHERE user_id = ? AND removed_at IS NULL ORDER BY is_default DESC, card_id DESC"
+	rows, err := db.Query(query, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	cards := []Card{}
+	for rows.Next() {
+		var card Card
+		if err := rows.Scan(&card.CardID, &card.Brand, &card.LastFour, &card.CardExpiry, &card.IsDefault, &card.UserID); err != nil {
+			http.Error(w, "Error reading payment methods", http.StatusInternalServerError)
+			return
+		}
+		cards = append(cards, card)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Payment methods found", cards}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Register a card as a payment method. The details are tokenized by the payment gateway and only
+// the token, brand, last four digits and expiry are kept. The user's first card becomes their default,
+// as does any card added with make_default set.
+func addPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+		Card    *Card  `json:"card"`
+	}
+
+	// Get the user_id from the access token
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid user id", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Get the card details from the request
+	var addRequest struct {
+		CardDetails
+		MakeDefault bool `json:"make_default"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&addRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid card details", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	tokenized, err := paymentGateway.Tokenize(addRequest.CardDetails)
+	if err != nil {
+		if errors.Is(err, errInvalidCard) {
+			w.WriteHeader(http.StatusBadRequest)
+			response := Response{"Invalid card details", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		response := Response{"Error saving card with the payment gateway", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the user's cards so only one of them ends up the default
+	var existing int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM card WHERE user_id = ? AND removed_at IS NULL FOR UPDATE", userId).Scan(&existing); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	query := "INSERT INTO card (gateway_token, brand, last_four, card_expiry, user_id) VALUES (?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, tokenized.Token, tokenized.Brand, tokenized.LastFour, tokenized.CardExpiry, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	cardId, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if existing == 0 || addRequest.MakeDefault {
+		if err := setDefaultPaymentMethod(tx, userId, int(cardId)); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	card, err := getPaymentMethod(tx, userId, int(cardId))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := Response{"Payment method added", card}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Make one of the user's payment methods their default
+func updateDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+		Card    *Card  `json:"card"`
+	}
+
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid user id", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	cardId, err := strconv.Atoi(mux.Vars(r)["card_id"])
+	if err != nil || cardId <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid card id", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := getPaymentMethod(tx, userId, cardId); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Payment method not found", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := setDefaultPaymentMethod(tx, userId, cardId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	card, err := getPaymentMethod(tx, userId, cardId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Default payment method updated", card}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Remove one of the user's payment methods. The card is kept for the payments already made with it,
+// but can no longer be charged. If it was the default, the most recently added remaining card takes over.
+func deletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid user id"})
+		return
+	}
+	cardId, err := strconv.Atoi(mux.Vars(r)["card_id"])
+	if err != nil || cardId <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid card id"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	card, err := getPaymentMethod(tx, userId, cardId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{"Payment method not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Payments still in progress need the card to capture or refund
+	var inProgress int
+	query := "SELECT COUNT(*) FROM payment_saga WHERE card_id = ? AND state IN ('Started', 'Charging', 'PaymentReserved', 'BookingConfirmed', 'Compensating')"
+	if err := tx.QueryRow(query, cardId).Scan(&inProgress); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if inProgress > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{"A payment with this card is still in progress"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE card SET removed_at = NOW(), is_default = FALSE WHERE card_id = ?", cardId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if card.IsDefault {
+		var nextId int
+		err := tx.QueryRow("SELECT card_id FROM card WHERE user_id = ? AND removed_at IS NULL ORDER BY card_id DESC LIMIT 1", userId).Scan(&nextId)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			if err := setDefaultPaymentMethod(tx, userId, nextId); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Payment method removed"})
+}
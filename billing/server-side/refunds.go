@@ -0,0 +1,451 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Credit note recording money returned to the card or wallet for an invoice
+type CreditNote struct {
+	CreditNoteID     int          `json:"credit_note_id"`
+	InvoiceID        int          `json:"invoice_id"`
+	BillingID        int          `json:"billing_id"`
+	Amount           money.Money  `json:"amount"`
+	WalletAmount     money.Money  `json:"wallet_amount"` // part of the amount refunded to the wallet, the rest went to the cards
+	RefundPercentage float64      `json:"refund_percentage"`
+	Reason           string       `json:"reason"`
+	IssueDate        string       `json:"issue_date"`
+	RefundStatus     string       `json:"refund_status"` // Pending until the cards' share has been refunded
+	CardRefunds      []CardRefund `json:"card_refunds,omitempty"`
+}
+
+// Part of a credit note refunded to the card one of the booking's payments was made with
+type CardRefund struct {
+	BillingID int         `json:"billing_id"`
+	CardID    int         `json:"card_id"`
+	Amount    money.Money `json:"amount"`
+	Status    string      `json:"status"`
+}
+
+// Refund states of a credit note
+const (
+	creditNotePending = "Pending"
+	creditNoteSettled = "Settled"
+)
+
+// States of a card refund
+const (
+	cardRefundPending  = "Pending"
+	cardRefundRefunded = "Refunded"
+)
+
+// Share of the payment refunded when cancelling at least MinHoursBefore hours ahead
+type refundTier struct {
+	MinHoursBefore float64
+	Percentage     float64
+}
+
+// Default policy: full refund 72 hours ahead, half refund 24 hours ahead, nothing after
+const defaultRefundPolicy = "72:100,24:50"
+
+// Cancellation refund policy, read from REFUND_POLICY
+var refundPolicy = loadRefundPolicy()
+
+// Parse a policy such as "72:100,24:50" into tiers ordered from the earliest cancellation
+func parseRefundPolicy(policy string) ([]refundTier, error) {
+	var tiers []refundTier
+	for _, entry := range strings.Split(policy, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid refund policy entry %q", entry)
+		}
+		hours, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || hours < 0 {
+			return nil, fmt.Errorf("invalid hours in refund policy entry %q", entry)
+		}
+		percentage, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return nil, fmt.Errorf("invalid percentage in refund policy entry %q", entry)
+		}
+		tiers = append(tiers, refundTier{hours, percentage})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinHoursBefore > tiers[j].MinHoursBefore })
+	return tiers, nil
+}
+
+// Read the refund policy from the environment, falling back to the default if unset or invalid
+func loadRefundPolicy() []refundTier {
+	policy := os.Getenv("REFUND_POLICY")
+	if policy != "" {
+		tiers, err := parseRefundPolicy(policy)
+		if err == nil {
+			return tiers
+		}
+		log.Println("Ignoring REFUND_POLICY:", err)
+	}
+	tiers, _ := parseRefundPolicy(defaultRefundPolicy)
+	return tiers
+}
+
+// Percentage of the payment refunded when cancelling hoursBefore hours ahead of the booking
+func refundPercentage(hoursBefore float64) float64 {
+	for _, tier := range refundPolicy {
+		if hoursBefore >= tier.MinHoursBefore {
+			return tier.Percentage
+		}
+	}
+	return 0
+}
+
+// Get the credit notes of the user's invoices, keyed by invoice_id
+func getCreditNotesByUserID(userId string) (map[int][]CreditNote, error) {
+	cardRefunds, err := getCardRefundsByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT cn.credit_note_id, cn.invoice_id, cn.billing_id, cn.amount, cn.wallet_amount, cn.refund_percentage, cn.reason, cn.issue_date, cn.refund_status
+		FROM credit_note cn
+		INNER JOIN invoice i ON cn.invoice_id = i.invoice_id
+		WHERE i.user_id = ?
+		ORDER BY cn.issue_date`
+	rows, err := db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creditNotes := make(map[int][]CreditNote)
+	for rows.Next() {
+		var creditNote CreditNote
+		if err := rows.Scan(&creditNote.CreditNoteID, &creditNote.InvoiceID, &creditNote.BillingID, &creditNote.Amount, &creditNote.WalletAmount, &creditNote.RefundPercentage, &creditNote.Reason, &creditNote.IssueDate, &creditNote.RefundStatus); err != nil {
+			return nil, err
+		}
+		creditNote.CardRefunds = cardRefunds[creditNote.CreditNoteID]
+		creditNotes[creditNote.InvoiceID] = append(creditNotes[creditNote.InvoiceID], creditNote)
+	}
+	return creditNotes, rows.Err()
+}
+
+// Get the card refunds of the user's credit notes, keyed by credit_note_id
+func getCardRefundsByUserID(userId string) (map[int][]CardRefund, error) {
+	query := `
+		SELECT r.credit_note_id, r.billing_id, r.card_id, r.amount, r.status
+		FROM credit_note_card_refund r
+		INNER JOIN credit_note cn ON r.credit_note_id = cn.credit_note_id
+		INNER JOIN invoice i ON cn.invoice_id = i.invoice_id
+		WHERE i.user_id = ?
+		ORDER BY r.billing_id`
+	rows, err := db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cardRefunds := make(map[int][]CardRefund)
+	for rows.Next() {
+		var creditNoteId int
+		var cardRefund CardRefund
+		if err := rows.Scan(&creditNoteId, &cardRefund.BillingID, &cardRefund.CardID, &cardRefund.Amount, &cardRefund.Status); err != nil {
+			return nil, err
+		}
+		cardRefunds[creditNoteId] = append(cardRefunds[creditNoteId], cardRefund)
+	}
+	return cardRefunds, rows.Err()
+}
+
+// Get a credit note's card refunds, one per payment the card share goes back to
+func getCardRefunds(tx *sql.Tx, creditNoteId int) ([]CardRefund, error) {
+	query := "SELECT billing_id, card_id, amount, status FROM credit_note_card_refund WHERE credit_note_id = ? ORDER BY billing_id"
+	rows, err := tx.Query(query, creditNoteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cardRefunds []CardRefund
+	for rows.Next() {
+		var cardRefund CardRefund
+		if err := rows.Scan(&cardRefund.BillingID, &cardRefund.CardID, &cardRefund.Amount, &cardRefund.Status); err != nil {
+			return nil, err
+		}
+		cardRefunds = append(cardRefunds, cardRefund)
+	}
+	return cardRefunds, rows.Err()
+}
+
+// Refund a paid booking that was cancelled, following the refund policy (called by the vehicle service)
+func refundBooking(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message    string      `json:"message"`
+		CreditNote *CreditNote `json:"credit_note"`
+	}
+
+	// Get the user_id and booking_id from the request
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["booking_id"]
+
+	// How far ahead of the booking it was cancelled
+	var refundRequest struct {
+		HoursBeforeStart float64 `json:"hours_before_start"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&refundRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid refund request", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Find the paid booking invoice and its payment, locking it against concurrent refunds
+	query := `
+		SELECT i.invoice_id, i.user_id, b.billing_id
+		FROM invoice i
+		INNER JOIN billing b ON b.invoice_id = i.invoice_id
+		WHERE i.booking_id = ? AND i.user_id = ? AND i.invoice_type = 'Booking' AND i.status IN ('Paid', 'PartiallyRefunded', 'Refunded')
+		ORDER BY b.billing_id
+		LIMIT 1
+		FOR UPDATE`
+	var invoiceId, ownerId, billingId int
+	err = tx.QueryRow(query, bookingId, userId).Scan(&invoiceId, &ownerId, &billingId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"No paid invoice found for booking", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A booking is only cancelled once, so return the existing credit note on retries
+	var creditNoteId int64
+	err = tx.QueryRow("SELECT credit_note_id FROM credit_note WHERE invoice_id = ? AND reason = 'Cancellation'", invoiceId).Scan(&creditNoteId)
+	if err == nil {
+		creditNote, err := getCreditNoteByID(tx, creditNoteId)
+		if err != nil {
+			http.Error(w, "Error querying credit note", http.StatusInternalServerError)
+			return
+		}
+		// Release the invoice before finishing a card refund an earlier attempt left pending
+		tx.Rollback()
+		finishCreditNote(creditNote)
+		w.WriteHeader(http.StatusOK)
+		response := Response{"Booking already refunded", creditNote}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != sql.ErrNoRows {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Unpaid supplementary invoices are no longer owed once the booking is cancelled
+	_, err = tx.Exec("UPDATE invoice SET status = 'Void' WHERE booking_id = ? AND invoice_type = 'Supplementary' AND status = 'Pending'", bookingId)
+	if err != nil {
+		http.Error(w, "Error voiding supplementary invoices", http.StatusInternalServerError)
+		return
+	}
+
+	// Refund the policy's share of what was paid, net of anything already refunded
+	charged, refunded, err := bookingCharges(tx, bookingId)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	netPaid := charged - refunded
+	percentage := refundPercentage(refundRequest.HoursBeforeStart)
+	amount := netPaid.Percent(percentage)
+
+	// Record the credit note, splitting the refund between the wallet and the cards as the booking was paid.
+	// The wallet's share is refunded with it; the cards' share once it is committed.
+	walletShare, cardRefunds, err := splitRefund(tx, bookingId, amount)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	creditNoteId, err = insertCreditNote(tx, ownerId, invoiceId, billingId, amount, walletShare, cardRefunds, percentage, "Cancellation")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error inserting credit note", http.StatusInternalServerError)
+		return
+	}
+
+	// Mark the invoice as fully or partially refunded
+	if amount > 0 {
+		status := "PartiallyRefunded"
+		if amount >= netPaid {
+			status = "Refunded"
+		}
+		_, err = tx.Exec("UPDATE invoice SET status = ? WHERE invoice_id = ?", status, invoiceId)
+		if err != nil {
+			http.Error(w, "Error updating invoice status", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Get the credit note as stored
+	creditNote, err := getCreditNoteByID(tx, creditNoteId)
+	if err != nil {
+		http.Error(w, "Error querying credit note", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	finishCreditNote(creditNote)
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Booking refunded", creditNote}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Record a credit note and refund its wallet share in the same transaction. The card refunds are left
+// pending, to be refunded through the gateway by settleCreditNote once the transaction has committed.
+func insertCreditNote(tx *sql.Tx, userId, invoiceId, billingId int, amount, walletShare money.Money, cardRefunds []CardRefund, percentage float64, reason string) (int64, error) {
+	refundStatus := creditNoteSettled
+	if len(cardRefunds) > 0 {
+		refundStatus = creditNotePending
+	}
+	query := "INSERT INTO credit_note (invoice_id, billing_id, amount, wallet_amount, refund_percentage, reason, refund_status) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, invoiceId, billingId, amount, walletShare, percentage, reason, refundStatus)
+	if err != nil {
+		return 0, err
+	}
+	creditNoteId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, cardRefund := range cardRefunds {
+		query = "INSERT INTO credit_note_card_refund (credit_note_id, billing_id, card_id, amount, status) VALUES (?, ?, ?, ?, ?)"
+		if _, err := tx.Exec(query, creditNoteId, cardRefund.BillingID, cardRefund.CardID, cardRefund.Amount, cardRefundPending); err != nil {
+			return 0, err
+		}
+	}
+	if walletShare > 0 {
+		if err := refundToWallet(tx, userId, walletShare, invoiceId, fmt.Sprintf("credit-note-%d", creditNoteId)); err != nil {
+			return 0, err
+		}
+	}
+	return creditNoteId, nil
+}
+
+// Refund each pending card refund of a credit note, outside any transaction, and mark the credit note settled.
+// Each refund is made under a reference of its own, so a retry refunds each payment once.
+func settleCreditNote(creditNote *CreditNote) error {
+	query := "SELECT billing_id, card_id, amount FROM credit_note_card_refund WHERE credit_note_id = ? AND status = 'Pending' ORDER BY billing_id"
+	rows, err := db.Query(query, creditNote.CreditNoteID)
+	if err != nil {
+		return err
+	}
+	var pending []CardRefund
+	for rows.Next() {
+		var cardRefund CardRefund
+		if err := rows.Scan(&cardRefund.BillingID, &cardRefund.CardID, &cardRefund.Amount); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, cardRefund)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cardRefund := range pending {
+		reference := fmt.Sprintf("credit-note-%d-%d", creditNote.CreditNoteID, cardRefund.BillingID)
+		if err := refundCard(db, cardRefund.CardID, cardRefund.Amount, reference); err != nil {
+			return err
+		}
+		query = "UPDATE credit_note_card_refund SET status = ? WHERE credit_note_id = ? AND billing_id = ?"
+		if _, err := db.Exec(query, cardRefundRefunded, creditNote.CreditNoteID, cardRefund.BillingID); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("UPDATE credit_note SET refund_status = ? WHERE credit_note_id = ?", creditNoteSettled, creditNote.CreditNoteID)
+	if err != nil {
+		return err
+	}
+	creditNote.RefundStatus = creditNoteSettled
+	for i := range creditNote.CardRefunds {
+		creditNote.CardRefunds[i].Status = cardRefundRefunded
+	}
+	return nil
+}
+
+// Settle a committed credit note if it is pending. A failure is left for the recovery loop to retry.
+func finishCreditNote(creditNote *CreditNote) {
+	if creditNote.RefundStatus != creditNotePending {
+		return
+	}
+	if err := settleCreditNote(creditNote); err != nil {
+		log.Println("Failed to settle credit note", creditNote.CreditNoteID, ":", err)
+	}
+}
+
+// Settle credit notes whose card refund was left pending, e.g. by a restart or an unreachable gateway
+func recoverCreditNotes(staleAfter time.Duration) {
+	query := `SELECT credit_note_id, invoice_id, billing_id, amount, wallet_amount, refund_percentage, reason, issue_date, refund_status
+	FROM credit_note
+	WHERE refund_status = 'Pending' AND issue_date < NOW() - INTERVAL ? SECOND`
+	rows, err := db.Query(query, int(staleAfter.Seconds()))
+	if err != nil {
+		log.Println("Failed to query pending credit notes:", err)
+		return
+	}
+	var creditNotes []CreditNote
+	for rows.Next() {
+		var creditNote CreditNote
+		if err := rows.Scan(&creditNote.CreditNoteID, &creditNote.InvoiceID, &creditNote.BillingID, &creditNote.Amount, &creditNote.WalletAmount, &creditNote.RefundPercentage, &creditNote.Reason, &creditNote.IssueDate, &creditNote.RefundStatus); err != nil {
+			log.Println("Failed to read credit note:", err)
+			continue
+		}
+		creditNotes = append(creditNotes, creditNote)
+	}
+	rows.Close()
+
+	for i := range creditNotes {
+		err := settleCreditNote(&creditNotes[i])
+		log.Println("Settled credit note", creditNotes[i].CreditNoteID, "result:", err)
+	}
+}
+
+// Periodically settle pending credit notes, starting with any left over from before a restart
+func startCreditNoteRecovery(interval time.Duration) {
+	recoverCreditNotes(0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		recoverCreditNotes(interval)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const pendingCardRefundsQuery = "SELECT billing_id, card_id, amount FROM credit_note_card_refund WHERE credit_note_id = ? AND status = 'Pending'"
+
+func expectCardRefunded(mock sqlmock.Sqlmock, creditNoteID, billingID int) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE credit_note_card_refund SET status = ? WHERE credit_note_id = ? AND billing_id = ?")).
+		WithArgs(cardRefundRefunded, creditNoteID, billingID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// A pending credit note refunds each payment's card its share, under a reference of its own, and is then settled
+func TestSettleCreditNote(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	creditNote := &CreditNote{CreditNoteID: 12, Amount: 40_00, WalletAmount: 10_00, RefundStatus: creditNotePending}
+
+	mock.ExpectQuery(regexp.QuoteMeta(pendingCardRefundsQuery)).
+		WithArgs(12).
+		WillReturnRows(sqlmock.NewRows([]string{"billing_id", "card_id", "amount"}).AddRow(5, 4, "20.00").AddRow(8, 6, "10.00"))
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	expectCardRefunded(mock, 12, 5)
+	expectCardToken(mock, 6, fakeTokenPrefix+"def")
+	expectCardRefunded(mock, 12, 8)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE credit_note SET refund_status = ? WHERE credit_note_id = ?")).
+		WithArgs(creditNoteSettled, 12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := settleCreditNote(creditNote); err != nil {
+		t.Fatal(err)
+	}
+	if creditNote.RefundStatus != creditNoteSettled {
+		t.Errorf("refund status = %s, want %s", creditNote.RefundStatus, creditNoteSettled)
+	}
+	want := []gatewayCall{
+		{fakeTokenPrefix + "abc", 20_00, "credit-note-12-5"},
+		{fakeTokenPrefix + "def", 10_00, "credit-note-12-8"},
+	}
+	if len(gateway.refunds) != len(want) || gateway.refunds[0] != want[0] || gateway.refunds[1] != want[1] {
+		t.Errorf("refunds = %v, want %v", gateway.refunds, want)
+	}
+}
+
+// A settlement that fails part way leaves the credit note pending, and the retry refunds only what is left
+func TestSettleCreditNoteRetried(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	creditNote := &CreditNote{CreditNoteID: 12, Amount: 30_00, RefundStatus: creditNotePending}
+
+	mock.ExpectQuery(regexp.QuoteMeta(pendingCardRefundsQuery)).
+		WithArgs(12).
+		WillReturnRows(sqlmock.NewRows([]string{"billing_id", "card_id", "amount"}).AddRow(5, 4, "20.00").AddRow(8, 6, "10.00"))
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	expectCardRefunded(mock, 12, 5)
+	unreachable := errors.New("database unreachable")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT gateway_token FROM card WHERE card_id = ?")).
+		WithArgs(6).
+		WillReturnError(unreachable)
+
+	if err := settleCreditNote(creditNote); !errors.Is(err, unreachable) {
+		t.Fatalf("settleCreditNote: %v, want %v", err, unreachable)
+	}
+	if creditNote.RefundStatus != creditNotePending {
+		t.Errorf("refund status = %s, want %s", creditNote.RefundStatus, creditNotePending)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(pendingCardRefundsQuery)).
+		WithArgs(12).
+		WillReturnRows(sqlmock.NewRows([]string{"billing_id", "card_id", "amount"}).AddRow(8, 6, "10.00"))
+	expectCardToken(mock, 6, fakeTokenPrefix+"def")
+	expectCardRefunded(mock, 12, 8)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE credit_note SET refund_status = ? WHERE credit_note_id = ?")).
+		WithArgs(creditNoteSettled, 12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := settleCreditNote(creditNote); err != nil {
+		t.Fatal(err)
+	}
+	want := []gatewayCall{
+		{fakeTokenPrefix + "abc", 20_00, "credit-note-12-5"},
+		{fakeTokenPrefix + "def", 10_00, "credit-note-12-8"},
+	}
+	if len(gateway.refunds) != len(want) || gateway.refunds[0] != want[0] || gateway.refunds[1] != want[1] {
+		t.Errorf("refunds = %v, want %v", gateway.refunds, want)
+	}
+}
+
+// A settled credit note is left alone
+func TestFinishSettledCreditNote(t *testing.T) {
+	_, gateway := setUpGatewayTest(t)
+	finishCreditNote(&CreditNote{CreditNoteID: 12, Amount: 40_00, RefundStatus: creditNoteSettled})
+	if len(gateway.refunds) != 0 {
+		t.Errorf("refunds = %v, want none", gateway.refunds)
+	}
+}
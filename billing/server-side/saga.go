@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// States of the booking-payment saga
+const (
+	sagaStarted          = "Started"
+	sagaCharging         = "Charging"
+	sagaPaymentReserved  = "PaymentReserved"
+	sagaBookingConfirmed = "BookingConfirmed"
+	sagaPaymentCaptured  = "PaymentCaptured"
+	sagaCompensating     = "Compensating"
+	sagaRefunded         = "Refunded"
+	sagaFailed           = "Failed"
+)
+
+// Persisted state of a single payment for an invoice
+type PaymentSaga struct {
+	SagaID       int64
+	InvoiceID    int
+	BookingID    int
+	UserID       int
+	CardID       sql.NullInt64 // not set when the wallet pays it all
+	Amount       money.Money
+	WalletAmount money.Money // part of the amount paid from the wallet
+	State        string
+	BillingID    sql.NullInt64
+	Reference    sql.NullString // gateway reference of the card charge, set before charging
+}
+
+var (
+	// The vehicle service refused to confirm the booking and the payment was refunded
+	errBookingNotConfirmed = errors.New("booking could not be confirmed")
+	// The vehicle service could not be reached; the recovery loop will retry the confirmation
+	errConfirmationPending = errors.New("booking confirmation pending")
+)
+
+// Claim the pending invoice and record a new saga for its payment
+func startPaymentSaga(invoiceID, bookingID, userID int, cardID sql.NullInt64, amount, walletAmount money.Money) (*PaymentSaga, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Only one payment may be in progress for an invoice
+	result, err := tx.Exec("UPDATE invoice SET status = 'Processing' WHERE invoice_id = ? AND status = 'Pending'", invoiceID)
+	if err != nil {
+		return nil, false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if rowsAffected == 0 {
+		return nil, false, nil
+	}
+
+	result, err = tx.Exec("INSERT INTO payment_saga (invoice_id, booking_id, user_id, card_id, amount, wallet_amount, state) VALUES (?, ?, ?, ?, ?, ?, ?)", invoiceID, bookingID, userID, cardID, amount, walletAmount, sagaStarted)
+	if err != nil {
+		return nil, false, err
+	}
+	sagaID, err := result.LastInsertId()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return &PaymentSaga{SagaID: sagaID, InvoiceID: invoiceID, BookingID: bookingID, UserID: userID, CardID: cardID, Amount: amount, WalletAmount: walletAmount, State: sagaStarted}, true, nil
+}
+
+// Load a saga by id
+func loadPaymentSaga(sagaID int64) (*PaymentSaga, error) {
+	var saga PaymentSaga
+	query := "SELECT saga_id, invoice_id, booking_id, user_id, card_id, amount, wallet_amount, state, billing_id, gateway_reference FROM payment_saga WHERE saga_id = ?"
+	err := db.QueryRow(query, sagaID).Scan(&saga.SagaID, &saga.InvoiceID, &saga.BookingID, &saga.UserID, &saga.CardID, &saga.Amount, &saga.WalletAmount, &saga.State, &saga.BillingID, &saga.Reference)
+	if err != nil {
+		return nil, err
+	}
+	return &saga, nil
+}
+
+// Move the saga from one state to the next, running the step in the same transaction.
+// Reports false without running the step if another worker already moved the saga on.
+// Steps only touch this database; the gateway is called between transitions, so a slow
+// gateway never holds a transaction open.
+func advanceSaga(saga *PaymentSaga, from, to string, step func(tx *sql.Tx) error) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE payment_saga SET state = ? WHERE saga_id = ? AND state = ?", to, saga.SagaID, from)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected == 0 {
+		return false, nil
+	}
+	if step != nil {
+		if err := step(tx); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	saga.State = to
+	return true, nil
+}
+
+// Record why the saga could not progress
+func recordSagaError(saga *PaymentSaga, cause error) {
+	_, err := db.Exec("UPDATE payment_saga SET attempts = attempts + 1, last_error = ? WHERE saga_id = ?", cause.Error(), saga.SagaID)
+	if err != nil {
+		log.Println("Failed to record saga error:", err)
+	}
+}
+
+// Give back the wallet's part of a payment that did not go through and release the invoice for another attempt
+func releaseSagaPayment(tx *sql.Tx, saga *PaymentSaga) error {
+	if saga.WalletAmount > 0 {
+		reference := saga.Reference.String + "-refund"
+		if err := refundToWallet(tx, saga.UserID, saga.WalletAmount, saga.InvoiceID, reference); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("UPDATE invoice SET status = 'Pending' WHERE invoice_id = ?", saga.InvoiceID)
+	return err
+}
+
+// Ask the vehicle service to confirm the booking.
+// Returns errBookingNotConfirmed if it definitively refused and errConfirmationPending if it should be retried.
+func confirmSagaBooking(saga *PaymentSaga) error {
+	bookingConfirmationURL := vehicleServiceURL + "/api/v1/confirm-booking/" + strconv.Itoa(saga.UserID) + "/" + strconv.Itoa(saga.BookingID)
+	var paymentConfirmation = struct {
+		Message        string `json:"message"`
+		PaymentSuccess bool   `json:"paymentSuccess"`
+	}{
+		Message:        "Payment successful",
+		PaymentSuccess: true,
+	}
+
+	// Prepare JSON payload for booking confirmation
+	jsonData, err := json.Marshal(paymentConfirmation)
+	if err != nil {
+		return err
+	}
+
+	// Send the confirmation request
+	resp, err := auth.ServicePost(bookingConfirmationURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errConfirmationPending, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: status code %d", errBookingNotConfirmed, resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status code %d", errConfirmationPending, resp.StatusCode)
+	}
+}
+
+// Drive the saga forward from its current state until it finishes or has to wait
+func runPaymentSaga(saga *PaymentSaga) error {
+	for {
+		var advanced bool
+		var err error
+
+		switch saga.State {
+		case sagaStarted:
+			// Take the wallet's part and record the reference the card will be charged under,
+			// so a charge retried after a crash or timeout is recognised by the gateway
+			reference := fmt.Sprintf("saga-%d", saga.SagaID)
+			advanced, err = advanceSaga(saga, sagaStarted, sagaCharging, func(tx *sql.Tx) error {
+				if saga.WalletAmount > 0 {
+					err := postWalletTransaction(tx, saga.UserID, &WalletTransaction{
+						Type:        ledgerCharge,
+						Amount:      -saga.WalletAmount,
+						InvoiceID:   &saga.InvoiceID,
+						Description: fmt.Sprintf("Payment for invoice %d", saga.InvoiceID),
+						Reference:   &reference,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				_, err := tx.Exec("UPDATE payment_saga SET gateway_reference = ? WHERE saga_id = ?", reference, saga.SagaID)
+				return err
+			})
+			if advanced {
+				saga.Reference = sql.NullString{String: reference, Valid: true}
+			}
+			if errors.Is(err, errInsufficientWalletBalance) {
+				// Nothing was taken, so release the invoice and stop
+				recordSagaError(saga, err)
+				insufficient := err
+				if _, failErr := advanceSaga(saga, sagaStarted, sagaFailed, func(tx *sql.Tx) error {
+					_, err := tx.Exec("UPDATE invoice SET status = 'Pending' WHERE invoice_id = ?", saga.InvoiceID)
+					return err
+				}); failErr != nil {
+					return failErr
+				}
+				return insufficient
+			}
+
+		case sagaCharging:
+			// Charge the card the rest, outside any transaction
+			var chargeErr error
+			if cardAmount := saga.Amount - saga.WalletAmount; cardAmount > 0 {
+				chargeErr = chargeCard(db, int(saga.CardID.Int64), cardAmount, saga.Reference.String)
+			}
+			switch {
+			case chargeErr == nil:
+				advanced, err = advanceSaga(saga, sagaCharging, sagaPaymentReserved, nil)
+			case errors.Is(chargeErr, errCardDeclined):
+				// Nothing was charged, so give back the wallet's part, release the invoice and stop
+				recordSagaError(saga, chargeErr)
+				if _, failErr := advanceSaga(saga, sagaCharging, sagaFailed, func(tx *sql.Tx) error {
+					return releaseSagaPayment(tx, saga)
+				}); failErr != nil {
+					return failErr
+				}
+				return chargeErr
+			default:
+				// The outcome is unknown; the recovery loop repeats the charge under the same reference
+				recordSagaError(saga, chargeErr)
+				return chargeErr
+			}
+
+		case sagaPaymentReserved:
+			// Confirm the booking with the vehicle service
+			confirmErr := confirmSagaBooking(saga)
+			switch {
+			case confirmErr == nil:
+				advanced, err = advanceSaga(saga, sagaPaymentReserved, sagaBookingConfirmed, nil)
+			case errors.Is(confirmErr, errBookingNotConfirmed):
+				recordSagaError(saga, confirmErr)
+				advanced, err = advanceSaga(saga, sagaPaymentReserved, sagaCompensating, nil)
+			default:
+				recordSagaError(saga, confirmErr)
+				return errConfirmationPending
+			}
+
+		case sagaBookingConfirmed:
+			// Capture the payment; the billing trigger marks the invoice paid and writes the receipt
+			advanced, err = advanceSaga(saga, sagaBookingConfirmed, sagaPaymentCaptured, func(tx *sql.Tx) error {
+				transactionDate := time.Now().Format("2006-01-02")
+				query := "INSERT INTO billing (invoice_id, card_id, transaction_amount, wallet_amount, transaction_date) VALUES (?, ?, ?, ?, ?)"
+				result, err := tx.Exec(query, saga.InvoiceID, saga.CardID, saga.Amount, saga.WalletAmount, transactionDate)
+				if err != nil {
+					return err
+				}
+				billingID, err := result.LastInsertId()
+				if err != nil {
+					return err
+				}
+				saga.BillingID = sql.NullInt64{Int64: billingID, Valid: true}
+				_, err = tx.Exec("UPDATE payment_saga SET billing_id = ? WHERE saga_id = ?", billingID, saga.SagaID)
+				return err
+			})
+			// Send the receipt once, by whichever worker captured the payment
+			if advanced && err == nil {
+				go notifyUser(strconv.Itoa(saga.UserID), "receipt", map[string]interface{}{"InvoiceID": saga.InvoiceID, "BillingID": saga.BillingID.Int64, "Amount": saga.Amount})
+			}
+
+		case sagaCompensating:
+			// Refund the card outside any transaction, under a reference of its own so a retry refunds once
+			if cardAmount := saga.Amount - saga.WalletAmount; cardAmount > 0 {
+				if refundErr := refundCard(db, int(saga.CardID.Int64), cardAmount, saga.Reference.String+"-refund"); refundErr != nil {
+					recordSagaError(saga, refundErr)
+					return refundErr
+				}
+			}
+			// Then give back the wallet's part and release the invoice
+			advanced, err = advanceSaga(saga, sagaCompensating, sagaRefunded, func(tx *sql.Tx) error {
+				return releaseSagaPayment(tx, saga)
+			})
+
+		case sagaPaymentCaptured:
+			return nil
+
+		case sagaRefunded:
+			return errBookingNotConfirmed
+
+		case sagaFailed:
+			return errCardDeclined
+
+		default:
+			return fmt.Errorf("unknown saga state %q", saga.State)
+		}
+
+		if err != nil {
+			recordSagaError(saga, err)
+			return err
+		}
+		// Another worker moved the saga on, so continue from its current state
+		if !advanced {
+			saga, err = loadPaymentSaga(saga.SagaID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Resume sagas that were left unfinished, e.g. by a restart or an unreachable vehicle service
+func recoverPaymentSagas(staleAfter time.Duration) {
+	query := `SELECT saga_id FROM payment_saga
+	WHERE state IN ('Started', 'Charging', 'PaymentReserved', 'BookingConfirmed', 'Compensating')
+	AND updated_at < NOW() - INTERVAL ? SECOND`
+	rows, err := db.Query(query, int(staleAfter.Seconds()))
+	if err != nil {
+		log.Println("Failed to query unfinished payment sagas:", err)
+		return
+	}
+	var sagaIDs []int64
+	for rows.Next() {
+		var sagaID int64
+		if err := rows.Scan(&sagaID); err != nil {
+			log.Println("Failed to read payment saga:", err)
+			continue
+		}
+		sagaIDs = append(sagaIDs, sagaID)
+	}
+	rows.Close()
+
+	for _, sagaID := range sagaIDs {
+		saga, err := loadPaymentSaga(sagaID)
+		if err != nil {
+			log.Println("Failed to load payment saga", sagaID, ":", err)
+			continue
+		}
+		err = runPaymentSaga(saga)
+		log.Println("Resumed payment saga", sagaID, "result:", err)
+	}
+}
+
+// Periodically resume unfinished sagas, starting with any left over from before a restart
+func startSagaRecovery(interval time.Duration) {
+	recoverPaymentSagas(0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		recoverPaymentSagas(interval)
+	}
+}
@@ -1,85 +1,122 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/money"
 )
 
-// Card struct
+// Card struct, as kept in the vault: the gateway token stands in for the card number, which is never stored
 type Card struct {
-	CardID      int     `json:"card_id"`
-	CardNumber  string  `json:"card_number"`
-	CardExpiry  string  `json:"card_expiry"`
-	CVV         string  `json:"cvv"`
-	CardBalance float64 `json:"card_balance"`
-	UserID      int     `json:"user_id"`
+	CardID     int    `json:"card_id"`
+	Brand      string `json:"brand"`
+	LastFour   string `json:"last_four"`
+	CardExpiry string `json:"card_expiry"`
+	IsDefault  bool   `json:"is_default"`
+	UserID     int    `json:"user_id"`
 }
 
 // Invoice struct
 type Invoice struct {
-	InvoiceID       int     `json:"invoice_id"`
-	BookingID       int     `json:"booking_id"`
-	UserID          int     `json:"user_id"`
-	IssueDate       string  `json:"issue_date"`
-	BaseCost        float64 `json:"base_cost"`
-	PromotionCode   *string `json:"promo_code"`
-	DiscountApplied float64 `json:"discount_applied"`
-	TotalAmount     float64 `json:"total_amount"`
-	Details         string  `json:"details"`
-	Status          string  `json:"status"`
+	InvoiceID       int          `json:"invoice_id"`
+	BookingID       *int         `json:"booking_id"` // nil for membership invoices
+	UserID          int          `json:"user_id"`
+	IssueDate       string       `json:"issue_date"`
+	BaseCost        money.Money  `json:"base_cost"`
+	PromotionCode   *string      `json:"promo_code"`
+	DiscountApplied money.Money  `json:"discount_applied"`
+	TotalAmount     money.Money  `json:"total_amount"`
+	Details         string       `json:"details"`
+	Status          string       `json:"status"`
+	InvoiceType     string       `json:"invoice_type"`
+	ParentInvoiceID *int         `json:"parent_invoice_id"`
+	LineItems       []LineItem   `json:"line_items,omitempty"`
+	CreditNotes     []CreditNote `json:"credit_notes,omitempty"`
 }
 
 type Billing struct {
-	BillingID         int     `json:"billing_id"`
-	InvoiceID         int     `json:"invoice_id"`
-	CardID            int     `json:"card_id"`
-	TransactionAmount float64 `json:"transaction_amount"`
-	TransactionDate   string  `json:"transaction_date"`
+	BillingID         int         `json:"billing_id"`
+	InvoiceID         int         `json:"invoice_id"`
+	CardID            *int        `json:"card_id"` // nil when the wallet paid it all
+	TransactionAmount money.Money `json:"transaction_amount"`
+	WalletAmount      money.Money `json:"wallet_amount"` // part of the transaction paid from the wallet
+	TransactionDate   string      `json:"transaction_date"`
 }
 
 type VehicleBookingDetails struct {
-	BookingID          int64   `json:"booking_id"`
-	ScheduleID         int64   `json:"schedule_id"`
-	UserID             int     `json:"user_id"`
-	Status             string  `json:"status"`
-	BaseCost           float64 `json:"base_cost"`
-	PromotionCode      *string `json:"promo_code"`
-	MembershipDiscount float64 `json:"membership_discount"`
-	PromotionDiscount  float64 `json:"promotion_discount"`
-	DiscountApplied    float64 `json:"discount_applied"`
-	TotalAmount        float64 `json:"total_amount"`
-	Type               string  `json:"type"`
-	Brand              string  `json:"brand"`
-	Model              string  `json:"model"`
-	LicensePlate       string  `json:"license_plate"`
-	ScheduleDate       string  `json:"date"`
-	StartTime          string  `json:"start_time"`
-	EndTime            string  `json:"end_time"`
+	BookingID          int64       `json:"booking_id"`
+	ScheduleID         int64       `json:"schedule_id"`
+	UserID             int         `json:"user_id"`
+	Status             string      `json:"status"`
+	BaseCost           money.Money `json:"base_cost"`
+	PromotionCode      *string     `json:"promo_code"`
+	MembershipDiscount money.Money `json:"membership_discount"`
+	PromotionDiscount  money.Money `json:"promotion_discount"`
+	DiscountApplied    money.Money `json:"discount_applied"`
+	TotalAmount        money.Money `json:"total_amount"`
+	Type               string      `json:"type"`
+	Brand              string      `json:"brand"`
+	Model              string      `json:"model"`
+	LicensePlate       string      `json:"license_plate"`
+	ScheduleDate       string      `json:"date"`
+	StartTime          string      `json:"start_time"`
+	EndTime            string      `json:"end_time"`
+	HourlyRate         money.Money `json:"hourly_rate"`
+}
+
+// User struct (response from the user service)
+type User struct {
+	UserID       int    `json:"user_id"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	MembershipId string `json:"membership_id"`
+}
+
+// Membership struct (response from the user service)
+type Membership struct {
+	MembershipId       string  `json:"membership_id"`
+	HourlyRateDiscount float64 `json:"hourly_rate_discount"`
+	BookingLimit       int     `json:"booking_limit"`
 }
 
 // Receipt struct
 type Receipt struct {
-	ReceiptID     int     `json:"receipt_id"`
-	BillingID     int     `json:"billing_id"`
-	CardID        int     `json:"card_id"`
-	Amount        float64 `json:"amount"`
-	Date          string  `json:"date"`
-	Description   string  `json:"description"`
-	CardLastThree string  `json:"card_last_three"`
+	ReceiptID     int         `json:"receipt_id"`
+	BillingID     int         `json:"billing_id"`
+	CardID        *int        `json:"card_id"` // nil when the wallet paid it all
+	Amount        money.Money `json:"amount"`
+	WalletAmount  money.Money `json:"wallet_amount"`
+	Date          string      `json:"date"`
+	Description   string      `json:"description"`
+	PaymentMethod string      `json:"payment_method"` // how it was paid, with the card masked
 }
 
 var db *sql.DB
 
+// Base URLs of the other services
+var (
+	userServiceURL    = "http://localhost:8000"
+	vehicleServiceURL = "http://localhost:9000"
+)
+
+// Returned by validateBooking when the vehicle service reports the booking session has expired
+var errBookingSessionExpired = errors.New("booking session expired")
+
 // Initialise the user_svc_db database connection
 func initDB() {
 	var err error
@@ -91,22 +128,165 @@ func initDB() {
 }
 
 func main() {
+	// Refuse to start without a proper signing secret
+	auth.LoadSecret()
 	// Call initDB(), to initialise user_svc_db connection
 	initDB()
 	defer db.Close()
 	// Setting up router and API endpoints
 	router := mux.NewRouter()
-	handler := cors.Default().Handler(router)
+	router.Use(auth.Authenticate)
+	router.Use(idempotency.Middleware(db, getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)))
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "Idempotency-Key"},
+	}).Handler(router)
 	router.HandleFunc("/api/v1/card-details/{id}", getCardDetailsByUserID).Methods("GET")
+	router.HandleFunc("/api/v1/payment-methods/{id}", listPaymentMethods).Methods("GET")
+	router.HandleFunc("/api/v1/payment-methods/{id}", addPaymentMethod).Methods("POST")
+	router.HandleFunc("/api/v1/payment-methods/{id}/{card_id}/default", updateDefaultPaymentMethod).Methods("PUT")
+	router.HandleFunc("/api/v1/payment-methods/{id}/{card_id}", deletePaymentMethod).Methods("DELETE")
+	router.HandleFunc("/api/v1/wallet/{id}", getWallet).Methods("GET")
+	router.HandleFunc("/api/v1/wallet/{id}/top-up", topUpWallet).Methods("POST")
+	router.HandleFunc("/api/v1/admin/wallet/{id}/adjust", auth.RequireAdmin(adjustWallet)).Methods("POST")
 	router.HandleFunc("/api/v1/create-invoice/{id}/{booking_id}", createInvoice).Methods("POST")
 	router.HandleFunc("/api/v1/invoice-details/{id}", getInvoiceDetailsByUserID).Methods("GET")
 	router.HandleFunc("/api/v1/invoice-details-by-id/{id}", getInvoiceDetailsByInvoiceID).Methods("GET")
 	router.HandleFunc("/api/v1/make-payment/{id}", makePayment).Methods("POST")
 	router.HandleFunc("/api/v1/receipt-details/{id}", getReceiptDetailsByBillingID).Methods("GET")
+	router.HandleFunc("/api/v1/invoice-document/{id}", getInvoiceDocument).Methods("GET")
+	router.HandleFunc("/api/v1/receipt-document/{id}", getReceiptDocument).Methods("GET")
+	router.HandleFunc("/api/v1/refund-booking/{id}/{booking_id}", auth.RequireService(refundBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/adjust-booking/{id}/{booking_id}", auth.RequireService(adjustBooking)).Methods("POST")
+	router.HandleFunc("/api/v1/final-invoice/{id}/{booking_id}", finalInvoice).Methods("POST")
+	router.HandleFunc("/api/v1/membership-charge/{id}", auth.RequireService(chargeMembership)).Methods("POST")
+	// Resume payment sagas left unfinished by a restart or an unreachable vehicle service
+	go startSagaRecovery(getEnvDuration("SAGA_RECOVERY_INTERVAL", time.Minute))
+	// Finish card refunds of credit notes that the gateway did not take
+	go startCreditNoteRecovery(getEnvDuration("CREDIT_NOTE_RECOVERY_INTERVAL", time.Minute))
+	// Finish wallet top-ups whose card charge did not complete
+	go startWalletTopUpRecovery(getEnvDuration("WALLET_TOP_UP_RECOVERY_INTERVAL", time.Minute))
 	fmt.Println("Listening at port 8081")
 	log.Fatal(http.ListenAndServe(":8081", handler))
 }
 
+// Read a duration (e.g. "1m") from the environment, falling back to the default if unset or invalid
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+	return duration
+}
+
+// Read a number from the environment, falling back to the default if unset or invalid
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		log.Printf("Invalid %s value %q, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return number
+}
+
+// Read an amount of money from the environment, falling back to the default if unset or invalid
+func getEnvMoney(key string, defaultValue money.Money) money.Money {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	amount, err := money.Parse(value)
+	if err != nil || amount < 0 {
+		log.Printf("Invalid %s value %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return amount
+}
+
+// Validate user
+func validateUser(userId string) (*User, error) {
+	// Struct for response from the user service
+	type Response struct {
+		Message string `json:"message"`
+		User    User   `json:"user"`
+	}
+
+	// URL of the user service
+	validateURL := userServiceURL + "/api/v1/validate-user/" + userId
+
+	// Send GET request to the user service to validate the user
+	resp, err := auth.ServiceGet(validateURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Create a Response object to hold the data returned from the user service
+	var response Response
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Decode the response into the Response struct
+		err := json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode user data: %v", err)
+		}
+		return &response.User, nil
+
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("user not found")
+
+	default:
+		return nil, fmt.Errorf("failed to get user data, status code: %d", resp.StatusCode)
+	}
+}
+
+// Get membership details by membership_id
+func getMembershipDetails(membershipId string) (*Membership, error) {
+	// Struct for response from the user service
+	type Response struct {
+		Message    string     `json:"message"`
+		Membership Membership `json:"membership"`
+	}
+
+	// URL of the user service
+	membershipURL := userServiceURL + "/api/v1/membership/" + membershipId
+
+	// Send GET request to the user service to get the membership
+	resp, err := auth.ServiceGet(membershipURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get membership data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Create a Response object to hold the data returned from the user service
+	var response Response
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Decode the response into the Response struct
+		err := json.NewDecoder(resp.Body).Decode(&response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode membership data: %v", err)
+		}
+		return &response.Membership, nil
+
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("membership not found")
+
+	default:
+		return nil, fmt.Errorf("failed to get membership data, status code: %d", resp.StatusCode)
+	}
+}
+
 // Validate Booking
 func validateBooking(UserId string, BookingId string) (*VehicleBookingDetails, error) {
 	// Struct for response from the booking service
@@ -116,10 +296,10 @@ func validateBooking(UserId string, BookingId string) (*VehicleBookingDetails, e
 	}
 
 	// URL of the booking service
-	bookingServiceURL := "http://localhost:9000/api/v1/verify-booking/" + UserId + "/" + BookingId
+	verifyURL := vehicleServiceURL + "/api/v1/verify-booking/" + UserId + "/" + BookingId
 
 	// Send GET request to the booking service to validate the booking
-	resp, err := http.Get(bookingServiceURL)
+	resp, err := auth.ServiceGet(verifyURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get booking data: %v", err)
 	}
@@ -140,12 +320,15 @@ func validateBooking(UserId string, BookingId string) (*VehicleBookingDetails, e
 	case http.StatusNotFound:
 		return nil, fmt.Errorf("booking not found")
 
+	case http.StatusGone:
+		return nil, errBookingSessionExpired
+
 	default:
 		return nil, fmt.Errorf("failed to get booking data, status code: %d", resp.StatusCode)
 	}
 }
 
-// Get Card Details by User ID
+// Get Card Details by User ID, returning the user's default payment method
 func getCardDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 	// Set the response header
 	w.Header().Set("Content-Type", "application/json")
@@ -156,18 +339,17 @@ func getCardDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 		Card    *Card  `json:"card"`
 	}
 
-	// Get the user_id from the request
-	userId := mux.Vars(r)["id"]
-
-	// Query to get card details by user_id
-	query := "SELECT card_id, card_number, card_expiry, cvv, card_balance FROM card WHERE user_id = ?"
-
-	// Execute the query
-	row := db.QueryRow(query, userId)
+	// Get the user_id from the access token
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Error converting user_id to int", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
-	// Scan the row and assign to the Card struct
-	var card Card
-	if err := row.Scan(&card.CardID, &card.CardNumber, &card.CardExpiry, &card.CVV, &card.CardBalance); err != nil {
+	card, err := getPaymentMethod(db, userId, 0)
+	if err != nil {
 		// If there is an error
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -181,17 +363,9 @@ func getCardDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	userIdInt, err := strconv.Atoi(userId)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error converting user_id to int", nil}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	card.UserID = userIdInt
 	// If card found
 	w.WriteHeader(http.StatusOK)
-	response := Response{"Card found", &card}
+	response := Response{"Card found", card}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -205,30 +379,50 @@ func createInvoice(w http.ResponseWriter, r *http.Request) {
 		Message string   `json:"message"`
 		Invoice *Invoice `json:"invoice"`
 	}
-	// Get the user_id and booking_id from the request
-	userId := mux.Vars(r)["id"]
+	// Get the user_id from the access token and booking_id from the request
+	userId := auth.UserID(r)
 	bookingId := mux.Vars(r)["booking_id"]
 
 	// Validate the booking
 	booking, err := validateBooking(userId, bookingId)
 	if err != nil {
 		fmt.Println(err)
+		// Expired booking sessions must not be invoiced
+		if errors.Is(err, errBookingSessionExpired) {
+			w.WriteHeader(http.StatusGone)
+			response := Response{"Booking session expired", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		response := Response{"Booking not found", nil} // comment
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	fmt.Println(booking)
-	baseCost := booking.BaseCost
-	promotionCode := booking.PromotionCode
-	fmt.Println(promotionCode)
-	discountApplied := booking.DiscountApplied
-	totalAmount := booking.TotalAmount
+	// Itemise the booking, adding tax on top of the price quoted by the vehicle service
+	items, err := bookingLineItems(booking)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Error itemising invoice", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// The price quoted by the vehicle service must be exactly the sum of its lines
+	if _, _, quoted := invoiceTotals(items); quoted != booking.TotalAmount {
+		fmt.Println(errInvoiceTotalMismatch, booking.TotalAmount, quoted)
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Invoice total does not match its line items", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	items = addTaxLineItem(items)
+	baseCost, discountApplied, totalAmount := invoiceTotals(items)
 	details := "Reserved the " + booking.Brand + " " + booking.Model + " on " + booking.ScheduleDate + " from " + booking.StartTime + " to " + booking.EndTime
 	var invoiceSentBefore bool
 	var invoiceId int64
 	// Query to check if invoice is already sent
-	query := "SELECT invoice_id FROM invoice WHERE booking_id = ?"
+	query := "SELECT invoice_id FROM invoice WHERE booking_id = ? AND invoice_type = 'Booking'"
 	err = db.QueryRow(query, bookingId).Scan(&invoiceId) // corrected the assignment here
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -245,54 +439,40 @@ func createInvoice(w http.ResponseWriter, r *http.Request) {
 	}
 	// If invoice is not sent before
 	if !invoiceSentBefore {
-		if promotionCode != nil {
-			// Insert query with promo code
-			query = "INSERT INTO invoice (booking_id, user_id, base_cost, promo_code, discount_applied, total_amount, details, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-			result, err := db.Exec(query, bookingId, userId, baseCost, promotionCode, discountApplied, totalAmount, details, "Pending")
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := Response{"Error inserting invoice", nil}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			invoiceId, err = result.LastInsertId()
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := Response{"Error getting invoice id", nil}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-		} else {
-			// Insert query without promo code
-			query = "INSERT INTO invoice (booking_id, user_id, base_cost, discount_applied, total_amount, details, status) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			result, err := db.Exec(query, bookingId, userId, baseCost, discountApplied, totalAmount, details, "Pending")
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := Response{"Error inserting invoice", nil}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			invoiceId, err = result.LastInsertId()
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				response := Response{"Error getting invoice id", nil}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
 		}
-		var invoice Invoice
-		// Get the invoice details
-		if promotionCode != nil { // corrected the condition to check promo code
-			query = "SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status FROM invoice WHERE invoice_id = ?"
-			err = db.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status)
-		} else {
-			query = "SELECT invoice_id, booking_id, user_id, issue_date, base_cost, discount_applied, total_amount, details, status FROM invoice WHERE invoice_id = ?"
-			err = db.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status)
+		defer tx.Rollback()
+
+		// Insert the invoice, with the promo code if one was applied
+		query = "INSERT INTO invoice (booking_id, user_id, base_cost, promo_code, discount_applied, total_amount, details, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		result, err := tx.Exec(query, bookingId, userId, baseCost, booking.PromotionCode, discountApplied, totalAmount, details, "Pending")
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error inserting invoice", nil}
+			json.NewEncoder(w).Encode(response)
+			return
 		}
+		invoiceId, err = result.LastInsertId()
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error getting invoice id", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if err := insertLineItems(tx, invoiceId, items); err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error inserting line items", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// Get the invoice details
+		invoice, err := getInvoiceByID(tx, invoiceId)
 		if err != nil {
 			fmt.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -300,8 +480,22 @@ func createInvoice(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(response)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error querying line items", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// Let the user know the invoice was issued
+		go notifyUser(userId, "invoice", invoiceNotification(invoice))
+
 		w.WriteHeader(http.StatusOK)
-		response := Response{"Invoice created", &invoice}
+		response := Response{"Invoice created", invoice}
 		json.NewEncoder(w).Encode(response)
 	}
 	// If invoice is already sent
@@ -323,11 +517,11 @@ func getInvoiceDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 		Invoices []Invoice `json:"invoices"`
 	}
 
-	// Get the user_id from the request
-	userId := mux.Vars(r)["id"]
+	// Get the user_id from the access token
+	userId := auth.UserID(r)
 
 	// Query to get invoice details by user_id
-	query := `SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status 
+	query := `SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id
 	FROM 
 		invoice 
 	WHERE 
@@ -356,7 +550,7 @@ func getInvoiceDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var invoice Invoice
 		// Scan the row and assign to the Invoice struct
-		if err := rows.Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status); err != nil {
+		if err := rows.Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status, &invoice.InvoiceType, &invoice.ParentInvoiceID); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			response := Response{"Error iterating invoices", nil}
 			json.NewEncoder(w).Encode(response)
@@ -374,6 +568,27 @@ func getInvoiceDetailsByUserID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Attach the credit notes issued against each invoice
+	creditNotes, err := getCreditNotesByUserID(userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Error querying credit notes", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// Attach the line items of each invoice
+	lineItems, err := getLineItemsByUserID(userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Error querying line items", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	for i := range invoices {
+		invoices[i].CreditNotes = creditNotes[invoices[i].InvoiceID]
+		invoices[i].LineItems = lineItems[invoices[i].InvoiceID]
+	}
+
 	// If invoices found
 	if len(invoices) > 0 {
 		w.WriteHeader(http.StatusOK)
@@ -402,7 +617,7 @@ func getInvoiceDetailsByInvoiceID(w http.ResponseWriter, r *http.Request) {
 	invoiceId := mux.Vars(r)["id"]
 
 	// Query to get invoice details by invoice_id
-	query := `SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status 
+	query := `SELECT invoice_id, booking_id, user_id, issue_date, base_cost, promo_code, discount_applied, total_amount, details, status, invoice_type, parent_invoice_id
 	FROM 
 		invoice 
 	WHERE 
@@ -410,7 +625,7 @@ func getInvoiceDetailsByInvoiceID(w http.ResponseWriter, r *http.Request) {
 
 	// Execute the query
 	var invoice Invoice
-	err := db.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status)
+	err := db.QueryRow(query, invoiceId).Scan(&invoice.InvoiceID, &invoice.BookingID, &invoice.UserID, &invoice.IssueDate, &invoice.BaseCost, &invoice.PromotionCode, &invoice.DiscountApplied, &invoice.TotalAmount, &invoice.Details, &invoice.Status, &invoice.InvoiceType, &invoice.ParentInvoiceID)
 	if err != nil {
 		// If there is an error
 		if err == sql.ErrNoRows {
@@ -425,6 +640,22 @@ func getInvoiceDetailsByInvoiceID(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	// Only the owner of the invoice may view it
+	if !auth.OwnsResource(r, invoice.UserID) {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Invoice not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Get the line items of the invoice
+	invoice.LineItems, err = getLineItemsByInvoiceID(invoice.InvoiceID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Error querying line items", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	// If invoice found
 	w.WriteHeader(http.StatusOK)
@@ -445,16 +676,23 @@ func makePayment(w http.ResponseWriter, r *http.Request) {
 
 	// Get the invoice_id from the request
 	invoiceId := mux.Vars(r)["id"]
+	invoiceIdInt, err := strconv.Atoi(invoiceId)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid invoice id", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	// Query to get invoice details by invoice_id
 	query := "SELECT booking_id, user_id, total_amount, status  FROM invoice WHERE invoice_id = ?"
 
-	var bookingId int
+	var bookingIdValue sql.NullInt64
 	var userId int
-	var totalAmount float64
+	var totalAmount money.Money
 	var status string
 	// Execute the query
-	err := db.QueryRow(query, invoiceId).Scan(&bookingId, &userId, &totalAmount, &status)
+	err = db.QueryRow(query, invoiceId).Scan(&bookingIdValue, &userId, &totalAmount, &status)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -468,146 +706,164 @@ func makePayment(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	// Only the owner of the invoice may pay for it
+	if !auth.OwnsResource(r, userId) {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Invoice not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	if status == "Paid" {
 		w.WriteHeader(http.StatusConflict)
 		response := Response{"Invoice already paid", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Get the card details from the request
-	var card Card
-	err = json.NewDecoder(r.Body).Decode(&card)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Invalid card details", nil}
+	if status == "Processing" {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Invoice payment already in progress", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-
-	// Query to get card details by user_id
-	var cardDetails Card
-	query = "SELECT card_id, card_number, card_expiry, cvv, card_balance FROM card WHERE user_id = ?"
-	err = db.QueryRow(query, userId).Scan(&cardDetails.CardID, &cardDetails.CardNumber, &cardDetails.CardExpiry, &cardDetails.CVV, &cardDetails.CardBalance)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			response := Response{"Card not found", nil}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error querying card details", nil}
+	// Membership invoices are charged when the membership is subscribed to or renewed
+	if !bookingIdValue.Valid {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Membership invoices cannot be paid separately", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check card number matches with the card details
-	if card.CardNumber != cardDetails.CardNumber {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Card number does not match", nil}
+	bookingId := int(bookingIdValue.Int64)
+	// Refuse payment if the booking session expired after the invoice was created
+	_, err = validateBooking(strconv.Itoa(userId), strconv.Itoa(bookingId))
+	if errors.Is(err, errBookingSessionExpired) {
+		w.WriteHeader(http.StatusGone)
+		response := Response{"Booking session expired", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check card expiry matches with the card details
-	if card.CardExpiry != cardDetails.CardExpiry {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Card expiry does not match", nil}
-		json.NewEncoder(w).Encode(response)
-		return
+	// Get how to pay: wallet_amount from the wallet and the rest from the chosen card, or the user's default one
+	var paymentRequest struct {
+		CardID       int         `json:"card_id"`
+		WalletAmount money.Money `json:"wallet_amount"`
 	}
-	// Check CVV matches with the card details
-	if card.CVV != cardDetails.CVV {
+	if err := json.NewDecoder(r.Body).Decode(&paymentRequest); err != nil && err != io.EOF {
 		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"CVV does not match", nil}
+		response := Response{"Invalid payment details", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check the expiry date of the card
-	today := time.Now()
-	expiryDate, err := time.Parse("01/06", cardDetails.CardExpiry)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error parsing expiry date", nil}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	if today.After(expiryDate) {
+	walletAmount := paymentRequest.WalletAmount
+	if walletAmount < 0 || walletAmount > totalAmount {
 		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Card expired", nil}
+		response := Response{"Wallet amount must be between 0 and the invoice total", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check if the card has sufficient balance
-	if cardDetails.CardBalance < totalAmount {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Insufficient balance", nil}
-		json.NewEncoder(w).Encode(response)
-		return
+	if walletAmount > 0 {
+		// Checked again when the payment is taken, with the wallet locked
+		balance, err := walletBalance(db, userId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error querying wallet balance", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if balance < walletAmount {
+			w.WriteHeader(http.StatusPaymentRequired)
+			response := Response{"Insufficient wallet balance", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
 	}
-	// Update the card balance
-	newBalance := cardDetails.CardBalance - totalAmount
-	query = "UPDATE card SET card_balance = ? WHERE user_id = ?"
-	_, err = db.Exec(query, newBalance, userId)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error updating card balance", nil}
-		json.NewEncoder(w).Encode(response)
-		return
+	var cardId sql.NullInt64
+	if walletAmount < totalAmount {
+		card, err := getPaymentMethod(db, userId, paymentRequest.CardID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				response := Response{"Card not found", nil}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error querying card details", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		// Check the expiry date of the card
+		expired, err := cardExpired(card.CardExpiry, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error parsing expiry date", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if expired {
+			w.WriteHeader(http.StatusBadRequest)
+			response := Response{"Card expired", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		cardId = sql.NullInt64{Int64: int64(card.CardID), Valid: true}
 	}
-	// Insert the billing details
-	transactionDate := time.Now().Format("2006-01-02")
-	query = "INSERT INTO billing (invoice_id, card_id, transaction_amount, transaction_date) VALUES (?, ?, ?, ?)"
-	result, err := db.Exec(query, invoiceId, cardDetails.CardID, totalAmount, transactionDate)
+	// Claim the invoice and record the payment saga
+	saga, started, err := startPaymentSaga(invoiceIdInt, bookingId, userId, cardId, totalAmount, walletAmount)
 	if err != nil {
+		fmt.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error inserting billing details", nil}
+		response := Response{"Error starting payment", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-
-	// Make payment and then confirm booking
-	fmt.Println("userId: ", userId, "bookingId: ", bookingId)
-	bookingConfirmationURL := "http://localhost:9000/api/v1/confirm-booking/" + strconv.Itoa(userId) + "/" + strconv.Itoa(bookingId)
-	fmt.Println("bookingConfirmationURL: ", bookingConfirmationURL)
-	var paymentConfirmation = struct {
-		Message        string `json:"message"`
-		PaymentSuccess bool   `json:"paymentSuccess"`
-	}{
-		Message:        "Payment successful",
-		PaymentSuccess: true, // Assume payment is successful, set to true
-	}
-
-	// Prepare JSON payload for booking confirmation
-	jsonData, err := json.Marshal(paymentConfirmation)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error preparing confirmation data", nil}
+	if !started {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Invoice already paid or being processed", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Send the confirmation request
-	resp, err := http.Post(bookingConfirmationURL, "application/json", bytes.NewBuffer(jsonData))
+	// Reserve the payment, confirm the booking and capture the payment
+	err = runPaymentSaga(saga)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Error sending booking confirmation", nil}
-		json.NewEncoder(w).Encode(response)
+		fmt.Println("Payment saga", saga.SagaID, "stopped:", err)
+		switch {
+		case errors.Is(err, errCardDeclined):
+			w.WriteHeader(http.StatusPaymentRequired)
+			response := Response{"Card declined", nil}
+			json.NewEncoder(w).Encode(response)
+		case errors.Is(err, errInsufficientWalletBalance):
+			w.WriteHeader(http.StatusPaymentRequired)
+			response := Response{"Insufficient wallet balance", nil}
+			json.NewEncoder(w).Encode(response)
+		case errors.Is(err, errBookingNotConfirmed):
+			w.WriteHeader(http.StatusConflict)
+			response := Response{"Booking could not be confirmed, payment refunded", nil}
+			json.NewEncoder(w).Encode(response)
+		case errors.Is(err, errConfirmationPending):
+			w.WriteHeader(http.StatusAccepted)
+			response := Response{"Payment reserved, booking confirmation pending", nil}
+			json.NewEncoder(w).Encode(response)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			response := Response{"Error processing payment", nil}
+			json.NewEncoder(w).Encode(response)
+		}
 		return
 	}
-	fmt.Println("Booking confirmation response status: ", resp.Status)
-	defer resp.Body.Close()
 
-	// Get the billing id
-	billingId, err := result.LastInsertId()
-	if err != nil {
+	// Get the billing id recorded when the payment was captured
+	saga, err = loadPaymentSaga(saga.SagaID)
+	if err != nil || !saga.BillingID.Valid {
 		w.WriteHeader(http.StatusInternalServerError)
 		response := Response{"Error getting billing id", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	billingId := saga.BillingID.Int64
 	var billing Billing
 	// Get the billing details
-	query = "SELECT billing_id, invoice_id, card_id, transaction_amount, transaction_date FROM billing WHERE billing_id = ?"
-	err = db.QueryRow(query, billingId).Scan(&billing.BillingID, &billing.InvoiceID, &billing.CardID, &billing.TransactionAmount, &billing.TransactionDate)
+	query = "SELECT billing_id, invoice_id, card_id, transaction_amount, wallet_amount, transaction_date FROM billing WHERE billing_id = ?"
+	err = db.QueryRow(query, billingId).Scan(&billing.BillingID, &billing.InvoiceID, &billing.CardID, &billing.TransactionAmount, &billing.WalletAmount, &billing.TransactionDate)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		response := Response{"Error querying billing details", nil}
@@ -633,20 +889,23 @@ func getReceiptDetailsByBillingID(w http.ResponseWriter, r *http.Request) {
 	// Get the billing_id from the request
 	billingId := mux.Vars(r)["id"]
 
-	// Query to get receipt details and the card number
+	// Query to get receipt details, the card's last digits and the owner of the invoice
 	query := `
-		SELECT r.receipt_id, r.card_id, r.amount, r.date, r.description, c.card_number
+		SELECT r.receipt_id, r.card_id, r.amount, b.wallet_amount, r.date, r.description, COALESCE(c.last_four, ''), i.user_id
 		FROM receipt r
-		INNER JOIN card c ON r.card_id = c.card_id
+		LEFT JOIN card c ON r.card_id = c.card_id
+		INNER JOIN billing b ON r.billing_id = b.billing_id
+		INNER JOIN invoice i ON b.invoice_id = i.invoice_id
 		WHERE r.billing_id = ?
 	`
 
-	// Declare variables to hold the receipt data and card number
+	// Declare variables to hold the receipt data, card digits and owner
 	var receipt Receipt
-	var cardNumber string
+	var lastFour string
+	var ownerId int
 
 	// Execute the query
-	err := db.QueryRow(query, billingId).Scan(&receipt.ReceiptID, &receipt.CardID, &receipt.Amount, &receipt.Date, &receipt.Description, &cardNumber)
+	err := db.QueryRow(query, billingId).Scan(&receipt.ReceiptID, &receipt.CardID, &receipt.Amount, &receipt.WalletAmount, &receipt.Date, &receipt.Description, &lastFour, &ownerId)
 	if err != nil {
 		// If there is an error
 		if err == sql.ErrNoRows {
@@ -661,12 +920,16 @@ func getReceiptDetailsByBillingID(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	// Only the owner of the receipt may view it
+	if !auth.OwnsResource(r, ownerId) {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Receipt not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	receipt.BillingID, _ = strconv.Atoi(billingId)
-	// Mask the card number by replacing the first digits with asterisks and keeping the last 3 digits
-	maskedCardNumber := maskCardNumber(cardNumber)
-
-	// Assign the masked card number to the receipt
-	receipt.CardLastThree = maskedCardNumber
+	// Show how it was paid, with only the card's last digits
+	receipt.PaymentMethod = paymentMethodLabel(lastFour, receipt.WalletAmount)
 
 	// If receipt found
 	w.WriteHeader(http.StatusOK)
@@ -674,12 +937,19 @@ func getReceiptDetailsByBillingID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Mask the card number by replacing all but the last 3 digits with asterisks
-func maskCardNumber(cardNumber string) string {
-	// Ensure the card number is at least 3 characters long
-	if len(cardNumber) < 3 {
-		return cardNumber
+// Mask a card from its last four digits (e.g., **** **** **** 1234)
+func maskCardNumber(lastFour string) string {
+	return "**** **** **** " + lastFour
+}
+
+// Describe how a payment was made: the masked card, the wallet, or both
+func paymentMethodLabel(lastFour string, walletAmount money.Money) string {
+	switch {
+	case lastFour == "":
+		return "Wallet"
+	case walletAmount > 0:
+		return fmt.Sprintf("%s and wallet ($%s)", maskCardNumber(lastFour), walletAmount)
+	default:
+		return maskCardNumber(lastFour)
 	}
-	// Mask the card number (e.g., ************123)
-	return "**** **** **** " + cardNumber[len(cardNumber)-4:]
 }
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Kinds of wallet transaction recorded in the ledger
+const (
+	ledgerTopUp      = "TopUp"
+	ledgerCharge     = "Charge"
+	ledgerRefund     = "Refund"
+	ledgerAdjustment = "Adjustment"
+)
+
+// Ledger accounts. Every transaction posts one entry to the user's wallet and an equal and opposite
+// one to the counter account of its kind, so the entries of a transaction always sum to zero.
+const (
+	accountWallet     = "Wallet"
+	accountCard       = "Card"       // money coming in from the user's cards
+	accountRevenue    = "Revenue"    // money paid for invoices, and returned by refunds
+	accountAdjustment = "Adjustment" // corrections made by administrators
+)
+
+var ledgerCounterAccounts = map[string]string{
+	ledgerTopUp:      accountCard,
+	ledgerCharge:     accountRevenue,
+	ledgerRefund:     accountRevenue,
+	ledgerAdjustment: accountAdjustment,
+}
+
+// Largest amount a single top-up may add to the wallet
+const maxWalletTopUp money.Money = 1000_00
+
+var (
+	// The wallet balance does not cover the amount taken out of it
+	errInsufficientWalletBalance = errors.New("insufficient wallet balance")
+	// Another worker already completed or declined the top-up
+	errTopUpNotPending = errors.New("top-up is no longer pending")
+)
+
+// A wallet transaction, as seen from the wallet: a positive amount adds to the balance
+type WalletTransaction struct {
+	TransactionID int64       `json:"transaction_id"`
+	Type          string      `json:"type"`
+	Amount        money.Money `json:"amount"`
+	InvoiceID     *int        `json:"invoice_id"`
+	CardID        *int        `json:"card_id"`
+	Description   string      `json:"description"`
+	Reference     *string     `json:"-"` // what the transaction is for, e.g. a payment saga; unique if set
+	CreatedAt     string      `json:"created_at,omitempty"`
+}
+
+// A top-up from a card, recorded as pending before the card is charged so a retry charges it under the same reference
+type walletTopUp struct {
+	TopUpID     int64
+	UserID      int
+	CardID      int
+	Amount      money.Money
+	Description string
+}
+
+// Get the user's wallet balance, the sum of the wallet's ledger entries
+func walletBalance(q queryRower, userId int) (money.Money, error) {
+	var balance money.Money
+	err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entry WHERE account = ? AND user_id = ?", accountWallet, userId).Scan(&balance)
+	return balance, err
+}
+
+// Lock the user's wallet until the transaction ends, creating it on first use, and get its balance
+func lockWallet(tx *sql.Tx, userId int) (money.Money, error) {
+	if _, err := tx.Exec("INSERT IGNORE INTO wallet (user_id) VALUES (?)", userId); err != nil {
+		return 0, err
+	}
+	var locked int
+	if err := tx.QueryRow("SELECT user_id FROM wallet WHERE user_id = ? FOR UPDATE", userId).Scan(&locked); err != nil {
+		return 0, err
+	}
+	return walletBalance(tx, userId)
+}
+
+// Record a wallet transaction in the ledger, refusing to take the balance below zero
+func postWalletTransaction(tx *sql.Tx, userId int, transaction *WalletTransaction) error {
+	counterAccount, ok := ledgerCounterAccounts[transaction.Type]
+	if !ok {
+		return fmt.Errorf("unknown wallet transaction type %q", transaction.Type)
+	}
+	if transaction.Amount == 0 {
+		return fmt.Errorf("wallet transaction of zero")
+	}
+
+	balance, err := lockWallet(tx, userId)
+	if err != nil {
+		return err
+	}
+	if balance+transaction.Amount < 0 {
+		return errInsufficientWalletBalance
+	}
+
+	query := "INSERT INTO ledger_transaction (user_id, transaction_type, invoice_id, card_id, description, reference) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, userId, transaction.Type, transaction.InvoiceID, transaction.CardID, transaction.Description, transaction.Reference)
+	if err != nil {
+		return err
+	}
+	transaction.TransactionID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	query = "INSERT INTO ledger_entry (transaction_id, account, user_id, amount) VALUES (?, ?, ?, ?), (?, ?, NULL, ?)"
+	_, err = tx.Exec(query, transaction.TransactionID, accountWallet, userId, transaction.Amount, transaction.TransactionID, counterAccount, -transaction.Amount)
+	return err
+}
+
+// Return money for a payment to the wallet. Card refunds go through the gateway outside any transaction.
+func refundToWallet(tx *sql.Tx, userId int, amount money.Money, invoiceId int, reference string) error {
+	return postWalletTransaction(tx, userId, &WalletTransaction{
+		Type:        ledgerRefund,
+		Amount:      amount,
+		InvoiceID:   &invoiceId,
+		Description: fmt.Sprintf("Refund for invoice %d", invoiceId),
+		Reference:   &reference,
+	})
+}
+
+// Split a refund of a booking between the wallet and the cards in proportion to how the booking was paid.
+// The wallet's share is capped at what it paid less what was already refunded to it. The cards' share goes
+// back to each payment's card in the order they were made, up to what that payment has left to refund, and
+// anything the cards cannot take back goes to the wallet. Returns the wallet's share and the card refunds.
+func splitRefund(tx *sql.Tx, bookingId string, amount money.Money) (money.Money, []CardRefund, error) {
+	query := `
+		SELECT b.billing_id, b.card_id, b.transaction_amount, b.wallet_amount,
+			(SELECT COALESCE(SUM(r.amount), 0) FROM credit_note_card_refund r WHERE r.billing_id = b.billing_id)
+		FROM billing b
+		INNER JOIN invoice i ON b.invoice_id = i.invoice_id
+		WHERE i.booking_id = ?
+		ORDER BY b.billing_id`
+	rows, err := tx.Query(query, bookingId)
+	if err != nil {
+		return 0, nil, err
+	}
+	var paid, walletPaid money.Money
+	var cardPayments []CardRefund
+	for rows.Next() {
+		var billingId int
+		var cardId sql.NullInt64
+		var transactionAmount, walletAmount, cardRefunded money.Money
+		if err := rows.Scan(&billingId, &cardId, &transactionAmount, &walletAmount, &cardRefunded); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		paid += transactionAmount
+		walletPaid += walletAmount
+		if cardId.Valid {
+			// What is left to refund to the card this payment was made with
+			cardPayments = append(cardPayments, CardRefund{BillingID: billingId, CardID: int(cardId.Int64), Amount: transactionAmount - walletAmount - cardRefunded})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(cardPayments) == 0 {
+		return amount, nil, nil
+	}
+
+	var walletShare money.Money
+	if paid > 0 && walletPaid > 0 {
+		var walletRefunded money.Money
+		query = `SELECT COALESCE(SUM(cn.wallet_amount), 0) FROM credit_note cn INNER JOIN invoice i ON cn.invoice_id = i.invoice_id WHERE i.booking_id = ?`
+		if err := tx.QueryRow(query, bookingId).Scan(&walletRefunded); err != nil {
+			return 0, nil, err
+		}
+		walletShare = amount.MulDiv(int64(walletPaid), int64(paid))
+		walletShare = max(min(walletShare, walletPaid-walletRefunded, amount), 0)
+	}
+
+	cardShare := amount - walletShare
+	var cardRefunds []CardRefund
+	for _, payment := range cardPayments {
+		refund := min(cardShare, payment.Amount)
+		if refund <= 0 {
+			continue
+		}
+		cardRefunds = append(cardRefunds, CardRefund{BillingID: payment.BillingID, CardID: payment.CardID, Amount: refund, Status: cardRefundPending})
+		cardShare -= refund
+	}
+	return walletShare + cardShare, cardRefunds, nil
+}
+
+// Get the user's wallet balance and latest transactions
+func getWallet(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message      string              `json:"message"`
+		Balance      money.Money         `json:"balance"`
+		Transactions []WalletTransaction `json:"transactions"`
+	}
+
+	// Get the user_id from the access token
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid user id"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	balance, err := walletBalance(db, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	query := `
+		SELECT t.transaction_id, t.transaction_type, e.amount, t.invoice_id, t.card_id, t.description, t.created_at
+		FROM ledger_transaction t
+		INNER JOIN ledger_entry e ON e.transaction_id = t.transaction_id AND e.account = ?
+		WHERE t.user_id = ?
+		ORDER BY t.transaction_id DESC
+		LIMIT 50`
+	rows, err := db.Query(query, accountWallet, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []WalletTransaction{}
+	for rows.Next() {
+		var transaction WalletTransaction
+		if err := rows.Scan(&transaction.TransactionID, &transaction.Type, &transaction.Amount, &transaction.InvoiceID, &transaction.CardID, &transaction.Description, &transaction.CreatedAt); err != nil {
+			http.Error(w, "Error reading wallet transactions", http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, transaction)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Wallet found", balance, transactions}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Add money to the wallet from one of the user's cards, the default if none is chosen
+func topUpWallet(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message     string             `json:"message"`
+		Balance     money.Money        `json:"balance"`
+		Transaction *WalletTransaction `json:"transaction"`
+	}
+
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid user id"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	var topUpRequest struct {
+		Amount money.Money `json:"amount"`
+		CardID int         `json:"card_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&topUpRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid top-up data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	amount := topUpRequest.Amount
+	if amount <= 0 || amount > maxWalletTopUp {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: fmt.Sprintf("Top-up amount must be between 0.01 and %s", maxWalletTopUp)}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	card, err := getPaymentMethod(db, userId, topUpRequest.CardID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{Message: "Card not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if expired, err := cardExpired(card.CardExpiry, time.Now()); err != nil || expired {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Card expired"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Record the top-up as pending first, so the charge has a reference that stays the same if it is retried
+	topUp := walletTopUp{
+		UserID:      userId,
+		CardID:      card.CardID,
+		Amount:      amount,
+		Description: fmt.Sprintf("Top-up from %s ending %s", card.Brand, card.LastFour),
+	}
+	query := "INSERT INTO wallet_top_up (user_id, card_id, amount, description) VALUES (?, ?, ?, ?)"
+	result, err := db.Exec(query, topUp.UserID, topUp.CardID, topUp.Amount, topUp.Description)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error recording top-up", http.StatusInternalServerError)
+		return
+	}
+	topUp.TopUpID, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Error getting top-up id", http.StatusInternalServerError)
+		return
+	}
+
+	// Charge the card, then add the money to the wallet
+	transaction, err := completeWalletTopUp(&topUp)
+	if errors.Is(err, errCardDeclined) {
+		w.WriteHeader(http.StatusPaymentRequired)
+		response := Response{Message: "Card declined"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if errors.Is(err, errTopUpNotPending) {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Top-up already processed"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		// The recovery loop retries the charge under the same reference
+		fmt.Println(err)
+		http.Error(w, "Error charging card", http.StatusInternalServerError)
+		return
+	}
+	balance, err := walletBalance(db, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Wallet topped up", balance, transaction}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Charge the card for a pending top-up, outside any transaction, then post it to the ledger and mark it completed.
+// A declined card marks the top-up declined; any other failure leaves it pending for the recovery loop.
+func completeWalletTopUp(topUp *walletTopUp) (*WalletTransaction, error) {
+	reference := fmt.Sprintf("wallet-top-up-%d", topUp.TopUpID)
+	err := chargeCard(db, topUp.CardID, topUp.Amount, reference)
+	if errors.Is(err, errCardDeclined) {
+		if _, updateErr := db.Exec("UPDATE wallet_top_up SET status = 'Declined' WHERE top_up_id = ? AND status = 'Pending'", topUp.TopUpID); updateErr != nil {
+			return nil, updateErr
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE wallet_top_up SET status = 'Completed' WHERE top_up_id = ? AND status = 'Pending'", topUp.TopUpID)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, errTopUpNotPending
+	}
+	transaction := WalletTransaction{
+		Type:        ledgerTopUp,
+		Amount:      topUp.Amount,
+		CardID:      &topUp.CardID,
+		Description: topUp.Description,
+		Reference:   &reference,
+	}
+	if err := postWalletTransaction(tx, topUp.UserID, &transaction); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// Finish top-ups left pending, e.g. by a restart or a gateway timeout
+func recoverWalletTopUps(staleAfter time.Duration) {
+	query := `SELECT top_up_id, user_id, card_id, amount, description FROM wallet_top_up
+	WHERE status = 'Pending' AND created_at < NOW() - INTERVAL ? SECOND`
+	rows, err := db.Query(query, int(staleAfter.Seconds()))
+	if err != nil {
+		log.Println("Failed to query pending top-ups:", err)
+		return
+	}
+	var topUps []walletTopUp
+	for rows.Next() {
+		var topUp walletTopUp
+		if err := rows.Scan(&topUp.TopUpID, &topUp.UserID, &topUp.CardID, &topUp.Amount, &topUp.Description); err != nil {
+			log.Println("Failed to read top-up:", err)
+			continue
+		}
+		topUps = append(topUps, topUp)
+	}
+	rows.Close()
+
+	for i := range topUps {
+		_, err := completeWalletTopUp(&topUps[i])
+		log.Println("Resumed top-up", topUps[i].TopUpID, "result:", err)
+	}
+}
+
+// Periodically finish pending top-ups, starting with any left over from before a restart
+func startWalletTopUpRecovery(interval time.Duration) {
+	recoverWalletTopUps(0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		recoverWalletTopUps(interval)
+	}
+}
+
+// Credit or debit a user's wallet to correct it (admins only). A negative amount takes money out.
+func adjustWallet(w http.ResponseWriter, r *http.Request) {
+	// Set the response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message     string             `json:"message"`
+		Balance     money.Money        `json:"balance"`
+		Transaction *WalletTransaction `json:"transaction"`
+	}
+
+	// The wallet adjusted is the one in the path, not the admin's own
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid user id"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	var adjustRequest struct {
+		Amount      money.Money `json:"amount"`
+		Description string      `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&adjustRequest); err != nil || adjustRequest.Amount == 0 || adjustRequest.Description == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "An amount and a description are required"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction := WalletTransaction{Type: ledgerAdjustment, Amount: adjustRequest.Amount, Description: adjustRequest.Description}
+	err = postWalletTransaction(tx, userId, &transaction)
+	if errors.Is(err, errInsufficientWalletBalance) {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Insufficient wallet balance"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error recording adjustment", http.StatusInternalServerError)
+		return
+	}
+	balance, err := walletBalance(tx, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Wallet adjusted", balance, &transaction}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"shared/money"
+)
+
+// A payment of the booking as billed: its card, what it took and how much of it has been refunded to the card
+type billedPayment struct {
+	billingId    int
+	cardId       interface{}
+	paid         money.Money
+	walletPaid   money.Money
+	cardRefunded money.Money
+}
+
+func TestSplitRefund(t *testing.T) {
+	tests := []struct {
+		name            string
+		payments        []billedPayment
+		walletRefunded  money.Money
+		amount          money.Money
+		wantWallet      money.Money
+		wantCardRefunds []CardRefund
+	}{
+		{"card only", []billedPayment{{5, 4, 100_00, 0, 0}}, 0, 50_00, 0, []CardRefund{{5, 4, 50_00, cardRefundPending}}},
+		{"wallet only", []billedPayment{{5, nil, 100_00, 100_00, 0}}, 0, 50_00, 50_00, nil},
+		{"split pro rata", []billedPayment{{5, 4, 100_00, 25_00, 0}}, 0, 40_00, 10_00, []CardRefund{{5, 4, 30_00, cardRefundPending}}},
+		{"split rounds half away from zero", []billedPayment{{5, 4, 30_00, 10_00, 0}}, 0, 10_01, 3_34, []CardRefund{{5, 4, 6_67, cardRefundPending}}},
+		{"full refund of a split payment", []billedPayment{{5, 4, 100_00, 25_00, 0}}, 0, 100_00, 25_00, []CardRefund{{5, 4, 75_00, cardRefundPending}}},
+		{"capped at what the wallet has left", []billedPayment{{5, 4, 100_00, 25_00, 0}}, 20_00, 40_00, 5_00, []CardRefund{{5, 4, 35_00, cardRefundPending}}},
+		{"nothing left for the wallet", []billedPayment{{5, 4, 100_00, 25_00, 0}}, 25_00, 40_00, 0, []CardRefund{{5, 4, 40_00, cardRefundPending}}},
+		{"each payment back to its own card", []billedPayment{{5, 4, 60_00, 0, 0}, {8, 6, 40_00, 0, 0}}, 0, 80_00, 0, []CardRefund{{5, 4, 60_00, cardRefundPending}, {8, 6, 20_00, cardRefundPending}}},
+		{"past card refunds are not refunded again", []billedPayment{{5, 4, 60_00, 0, 50_00}, {8, 6, 40_00, 0, 0}}, 0, 30_00, 0, []CardRefund{{5, 4, 10_00, cardRefundPending}, {8, 6, 20_00, cardRefundPending}}},
+		{"what the cards cannot take back goes to the wallet", []billedPayment{{5, 4, 60_00, 0, 60_00}}, 0, 10_00, 10_00, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, _ := setUpGatewayTest(t)
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows([]string{"billing_id", "card_id", "transaction_amount", "wallet_amount", "card_refunded"})
+			var paid, walletPaid money.Money
+			hasCard := false
+			for _, payment := range tt.payments {
+				rows.AddRow(payment.billingId, payment.cardId, payment.paid.String(), payment.walletPaid.String(), payment.cardRefunded.String())
+				paid += payment.paid
+				walletPaid += payment.walletPaid
+				hasCard = hasCard || payment.cardId != nil
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT b.billing_id, b.card_id, b.transaction_amount, b.wallet_amount")).
+				WithArgs("9").
+				WillReturnRows(rows)
+			if hasCard && paid > 0 && walletPaid > 0 {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(cn.wallet_amount), 0) FROM credit_note")).
+					WithArgs("9").
+					WillReturnRows(sqlmock.NewRows([]string{"wallet_refunded"}).AddRow(tt.walletRefunded.String()))
+			}
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			gotWallet, gotCardRefunds, err := splitRefund(tx, "9", tt.amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotWallet != tt.wantWallet || !reflect.DeepEqual(gotCardRefunds, tt.wantCardRefunds) {
+				t.Errorf("split of %v = %v to the wallet and %v to cards, want %v and %v", tt.amount, gotWallet, gotCardRefunds, tt.wantWallet, tt.wantCardRefunds)
+			}
+		})
+	}
+}
+
+// A top-up charges the card under the top-up's reference before anything is posted, then posts it once
+func TestCompleteWalletTopUp(t *testing.T) {
+	mock, gateway := setUpGatewayTest(t)
+	topUp := &walletTopUp{TopUpID: 3, UserID: 2, CardID: 4, Amount: 20_00, Description: "Top-up from Visa ending 4242"}
+
+	expectCardToken(mock, 4, fakeTokenPrefix+"abc")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE wallet_top_up SET status = 'Completed' WHERE top_up_id = ? AND status = 'Pending'")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO wallet")).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM wallet WHERE user_id = ? FOR UPDATE")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(amount), 0) FROM ledger_entry")).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("0.00"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ledger_transaction")).
+		WithArgs(2, ledgerTopUp, nil, 4, topUp.Description, "wallet-top-up-3").
+		WillReturnResult(sqlmock.NewResult(15, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO ledger_entry")).
+		WithArgs(15, accountWallet, 2, "20.00", 15, accountCard, "-20.00").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	transaction, err := completeWalletTopUp(topUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.TransactionID != 15 {
+		t.Errorf("transaction id = %d, want 15", transaction.TransactionID)
+	}
+	want := gatewayCall{fakeTokenPrefix + "abc", 20_00, "wallet-top-up-3"}
+	if len(gateway.charges) != 1 || gateway.charges[0] != want {
+		t.Errorf("charges = %v, want %v", gateway.charges, []gatewayCall{want})
+	}
+}
+
+// A declined top-up is marked declined and nothing is posted to the wallet
+func TestCompleteWalletTopUpDeclined(t *testing.T) {
+	mock, _ := setUpGatewayTest(t)
+	topUp := &walletTopUp{TopUpID: 3, UserID: 2, CardID: 4, Amount: 20_00}
+
+	expectCardToken(mock, 4, fakeDeclinedTokenPrefix+"abc")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE wallet_top_up SET status = 'Declined' WHERE top_up_id = ? AND status = 'Pending'")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := completeWalletTopUp(topUp); !errors.Is(err, errCardDeclined) {
+		t.Errorf("completeWalletTopUp: %v, want %v", err, errCardDeclined)
+	}
+}
@@ -9,4 +9,47 @@
     setTimeout(() => {
         messageDiv.style.display = 'none';
     }, 3000);
-}
\ No newline at end of file
+}
+
+// Exchange the stored refresh token for a new pair of tokens
+async function refreshTokens() {
+    const refreshToken = sessionStorage.getItem('refresh_token');
+    if (!refreshToken) {
+        return false;
+    }
+    const response = await fetch("http://localhost:8000/api/v1/token/refresh", {
+        method: "POST",
+        headers: {
+            "Content-Type": "application/json"
+        },
+        body: JSON.stringify({ refresh_token: refreshToken })
+    });
+    if (!response.ok) {
+        return false;
+    }
+    const data = await response.json();
+    sessionStorage.setItem('access_token', data.access_token);
+    sessionStorage.setItem('refresh_token', data.refresh_token);
+    return true;
+}
+
+// Fetch with the access token attached, refreshing it once if it has expired
+async function authFetch(url, options = {}) {
+    const send = () => fetch(url, {
+        ...options,
+        headers: {
+            ...options.headers,
+            'Authorization': `Bearer ${sessionStorage.getItem('access_token')}`
+        }
+    });
+    let response = await send();
+    if (response.status === 401 && await refreshTokens()) {
+        response = await send();
+    }
+    // Send the user back to the login page once the session cannot be renewed
+    if (response.status === 401) {
+        sessionStorage.clear();
+        window.location.href = 'index.html';
+    }
+    return response;
+}
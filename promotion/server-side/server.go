@@ -10,6 +10,8 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+
+	"shared/auth"
 )
 
 // Promotion struct
@@ -34,12 +36,18 @@ func initDB() {
 }
 
 func main() {
+	// Refuse to start without a proper signing secret
+	auth.LoadSecret()
 	// Call initDB(), to initialise user_svc_db connection
 	initDB()
 	defer db.Close()
 	// Setting up router and API endpoints
 	router := mux.NewRouter()
-	handler := cors.Default().Handler(router)
+	router.Use(auth.Authenticate)
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+	}).Handler(router)
 	router.HandleFunc("/api/v1/promotions", getAllPromotions).Methods("GET")
 	router.HandleFunc("/api/v1/promotions/{promo_code}", getPromotionByPromoCode).Methods("GET")
 	fmt.Println("Listening at port 8080")
@@ -1,15 +1,21 @@
 @echo off
+if "%JWT_SECRET%"=="" (
+    echo JWT_SECRET must be set to a random value of at least 32 characters shared by all services.
+    pause
+    exit /b 1
+)
+
 echo Starting user service...
-start cmd /k "cd user\server-side && go run server.go"
+start cmd /k "cd user\server-side && go run ."
 
 echo Starting vehicle service...
-start cmd /k "cd vehicle\server-side && go run server.go"
+start cmd /k "cd vehicle\server-side && go run ."
 
 echo Starting billing service...
-start cmd /k "cd billing\server-side && go run server.go"
+start cmd /k "cd billing\server-side && go run ."
 
 echo Starting promotion service...
-start cmd /k "cd promotion\server-side && go run server.go"
+start cmd /k "cd promotion\server-side && go run ."
 
 echo All services are running in separate windows.
 pause
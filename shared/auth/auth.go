@@ -0,0 +1,216 @@
+// Package auth issues and verifies the JWTs shared by all services, and provides the
+// middleware and helpers the services use to authenticate requests and call each other.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Claims carried by the tokens issued by the user service
+type Claims struct {
+	UserID    int    `json:"user_id"`
+	Role      string `json:"role"`
+	TokenType string `json:"token_type"`
+	jwt.RegisteredClaims
+}
+
+// Key used to store the verified claims in the request context
+type claimsContextKey struct{}
+
+// Shortest JWT_SECRET accepted, in bytes
+const minSecretLength = 32
+
+// Secret shared by all services to sign and verify tokens, set by LoadSecret
+var secret []byte
+
+// Returned when signing or verifying before LoadSecret
+var errNoSecret = errors.New("signing secret is not loaded")
+
+// Read the signing secret from JWT_SECRET. Services call this on startup and stop if it is
+// missing or too short, so tokens are never signed with a secret anyone else could know.
+func LoadSecret() {
+	value := os.Getenv("JWT_SECRET")
+	if len(value) < minSecretLength {
+		log.Fatalf("JWT_SECRET must be set to a random value of at least %d characters", minSecretLength)
+	}
+	secret = []byte(value)
+}
+
+// Sign the claims with an expiry of ttl from now
+func SignToken(claims Claims, ttl time.Duration) (string, error) {
+	if len(secret) == 0 {
+		return "", errNoSecret
+	}
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(secret)
+}
+
+// Verify the signature and expiry of a token and check it is of the expected type
+func ParseToken(tokenString string, tokenType string) (*Claims, error) {
+	if len(secret) == 0 {
+		return nil, errNoSecret
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenType != tokenType {
+		return nil, errors.New("unexpected token type")
+	}
+	return claims, nil
+}
+
+// Hash a short secret value, such as a one-time code, for storage. It is an HMAC keyed with the
+// signing secret and the purpose, so the stored hashes cannot be brute-forced without the secret
+// and a hash made for one purpose never matches one made for another.
+func KeyedHash(purpose string, value string) (string, error) {
+	if len(secret) == 0 {
+		return "", errNoSecret
+	}
+	key := hmac.New(sha256.New, secret)
+	key.Write([]byte(purpose))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Write a JSON error in the same shape as the handlers' responses
+func WriteError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{message})
+}
+
+// Middleware that rejects requests without a valid access token and stores its claims in the context
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			WriteError(w, http.StatusUnauthorized, "Missing access token")
+			return
+		}
+		claims, err := ParseToken(strings.TrimPrefix(header, "Bearer "), "access")
+		if err != nil {
+			WriteError(w, http.StatusUnauthorized, "Invalid or expired access token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), claimsContextKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Wrap a single handler with Authenticate
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return Authenticate(next).ServeHTTP
+}
+
+// Wrap a handler that may only be called by other services; must run after Authenticate
+func RequireService(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !IsServiceRequest(r) {
+			WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Wrap a handler that may only be called by administrators; must run after Authenticate
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := RequestClaims(r)
+		if claims == nil || claims.Role != "admin" {
+			WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Claims of the authenticated caller, nil if the request was not authenticated
+func RequestClaims(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsContextKey{}).(*Claims)
+	return claims
+}
+
+// Check whether the caller is another service rather than a user
+func IsServiceRequest(r *http.Request) bool {
+	claims := RequestClaims(r)
+	return claims != nil && claims.Role == "service"
+}
+
+// Resolve the user the request acts for: the token's user, or the {id} in the path for service calls
+func UserID(r *http.Request) string {
+	claims := RequestClaims(r)
+	if claims == nil {
+		return ""
+	}
+	if claims.Role == "service" {
+		return mux.Vars(r)["id"]
+	}
+	return strconv.Itoa(claims.UserID)
+}
+
+// Check whether the caller may access a resource owned by ownerID
+func OwnsResource(r *http.Request, ownerID int) bool {
+	claims := RequestClaims(r)
+	return claims != nil && (claims.Role == "service" || claims.UserID == ownerID)
+}
+
+// Build a request to another service, authenticated with a short-lived service token
+func NewServiceRequest(method string, url string, contentType string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	token, err := SignToken(Claims{Role: "service", TokenType: "access"}, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// Send an authenticated request to another service
+func ServiceRequest(method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := NewServiceRequest(method, url, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Authenticated equivalent of http.Get for service-to-service calls
+func ServiceGet(url string) (*http.Response, error) {
+	return ServiceRequest(http.MethodGet, url, "", nil)
+}
+
+// Authenticated equivalent of http.Post for service-to-service calls
+func ServicePost(url string, contentType string, body io.Reader) (*http.Response, error) {
+	return ServiceRequest(http.MethodPost, url, contentType, body)
+}
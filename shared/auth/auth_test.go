@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withSecret(t *testing.T, value string) {
+	t.Helper()
+	previous := secret
+	secret = []byte(value)
+	t.Cleanup(func() { secret = previous })
+}
+
+func TestSignAndParseToken(t *testing.T) {
+	withSecret(t, "0123456789abcdef0123456789abcdef")
+
+	token, err := SignToken(Claims{UserID: 7, Role: "user", TokenType: "access"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseToken(token, "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.Role != "user" {
+		t.Errorf("got user %d role %q, want user 7 role %q", claims.UserID, claims.Role, "user")
+	}
+	if _, err := ParseToken(token, "refresh"); err == nil {
+		t.Error("access token accepted as a refresh token")
+	}
+
+	expired, err := SignToken(Claims{UserID: 7, TokenType: "access"}, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseToken(expired, "access"); err == nil {
+		t.Error("expired token accepted")
+	}
+
+	withSecret(t, "another-secret-of-at-least-32-bytes")
+	if _, err := ParseToken(token, "access"); err == nil {
+		t.Error("token signed with another secret accepted")
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	withSecret(t, "")
+
+	if _, err := SignToken(Claims{TokenType: "access"}, time.Minute); err != errNoSecret {
+		t.Errorf("SignToken error = %v, want %v", err, errNoSecret)
+	}
+	if _, err := ParseToken("anything", "access"); err != errNoSecret {
+		t.Errorf("ParseToken error = %v, want %v", err, errNoSecret)
+	}
+}
+
+func TestKeyedHash(t *testing.T) {
+	withSecret(t, "0123456789abcdef0123456789abcdef")
+
+	hash, err := KeyedHash("verification", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := KeyedHash("verification", "123456"); again != hash {
+		t.Error("the same value hashed differently")
+	}
+	if other, _ := KeyedHash("verification", "123457"); other == hash {
+		t.Error("different values hashed the same")
+	}
+	if other, _ := KeyedHash("password_reset", "123456"); other == hash {
+		t.Error("the same value hashed the same for different purposes")
+	}
+	unkeyed := sha256.Sum256([]byte("123456"))
+	if hash == hex.EncodeToString(unkeyed[:]) {
+		t.Error("hash does not depend on the secret")
+	}
+
+	withSecret(t, "another-secret-of-at-least-32-bytes")
+	if other, _ := KeyedHash("verification", "123456"); other == hash {
+		t.Error("the same value hashed the same with another secret")
+	}
+
+	withSecret(t, "")
+	if _, err := KeyedHash("verification", "123456"); err != errNoSecret {
+		t.Errorf("KeyedHash error = %v, want %v", err, errNoSecret)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	withSecret(t, "0123456789abcdef0123456789abcdef")
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	tests := []struct {
+		name    string
+		role    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"admin route as admin", "admin", RequireAdmin(ok), http.StatusOK},
+		{"admin route as user", "user", RequireAdmin(ok), http.StatusForbidden},
+		{"admin route as service", "service", RequireAdmin(ok), http.StatusForbidden},
+		{"service route as service", "service", RequireService(ok), http.StatusOK},
+		{"service route as admin", "admin", RequireService(ok), http.StatusForbidden},
+		{"without a token", "", RequireAdmin(ok), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.role != "" {
+				token, err := SignToken(Claims{UserID: 1, Role: tt.role, TokenType: "access"}, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			Authenticate(tt.handler).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
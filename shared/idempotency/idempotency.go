@@ -0,0 +1,188 @@
+// Package idempotency lets clients retry POST, PUT and DELETE requests safely by sending
+// an Idempotency-Key header, storing each first response in the idempotency_keys table.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/auth"
+)
+
+// Longest Idempotency-Key accepted, matching the column
+const maxKeyLength = 255
+
+// Records what a handler writes while passing it on to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Keys stored in a service's idempotency_keys table
+type store struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// Middleware that makes POST, PUT and DELETE requests carrying an Idempotency-Key header safe to retry.
+// The first request with a key runs and its response is stored; repeats of it get the stored response
+// back without running again, while a different request with the same key is rejected with 409.
+// Server errors and panics are not stored, so the request can be retried. Keys are remembered for ttl.
+// Must run after auth.Authenticate.
+func Middleware(db *sql.DB, ttl time.Duration) func(http.Handler) http.Handler {
+	keys := &store{db: db, ttl: ttl}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys.serve(next, w, r)
+		})
+	}
+}
+
+func (keys *store) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if len(key) > maxKeyLength {
+		auth.WriteError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+		return
+	}
+
+	// Fingerprint the request so a reused key can be told apart from a retry
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		auth.WriteError(w, http.StatusBadRequest, "Error reading request body")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+	hash.Write(body)
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	// Keys are per caller, so users cannot see each other's responses
+	scope := "service"
+	if !auth.IsServiceRequest(r) {
+		scope = strconv.Itoa(auth.RequestClaims(r).UserID)
+	}
+
+	// Claim the key; only one request gets to insert it
+	claimed, err := keys.claim(scope, key, requestHash)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		keys.replay(w, scope, key, requestHash)
+		return
+	}
+
+	// Release the key if the handler panics, or it would stay "in progress" until it expires
+	defer func() {
+		if p := recover(); p != nil {
+			keys.release(scope, key)
+			panic(p)
+		}
+	}()
+
+	rec := &responseRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	if rec.status >= http.StatusInternalServerError {
+		keys.release(scope, key)
+		return
+	}
+	query := "UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ? WHERE scope = ? AND idempotency_key = ?"
+	_, err = keys.db.Exec(query, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), scope, key)
+	if err != nil {
+		log.Println("Error storing idempotent response:", err)
+	}
+}
+
+// Record a new request for the key, clearing it first if it has expired.
+// Returns false if the key is already held by an earlier request.
+func (keys *store) claim(scope string, key string, requestHash string) (bool, error) {
+	expiredBefore := time.Now().Add(-keys.ttl)
+	_, err := keys.db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND created_at < ?", scope, key, expiredBefore)
+	if err != nil {
+		return false, err
+	}
+	result, err := keys.db.Exec("INSERT IGNORE INTO idempotency_keys (scope, idempotency_key, request_hash, created_at) VALUES (?, ?, ?, ?)", scope, key, requestHash, time.Now())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+// Forget a key whose request failed, so it can be retried
+func (keys *store) release(scope string, key string) {
+	_, err := keys.db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?", scope, key)
+	if err != nil {
+		log.Println("Error releasing idempotency key:", err)
+	}
+}
+
+// Answer a repeated key with the stored response, or a conflict if it cannot be replayed
+func (keys *store) replay(w http.ResponseWriter, scope string, key string, requestHash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	query := "SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?"
+	err := keys.db.QueryRow(query, scope, key).Scan(&storedHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// The first request failed and released the key in the meantime
+		auth.WriteError(w, http.StatusConflict, "A request with this Idempotency-Key failed, retry it")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case storedHash != requestHash:
+		auth.WriteError(w, http.StatusConflict, "Idempotency-Key was already used for a different request")
+	case !status.Valid:
+		auth.WriteError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+	default:
+		if contentType.String != "" {
+			w.Header().Set("Content-Type", contentType.String)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(int(status.Int64))
+		w.Write(body)
+	}
+}
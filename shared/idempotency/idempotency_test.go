@@ -0,0 +1,141 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"shared/auth"
+)
+
+const (
+	expireQuery  = `DELETE FROM idempotency_keys WHERE scope = \? AND idempotency_key = \? AND created_at < \?`
+	claimQuery   = `INSERT IGNORE INTO idempotency_keys`
+	releaseQuery = `DELETE FROM idempotency_keys WHERE scope = \? AND idempotency_key = \?$`
+	storeQuery   = `UPDATE idempotency_keys SET status_code = \?`
+	replayQuery  = `SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys`
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET", "idempotency-test-secret-of-32-bytes")
+	auth.LoadSecret()
+	os.Exit(m.Run())
+}
+
+// Run a POST with the key through the middleware, as user 42
+func serve(t *testing.T, mock func(sqlmock.Sqlmock), handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock(sqlMock)
+	// Checked on the way out, so a panicking handler is covered too
+	defer func() {
+		if err := sqlMock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	token, err := auth.SignToken(auth.Claims{UserID: 42, Role: "user", TokenType: "access"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/make-payment", strings.NewReader(`{"amount": 10}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Idempotency-Key", "key-1")
+	w := httptest.NewRecorder()
+	auth.Authenticate(Middleware(db, time.Hour)(handler)).ServeHTTP(w, r)
+	return w
+}
+
+func claimed(m sqlmock.Sqlmock) {
+	m.ExpectExec(expireQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	m.ExpectExec(claimQuery).WithArgs("42", "key-1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestStoresResponse(t *testing.T) {
+	w := serve(t, func(m sqlmock.Sqlmock) {
+		claimed(m)
+		m.ExpectExec(storeQuery).WithArgs(http.StatusCreated, "application/json", []byte(`{"id":1}`), "42", "key-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	})
+	if w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestReleasesKeyOnServerError(t *testing.T) {
+	w := serve(t, func(m sqlmock.Sqlmock) {
+		claimed(m)
+		m.ExpectExec(releaseQuery).WithArgs("42", "key-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestReleasesKeyOnPanic(t *testing.T) {
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recovered %v, want the handler's panic to be passed on", p)
+		}
+	}()
+	serve(t, func(m sqlmock.Sqlmock) {
+		claimed(m)
+		m.ExpectExec(releaseQuery).WithArgs("42", "key-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+}
+
+func TestReplay(t *testing.T) {
+	ran := false
+	handler := func(w http.ResponseWriter, r *http.Request) { ran = true }
+	held := func(hash string, status interface{}) func(sqlmock.Sqlmock) {
+		return func(m sqlmock.Sqlmock) {
+			m.ExpectExec(expireQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectExec(claimQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+			rows := sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body"}).
+				AddRow(hash, status, "application/json", []byte(`{"id":1}`))
+			m.ExpectQuery(replayQuery).WithArgs("42", "key-1").WillReturnRows(rows)
+		}
+	}
+	w := serve(t, held(requestHash(), http.StatusCreated), handler)
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":1}` || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay = %d %q, want the stored response", w.Code, w.Body.String())
+	}
+
+	w = serve(t, held(requestHash(), nil), handler)
+	if w.Code != http.StatusConflict {
+		t.Errorf("in progress: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	w = serve(t, held(strings.Repeat("0", 64), http.StatusCreated), handler)
+	if w.Code != http.StatusConflict {
+		t.Errorf("different request: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if ran {
+		t.Error("handler ran for a key that was already claimed")
+	}
+}
+
+// Hash the middleware stores for the request sent by serve
+func requestHash() string {
+	sum := sha256.Sum256([]byte("POST /api/v1/make-payment\n" + `{"amount": 10}`))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,161 @@
+// Package money represents amounts of money exactly, as whole numbers of cents.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// An amount of money as a whole number of cents, so sums and differences are exact.
+// It is stored in DECIMAL(10, 2) columns and sent as a JSON number such as 12.5.
+//
+// Rounding happens only when an amount is scaled (by a duration, a percentage or an
+// amount with more than two decimals) and is always to the nearest cent, halves away
+// from zero. Totals are sums of already rounded parts, so they match the itemised parts.
+type Money int64
+
+// Largest and smallest amount a DECIMAL(10, 2) column holds
+const (
+	Max Money = 99999999_99
+	Min Money = -Max
+)
+
+// Returned for text that is not an amount, or an amount out of range
+var ErrInvalid = errors.New("invalid amount of money")
+
+// Parse a decimal amount such as "12.5" or "-0.125", rounding to the nearest cent
+func Parse(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" && fraction == "" || strings.ContainsAny(whole+fraction, "+-eE ") {
+		return 0, ErrInvalid
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > int64(Max/100) {
+		return 0, ErrInvalid
+	}
+	// Keep two decimals and round on the third
+	fraction += "000"
+	cents, err := strconv.ParseInt(fraction[:2], 10, 64)
+	if err != nil {
+		return 0, ErrInvalid
+	}
+	for _, digit := range fraction[2:] {
+		if digit < '0' || digit > '9' {
+			return 0, ErrInvalid
+		}
+	}
+	amount := Money(units*100 + cents)
+	if fraction[2] >= '5' {
+		amount++
+	}
+	// Check the size before applying the sign, so both bounds are enforced
+	if amount > Max {
+		return 0, ErrInvalid
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// Convert a floating point amount, rounding to the nearest cent. Only for values that
+// are not amounts of money to begin with; amounts should be parsed with Parse.
+func FromFloat(amount float64) Money {
+	return Money(math.Round(amount * 100))
+}
+
+// Scale the amount by numerator/denominator, rounding to the nearest cent.
+// The intermediate product may exceed int64; the result is expected to fit.
+func (m Money) MulDiv(numerator, denominator int64) Money {
+	product := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(numerator))
+	d := big.NewInt(denominator)
+	quotient, remainder := new(big.Int).QuoRem(product, d, new(big.Int))
+	// Round half away from zero
+	twiceRemainder := new(big.Int).Lsh(new(big.Int).Abs(remainder), 1)
+	if twiceRemainder.Cmp(new(big.Int).Abs(d)) >= 0 {
+		if (product.Sign() < 0) != (denominator < 0) {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return Money(quotient.Int64())
+}
+
+// The given percentage of the amount, e.g. a discount, rounded to the nearest cent.
+// The percentage is taken to two decimals, as stored.
+func (m Money) Percent(percentage float64) Money {
+	return m.MulDiv(int64(math.Round(percentage*100)), 100_00)
+}
+
+// The amount as a float, for display and for values that are not amounts themselves such as unit prices
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// The amount as a decimal with two places, e.g. "12.50"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Accept a JSON number, or a string holding one
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	amount, err := Parse(strings.Trim(string(data), `"`))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, data)
+	}
+	*m = amount
+	return nil
+}
+
+// Read a DECIMAL column without going through floating point
+func (m *Money) Scan(src interface{}) error {
+	var amount Money
+	var err error
+	switch value := src.(type) {
+	case []byte:
+		amount, err = Parse(string(value))
+	case string:
+		amount, err = Parse(value)
+	case int64:
+		amount = Money(value * 100)
+	case float64:
+		amount = FromFloat(value)
+	default:
+		err = fmt.Errorf("cannot scan %T into Money", src)
+	}
+	if err != nil {
+		return err
+	}
+	*m = amount
+	return nil
+}
+
+// Write the amount as an exact decimal string
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
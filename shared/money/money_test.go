@@ -0,0 +1,211 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{"12.5", 12_50, false},
+		{"12.50", 12_50, false},
+		{"+3", 3_00, false},
+		{".5", 50, false},
+		{"7.", 7_00, false},
+		{" 1.23 ", 1_23, false},
+		{"0", 0, false},
+
+		// More than two decimals round on the third, halves away from zero
+		{"1.004", 1_00, false},
+		{"1.005", 1_01, false},
+		{"1.0049999", 1_00, false},
+		{"0.995", 1_00, false},
+		{"-0.125", -13, false},
+		{"-0.005", -1, false},
+		{"-0.0049", 0, false},
+		{"2.999", 3_00, false},
+
+		// Bounds of DECIMAL(10, 2), checked for both signs
+		{"99999999.99", Max, false},
+		{"-99999999.99", Min, false},
+		{"99999999.994", Max, false},
+		{"99999999.995", 0, true},
+		{"-99999999.995", 0, true},
+		{"100000000", 0, true},
+		{"-100000000", 0, true},
+		{"9223372036854775807", 0, true},
+
+		{"", 0, true},
+		{"-", 0, true},
+		{".", 0, true},
+		{"abc", 0, true},
+		{"1.2.3", 0, true},
+		{"1e3", 0, true},
+		{"--1", 0, true},
+		{"1.-5", 0, true},
+		{"1.5x", 0, true},
+		{"1 000", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("Parse(%q) = %v, %v; want ErrInvalid", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	tests := []struct {
+		name        string
+		m           Money
+		numerator   int64
+		denominator int64
+		want        Money
+	}{
+		{"exact", 50_00, 12 * 3600, 3600, 600_00},
+		{"half a cent rounds up", 1, 1, 2, 1},
+		{"just under half a cent rounds down", 1_00, 4999, 1_000_000, 0},
+		{"half a cent rounds away from zero", 25, 1, 10, 3},
+		{"negative half a cent rounds away from zero", -25, 1, 10, -3},
+		{"negative numerator", 25, -1, 10, -3},
+		{"negative denominator", 25, 1, -10, -3},
+		{"both negative", -25, 1, -10, 3},
+		{"negative below half", -24, 1, 10, -2},
+		{"a third", 10_00, 1, 3, 3_33},
+		{"two thirds", 10_00, 2, 3, 6_67},
+		{"zero", 0, 7, 3, 0},
+		{"the largest amount over a year in seconds", Max, 365 * 24 * 3600, 365 * 24 * 3600, Max},
+		{"product beyond int64", Max, math.MaxInt64 / 1000, math.MaxInt64 / 1000, Max},
+		{"smallest amount beyond int64", Min, math.MaxInt64, math.MaxInt64, Min},
+		{"large product halved", Max, 1 << 40, 1 << 41, 50000000_00},
+	}
+	for _, tt := range tests {
+		if got := tt.m.MulDiv(tt.numerator, tt.denominator); got != tt.want {
+			t.Errorf("%s: %v.MulDiv(%d, %d) = %v, want %v", tt.name, tt.m, tt.numerator, tt.denominator, got, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		m          Money
+		percentage float64
+		want       Money
+	}{
+		{100_00, 10, 10_00},
+		{19_99, 15, 3_00},
+		{10, 5, 1},
+		{10, 4.9, 0},
+		{-10, 5, -1},
+		{33_33, 33.33, 11_11},
+		{12_34, 12.345, 1_52},
+		{12_34, 0, 0},
+		{12_34, 100, 12_34},
+		{Max, 100, Max},
+		{Min, 50, -50000000_00},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Percent(tt.percentage); got != tt.want {
+			t.Errorf("%v.Percent(%v) = %v, want %v", tt.m, tt.percentage, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{12_50, "12.50"},
+		{-1, "-0.01"},
+		{-12_34, "-12.34"},
+		{Max, "99999999.99"},
+		{Min, "-99999999.99"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.m), got, tt.want)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, m := range []Money{0, 1, -1, 12_50, -12_34, Max, Min} {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Money
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if got != m {
+			t.Errorf("round trip of %v through %s gave %v", m, data, got)
+		}
+	}
+
+	var body struct {
+		Amount Money `json:"amount"`
+		Unset  Money `json:"unset"`
+	}
+	body.Unset = 5
+	if err := json.Unmarshal([]byte(`{"amount": "1.005", "unset": null}`), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Amount != 1_01 || body.Unset != 5 {
+		t.Errorf("got amount %v unset %v, want 1.01 and 0.05", body.Amount, body.Unset)
+	}
+	if err := json.Unmarshal([]byte(`{"amount": true}`), &body); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Unmarshal of true: %v, want ErrInvalid", err)
+	}
+}
+
+func TestSQLRoundTrip(t *testing.T) {
+	for _, m := range []Money{0, 1, -1, 12_50, -12_34, Max, Min} {
+		value, err := m.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The MySQL driver returns DECIMAL columns as bytes
+		var got Money
+		if err := got.Scan([]byte(value.(string))); err != nil {
+			t.Fatalf("Scan(%q): %v", value, err)
+		}
+		if got != m {
+			t.Errorf("round trip of %v through %q gave %v", m, value, got)
+		}
+	}
+
+	tests := []struct {
+		src  interface{}
+		want Money
+	}{
+		{"7.25", 7_25},
+		{int64(3), 3_00},
+		{float64(0.1) + float64(0.2), 30},
+	}
+	for _, tt := range tests {
+		var got Money
+		if err := got.Scan(tt.src); err != nil || got != tt.want {
+			t.Errorf("Scan(%#v) = %v, %v; want %v", tt.src, got, err, tt.want)
+		}
+	}
+	var got Money
+	if err := got.Scan(nil); err == nil {
+		t.Error("Scan(nil) succeeded")
+	}
+}
@@ -3,10 +3,15 @@ module user_svc
 go 1.23.2
 
 require (
-	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/go-sql-driver/mysql v1.8.1 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/rs/cors v1.11.1 // indirect
-	golang.org/x/crypto v0.30.0 // indirect
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/gorilla/mux v1.8.1
+	github.com/rs/cors v1.11.1
+	golang.org/x/crypto v0.30.0
+	shared v0.0.0-00010101000000-000000000000
 )
+
+require filippo.io/edwards25519 v1.1.0 // indirect
+
+replace shared => ../shared
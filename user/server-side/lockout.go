@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Login throttling, configurable through the environment
+var (
+	// Failed logins allowed for an account, and for a client IP, before they are locked out
+	loginMaxAccountFailures = getEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 5)
+	loginMaxIPFailures      = getEnvInt("LOGIN_MAX_IP_FAILURES", 20)
+	// The first lockout lasts loginLockoutBase and doubles with each further failure, up to loginLockoutMax
+	loginLockoutBase = getEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute)
+	loginLockoutMax  = getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour)
+	// Failures are forgotten once none happened for this long
+	loginFailureWindow = getEnvDuration("LOGIN_FAILURE_WINDOW", time.Hour)
+)
+
+// Same message for every failed login, so it does not reveal which accounts exist
+const invalidLoginMessage = "Invalid email or password"
+
+// Compared against when the email is unknown, so a failed login takes as long whether or not the account exists
+const dummyPasswordHash = "$2a$08$Db31aD7TpeRW.q.wwA8vFuKazaRr/KwpYfBxoN7/k9EmYK8QeJGNK"
+
+// Keys under which failed logins are counted
+func accountAttemptKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// How much longer the account or client IP stays locked out, zero if neither is
+func loginLockout(accountKey, ipKey string) (time.Duration, error) {
+	query := "SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, NOW(), locked_until)), 0) FROM login_attempts WHERE attempt_key IN (?, ?) AND locked_until > NOW()"
+	var seconds int64
+	if err := db.QueryRow(query, accountKey, ipKey).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Count a failed login against the key, locking it out once it reaches maxFailures.
+// Each failure past the limit doubles the lockout, so guessing slows down progressively.
+func recordLoginFailure(key string, maxFailures int) error {
+	query := `
+		INSERT INTO login_attempts (attempt_key, failures, last_failure) VALUES (?, 1, NOW())
+		ON DUPLICATE KEY UPDATE
+			failures = IF(last_failure < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+			last_failure = NOW()`
+	if _, err := db.Exec(query, key, int64(loginFailureWindow.Seconds())); err != nil {
+		return err
+	}
+
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_attempts WHERE attempt_key = ?", key).Scan(&failures); err != nil {
+		return err
+	}
+	lockout := lockoutDuration(failures, maxFailures)
+	if lockout == 0 {
+		return nil
+	}
+	_, err := db.Exec("UPDATE login_attempts SET locked_until = NOW() + INTERVAL ? SECOND WHERE attempt_key = ?", int64(lockout.Seconds()), key)
+	return err
+}
+
+// How long a key with this many failures is locked out: zero below maxFailures, then
+// loginLockoutBase doubling with each further failure, up to loginLockoutMax
+func lockoutDuration(failures, maxFailures int) time.Duration {
+	if failures < maxFailures {
+		return 0
+	}
+	lockout := time.Duration(float64(loginLockoutBase) * math.Pow(2, float64(failures-maxFailures)))
+	if lockout > loginLockoutMax || lockout <= 0 {
+		lockout = loginLockoutMax
+	}
+	return lockout
+}
+
+// Forget the failed logins counted against the key
+func clearLoginFailures(key string) error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key)
+	return err
+}
+
+// Lift the lockout of an account, and optionally of a client IP (admins only)
+func unlockAccount(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	var unlockRequest struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&unlockRequest); err != nil || unlockRequest.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Email is required"})
+		return
+	}
+
+	var userId int
+	err := db.QueryRow("SELECT user_id FROM users WHERE email = ?", unlockRequest.Email).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{"User not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := clearLoginFailures(accountAttemptKey(unlockRequest.Email)); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if unlockRequest.IP != "" {
+		if err := clearLoginFailures("ip:" + unlockRequest.IP); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Account unlocked"})
+}
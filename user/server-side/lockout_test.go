@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	previousBase, previousMax := loginLockoutBase, loginLockoutMax
+	loginLockoutBase, loginLockoutMax = time.Minute, time.Hour
+	t.Cleanup(func() { loginLockoutBase, loginLockoutMax = previousBase, previousMax })
+
+	tests := []struct {
+		name        string
+		failures    int
+		maxFailures int
+		want        time.Duration
+	}{
+		{"below the limit", 4, 5, 0},
+		{"first lockout", 5, 5, time.Minute},
+		{"doubles with the next failure", 6, 5, 2 * time.Minute},
+		{"keeps doubling", 10, 5, 32 * time.Minute},
+		{"capped", 11, 5, time.Hour},
+		{"capped long after", 5 + 100, 5, time.Hour},
+		{"per-IP limit", 21, 20, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lockoutDuration(tt.failures, tt.maxFailures); got != tt.want {
+				t.Errorf("lockoutDuration(%d, %d) = %v, want %v", tt.failures, tt.maxFailures, got, tt.want)
+			}
+		})
+	}
+}
+
+// Client IP of requests made by callHandler
+const testIPKey = "ip:192.0.2.1"
+
+func expectLockout(mock sqlmock.Sqlmock, seconds int64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, NOW(), locked_until)), 0) FROM login_attempts")).
+		WithArgs(accountAttemptKey("alice@example.com"), testIPKey).
+		WillReturnRows(sqlmock.NewRows([]string{"seconds"}).AddRow(seconds))
+}
+
+// A locked account is refused even with the right password, which is not checked
+func TestLoginUserLockedOut(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	expectLockout(mock, 90)
+
+	payload := map[string]string{"email": "alice@example.com", "password": "password"}
+	status, response := callHandler(t, loginUser, payload)
+	if status != http.StatusTooManyRequests {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusTooManyRequests)
+	}
+	if response["access_token"] != nil {
+		t.Error("a locked out login was issued tokens")
+	}
+}
+
+// An admin unlock clears the account and IP failures, after which the right password logs in
+func TestUnlockAccount(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	hashedPassword, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM users WHERE email = ?")).
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_attempts WHERE attempt_key = ?")).
+		WithArgs(accountAttemptKey("alice@example.com")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_attempts WHERE attempt_key = ?")).
+		WithArgs(testIPKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, response := callHandler(t, unlockAccount, map[string]string{"email": "alice@example.com", "ip": "192.0.2.1"})
+	if status != http.StatusOK {
+		t.Fatalf("unlock: status = %d (%v), want %d", status, response["message"], http.StatusOK)
+	}
+
+	expectLockout(mock, 0)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, email, password, verified FROM users WHERE email = ?")).
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "password", "verified"}).AddRow(3, "alice@example.com", hashedPassword, true))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_attempts WHERE attempt_key = ?")).
+		WithArgs(accountAttemptKey("alice@example.com")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT role FROM users WHERE user_id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).
+		WithArgs(sqlmock.AnyArg(), 3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, response = callHandler(t, loginUser, map[string]string{"email": "alice@example.com", "password": "password"})
+	if status != http.StatusOK || response["access_token"] == nil {
+		t.Errorf("login after unlock: status = %d (%v), want %d with tokens", status, response["message"], http.StatusOK)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"shared/money"
+)
+
+// Channels a notification can be delivered on
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+)
+
+// Message delivered to a user; SMS messages have no subject
+type Notification struct {
+	Channel string    `json:"channel"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject,omitempty"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Delivers notifications, e.g. over SMTP or to a local stand-in during development
+type Transport interface {
+	Send(notification Notification) error
+}
+
+// Returned by a transport that cannot deliver on the notification's channel
+var errUnsupportedChannel = errors.New("channel not supported by transport")
+
+// Returned by notifyUser for a template that does not exist
+var errUnknownTemplate = errors.New("unknown notification template")
+
+// Sends email through an SMTP server, configured with SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM
+type smtpTransport struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPTransport() *smtpTransport {
+	host := os.Getenv("SMTP_HOST")
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	transport := &smtpTransport{addr: host + ":" + port, from: os.Getenv("SMTP_FROM")}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		transport.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return transport
+}
+
+func (t *smtpTransport) Send(notification Notification) error {
+	if notification.Channel != channelEmail {
+		return errUnsupportedChannel
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", t.from)
+	fmt.Fprintf(&message, "To: %s\r\n", notification.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", notification.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", notification.SentAt.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(notification.Body, "\n", "\r\n"))
+	return smtp.SendMail(t.addr, t.auth, t.from, []string{notification.To}, message.Bytes())
+}
+
+// Appends every notification as a JSON line to a file, standing in for a real transport
+type fileTransport struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (t *fileTransport) Send(notification Notification) error {
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	file, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Keeps sent notifications in memory, standing in for a real transport
+type memoryTransport struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (t *memoryTransport) Send(notification Notification) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, notification)
+	return nil
+}
+
+// Notifications sent so far, oldest first
+func (t *memoryTransport) Sent() []Notification {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Notification(nil), t.sent...)
+}
+
+// Create the transport named by the environment variable: "smtp", "file", "memory" or "none".
+// An unknown name stops the service rather than silently sending nothing.
+func newTransport(key string, defaultValue string) Transport {
+	name := os.Getenv(key)
+	if name == "" {
+		name = defaultValue
+	}
+	switch name {
+	case "smtp":
+		return newSMTPTransport()
+	case "file":
+		path := os.Getenv("NOTIFY_FILE")
+		if path == "" {
+			path = "notifications.log"
+		}
+		return &fileTransport{path: path}
+	case "memory":
+		return &memoryTransport{}
+	case "none":
+		return nil
+	default:
+		log.Fatalf("Unknown %s %q, must be \"smtp\", \"file\", \"memory\" or \"none\"", key, name)
+		return nil
+	}
+}
+
+// Transports for each channel, configurable through the environment. Email defaults to the
+// file stand-in so codes are not lost in development; SMS is off unless a transport is set.
+var (
+	emailTransport = newTransport("EMAIL_TRANSPORT", "file")
+	smsTransport   = newTransport("SMS_TRANSPORT", "none")
+)
+
+// Templates of a kind of notification; SMS is optional and kept short
+type notificationTemplate struct {
+	subject *template.Template
+	email   *template.Template
+	sms     *template.Template
+}
+
+// Functions available to the templates
+var templateFuncs = template.FuncMap{"money": formatAmount}
+
+// Format an amount to two decimals, whether it arrived as a JSON number or as a decimal string such as "5.00"
+func formatAmount(amount interface{}) (string, error) {
+	switch amount := amount.(type) {
+	case string:
+		parsed, err := money.Parse(amount)
+		if err != nil {
+			return "", err
+		}
+		return parsed.String(), nil
+	case float64:
+		return money.FromFloat(amount).String(), nil
+	case money.Money:
+		return amount.String(), nil
+	default:
+		return "", fmt.Errorf("invalid amount %v", amount)
+	}
+}
+
+func newNotificationTemplate(name, subject, email, sms string) notificationTemplate {
+	tmpl := notificationTemplate{
+		subject: template.Must(template.New(name + "_subject").Funcs(templateFuncs).Parse(subject)),
+		email:   template.Must(template.New(name + "_email").Funcs(templateFuncs).Parse(email)),
+	}
+	if sms != "" {
+		tmpl.sms = template.Must(template.New(name + "_sms").Funcs(templateFuncs).Parse(sms))
+	}
+	return tmpl
+}
+
+// Notifications the services can send, keyed by name. Templates are given the user's Name plus the caller's data.
+var notificationTemplates = map[string]notificationTemplate{
+	"verification": newNotificationTemplate("verification",
+		"Your verification code",
+		"Hi {{.Name}},\n\nYour verification code is {{.Code}}. Enter it in the app to verify your email address.\n\nIf you did not request this, you can ignore this email.\n",
+		"Your verification code is {{.Code}}."),
+	"booking_confirmed": newNotificationTemplate("booking_confirmed",
+		"Booking #{{.BookingID}} confirmed",
+		"Hi {{.Name}},\n\nYour booking #{{.BookingID}} is confirmed.\n{{if .Date}}\nDate: {{.Date}}\nTime: {{.StartTime}} to {{.EndTime}}\n{{end}}\nHave a safe trip!\n",
+		"Booking #{{.BookingID}} confirmed{{if .Date}} for {{.Date}} {{.StartTime}}-{{.EndTime}}{{end}}."),
+	"booking_vehicle_changed": newNotificationTemplate("booking_vehicle_changed",
+		"Booking #{{.BookingID}} moved to another vehicle",
+		"Hi {{.Name}},\n\nThe vehicle of your booking #{{.BookingID}} on {{.Date}} from {{.StartTime}} to {{.EndTime}} has been retired, so we moved your booking to a similar vehicle at the same time and price.\n\nYou can see the new vehicle in the app.\n",
+		"Booking #{{.BookingID}} on {{.Date}} was moved to a similar vehicle at the same time and price."),
+	"booking_cancelled": newNotificationTemplate("booking_cancelled",
+		"Booking #{{.BookingID}} cancelled",
+		"Hi {{.Name}},\n\nYour booking #{{.BookingID}} has been cancelled. Any refund due is returned the way you paid, to your card and your wallet.\n",
+		"Booking #{{.BookingID}} cancelled."),
+	"password_reset": newNotificationTemplate("password_reset",
+		"Reset your password",
+		"Hi {{.Name}},\n\nUse this token to reset your password within {{.ExpiresIn}}:\n\n{{.Token}}\n\nIf you did not ask to reset your password, you can ignore this email; your password has not changed.\n",
+		""),
+	"password_changed": newNotificationTemplate("password_changed",
+		"Your password was changed",
+		"Hi {{.Name}},\n\nThe password of your account was just changed and your other sessions were signed out.\n\nIf this was not you, reset your password straight away.\n",
+		"Your password was changed. If this was not you, reset it straight away."),
+	"invoice": newNotificationTemplate("invoice",
+		"Invoice #{{.InvoiceID}}",
+		"Hi {{.Name}},\n\nInvoice #{{.InvoiceID}} for booking #{{.BookingID}} has been issued.\n\nTotal: ${{money .TotalAmount}}\nStatus: {{.Status}}\n\nYou can view and download it in the app.\n",
+		""),
+	"receipt": newNotificationTemplate("receipt",
+		"Receipt for invoice #{{.InvoiceID}}",
+		"Hi {{.Name}},\n\nWe received your payment of ${{money .Amount}} for invoice #{{.InvoiceID}}. Thank you!\n\nYou can view and download the receipt in the app.\n",
+		""),
+	"membership_downgraded": newNotificationTemplate("membership_downgraded",
+		"Your {{.MembershipID}} membership has ended",
+		"Hi {{.Name}},\n\nWe could not renew your {{.MembershipID}} membership, so your account is now on the {{.DefaultMembershipID}} membership.\n\nYou can subscribe again at any time in the app.\n",
+		"Your {{.MembershipID}} membership could not be renewed, you are now on {{.DefaultMembershipID}}."),
+}
+
+// Templates other services may not send, as they carry secrets or account security notices
+var internalTemplates = map[string]bool{"verification": true, "password_reset": true, "password_changed": true}
+
+// Render a template and send it to the user by email, and by SMS if enabled and the template has an SMS version
+func notifyUser(userId int, templateName string, data map[string]interface{}) error {
+	tmpl, ok := notificationTemplates[templateName]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownTemplate, templateName)
+	}
+
+	// Look up where to send it
+	var name, email, phone string
+	query := "SELECT name, email, phone FROM users WHERE user_id = ?"
+	if err := db.QueryRow(query, userId).Scan(&name, &email, &phone); err != nil {
+		return err
+	}
+	values := map[string]interface{}{"Name": name}
+	for key, value := range data {
+		values[key] = value
+	}
+	render := func(t *template.Template) (string, error) {
+		var out bytes.Buffer
+		if err := t.Execute(&out, values); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+
+	now := time.Now()
+	if emailTransport != nil {
+		subject, err := render(tmpl.subject)
+		if err != nil {
+			return err
+		}
+		body, err := render(tmpl.email)
+		if err != nil {
+			return err
+		}
+		if err := emailTransport.Send(Notification{Channel: channelEmail, To: email, Subject: subject, Body: body, SentAt: now}); err != nil {
+			return fmt.Errorf("failed to send email: %w", err)
+		}
+	}
+	if smsTransport != nil && tmpl.sms != nil {
+		body, err := render(tmpl.sms)
+		if err != nil {
+			return err
+		}
+		if err := smsTransport.Send(Notification{Channel: channelSMS, To: phone, Body: body, SentAt: now}); err != nil {
+			return fmt.Errorf("failed to send SMS: %w", err)
+		}
+	}
+	return nil
+}
+
+// Send a notification to a user on behalf of another service
+func sendNotification(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Struct for the request body
+	var request struct {
+		Template string                 `json:"template"`
+		Data     map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid notification data"})
+		return
+	}
+	// Account security notices are only ever sent by this service
+	if _, ok := notificationTemplates[request.Template]; !ok || internalTemplates[request.Template] {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Unknown notification template"})
+		return
+	}
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid user ID"})
+		return
+	}
+
+	err = notifyUser(userId, request.Template, request.Data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{"User not found"})
+			return
+		}
+		log.Println("Failed to send notification:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{"Failed to send notification"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Notification sent"})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Templates render the data other services send, decoded from JSON as sendNotification does
+func TestNotificationTemplates(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		data        string
+		wantSubject string
+		wantEmail   string
+		wantSMS     string
+	}{
+		{"invoice", "invoice", `{"InvoiceID": 7, "BookingID": 3, "TotalAmount": 114.75, "Status": "Paid"}`,
+			"Invoice #7", "Total: $114.75\nStatus: Paid", ""},
+		{"invoice with a whole amount", "invoice", `{"InvoiceID": 7, "BookingID": 3, "TotalAmount": 50.00, "Status": "Pending"}`,
+			"Invoice #7", "Total: $50.00\n", ""},
+		{"invoice with a decimal string amount", "invoice", `{"InvoiceID": 7, "BookingID": 3, "TotalAmount": "5.5", "Status": "Paid"}`,
+			"Invoice #7", "Total: $5.50\n", ""},
+		{"receipt", "receipt", `{"InvoiceID": 7, "BillingID": 9, "Amount": 12.3}`,
+			"Receipt for invoice #7", "We received your payment of $12.30 for invoice #7.", ""},
+		{"booking confirmed", "booking_confirmed", `{"BookingID": 3, "Date": "2024-12-24", "StartTime": "10:00", "EndTime": "12:00"}`,
+			"Booking #3 confirmed", "Date: 2024-12-24\nTime: 10:00 to 12:00", "Booking #3 confirmed for 2024-12-24 10:00-12:00."},
+		{"booking confirmed without times", "booking_confirmed", `{"BookingID": 3}`,
+			"Booking #3 confirmed", "Your booking #3 is confirmed.\n\nHave a safe trip!", "Booking #3 confirmed."},
+		{"membership downgraded", "membership_downgraded", `{"MembershipID": "VIP", "DefaultMembershipID": "Basic"}`,
+			"Your VIP membership has ended", "your account is now on the Basic membership", "Your VIP membership could not be renewed, you are now on Basic."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, email := setUpDBTest(t)
+			sms := &memoryTransport{}
+			smsTransport = sms
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT name, email, phone FROM users WHERE user_id = ?")).
+				WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Alice", "alice@example.com", "91234567"))
+
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatal(err)
+			}
+			if err := notifyUser(3, tt.template, data); err != nil {
+				t.Fatal(err)
+			}
+
+			sent := email.Sent()
+			if len(sent) != 1 {
+				t.Fatalf("%d emails sent, want 1", len(sent))
+			}
+			if sent[0].To != "alice@example.com" || sent[0].Subject != tt.wantSubject {
+				t.Errorf("email to %s with subject %q, want alice@example.com and %q", sent[0].To, sent[0].Subject, tt.wantSubject)
+			}
+			if !strings.HasPrefix(sent[0].Body, "Hi Alice,\n") || !strings.Contains(sent[0].Body, tt.wantEmail) {
+				t.Errorf("email body %q does not greet Alice and contain %q", sent[0].Body, tt.wantEmail)
+			}
+			if strings.Contains(sent[0].Body, "%!") || strings.Contains(sent[0].Body, "<no value>") {
+				t.Errorf("email body %q was not fully rendered", sent[0].Body)
+			}
+
+			texts := sms.Sent()
+			if tt.wantSMS == "" {
+				if len(texts) != 0 {
+					t.Errorf("SMS sent for a template without one: %v", texts)
+				}
+				return
+			}
+			if len(texts) != 1 || texts[0].To != "91234567" || texts[0].Body != tt.wantSMS {
+				t.Errorf("SMS = %v, want %q to 91234567", texts, tt.wantSMS)
+			}
+		})
+	}
+}
+
+// A template given something that is not an amount fails rather than sending a garbled email
+func TestNotificationTemplateInvalidAmount(t *testing.T) {
+	mock, email := setUpDBTest(t)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, email, phone FROM users WHERE user_id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Alice", "alice@example.com", "91234567"))
+
+	if err := notifyUser(3, "receipt", map[string]interface{}{"InvoiceID": 7, "Amount": "twelve"}); err == nil {
+		t.Error("notifyUser rendered an invalid amount")
+	}
+	if sent := email.Sent(); len(sent) != 0 {
+		t.Errorf("emails sent: %v", sent)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"shared/auth"
+)
+
+// How long a password reset token can be used, configurable through the environment
+var passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute)
+
+// Generate a random password reset token, returning it and the hash stored in the database
+func newPasswordResetToken() (string, string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(bytes)
+	return token, hashPasswordResetToken(token), nil
+}
+
+// Hash a password reset token presented by the user, to look it up
+func hashPasswordResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Send a single-use password reset token to the user with the given email
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	var forgotRequest struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotRequest); err != nil || forgotRequest.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid request data"})
+		return
+	}
+
+	// The response is the same whether or not the email is registered, so it cannot be used to find accounts
+	response := Response{"If an account exists for this email, a password reset token has been sent to it"}
+
+	var userId int
+	err := db.QueryRow("SELECT user_id FROM users WHERE email = ?", forgotRequest.Email).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	token, tokenHash, err := newPasswordResetToken()
+	if err != nil {
+		http.Error(w, "Failed to generate reset token", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the latest token can be used, so invalidate any earlier ones
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	query := "INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES (?, ?, NOW() + INTERVAL ? SECOND)"
+	if _, err := tx.Exec(query, tokenHash, userId, int64(passwordResetTTL.Seconds())); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Sent in the background and a failure only logged, as a slower or different answer would show the account exists
+	go func() {
+		if err := notifyUser(userId, "password_reset", map[string]interface{}{"Token": token, "ExpiresIn": passwordResetTTL.String()}); err != nil {
+			log.Println("Failed to send password reset token:", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Set a new password with a password reset token, signing the user out everywhere
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	var resetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetRequest); err != nil || resetRequest.Token == "" || resetRequest.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Token and new password are required"})
+		return
+	}
+
+	newHashedPassword, err := hashPassword(resetRequest.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{"Failed to hash password"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Use up the token, unless it was already used, replaced or has expired
+	tokenHash := hashPasswordResetToken(resetRequest.Token)
+	var userId int
+	query := "SELECT user_id FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW() FOR UPDATE"
+	err = tx.QueryRow(query, tokenHash).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{"Invalid or expired reset token"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = NOW() WHERE token_hash = ?", tokenHash); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Update the password and revoke the existing sessions in the same transaction
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE user_id = ?", newHashedPassword, userId); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ? AND revoked = FALSE", userId); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the user know in case it was not them
+	go func() {
+		if err := notifyUser(userId, "password_changed", nil); err != nil {
+			log.Println("Failed to send password change notice:", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Password reset successfully, please log in with your new password"})
+}
+
+// Change the signed-in user's password, which requires their current password
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+		*TokenPair
+	}
+
+	var changeRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeRequest); err != nil || changeRequest.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{Message: "Current and new password are required"})
+		return
+	}
+
+	// Get user ID from the access token
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid user"})
+		return
+	}
+
+	var currentHashedPassword string
+	err = db.QueryRow("SELECT password FROM users WHERE user_id = ?", userId).Scan(&currentHashedPassword)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{Message: "User not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Check the current password
+	if bcrypt.CompareHashAndPassword([]byte(currentHashedPassword), []byte(changeRequest.CurrentPassword)) != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{Message: "Current password is incorrect"})
+		return
+	}
+	// Check if the new password is different from the current one
+	if bcrypt.CompareHashAndPassword([]byte(currentHashedPassword), []byte(changeRequest.NewPassword)) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{Message: "New password cannot be the same as the current password"})
+		return
+	}
+
+	newHashedPassword, err := hashPassword(changeRequest.NewPassword)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Message: "Failed to hash password"})
+		return
+	}
+
+	// Update the password unless it changed since it was checked
+	result, err := db.Exec("UPDATE users SET password = ? WHERE user_id = ? AND password = ?", newHashedPassword, userId, currentHashedPassword)
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{Message: "Password was changed by another request"})
+		return
+	}
+
+	// Sign out the other sessions, keeping this one with a fresh pair of tokens
+	if err := revokeUserTokens(userId); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := issueTokens(userId)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the user know in case it was not them
+	go func() {
+		if err := notifyUser(userId, "password_changed", nil); err != nil {
+			log.Println("Failed to send password change notice:", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Password changed successfully", tokens})
+}
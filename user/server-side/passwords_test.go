@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Wait for notifications sent in the background
+func waitForSent(t *testing.T, transport *memoryTransport, count int) []Notification {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sent := transport.Sent()
+		if len(sent) >= count {
+			return sent
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d notifications sent, want %d", len(sent), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Query resetPassword uses to claim a token; only unused tokens that have not expired match it
+const claimResetTokenQuery = "SELECT user_id FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW() FOR UPDATE"
+
+// A reset token is emailed, stored only as its hash to expire after the TTL, and can be used once
+func TestPasswordResetTokenWorksOnce(t *testing.T) {
+	mock, transport := setUpDBTest(t)
+
+	var stored string
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM users WHERE email = ?")).
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES (?, ?, NOW() + INTERVAL ? SECOND)")).
+		WithArgs(captureArg{&stored}, 3, int64(passwordResetTTL.Seconds())).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, email, phone FROM users WHERE user_id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Alice", "alice@example.com", "91234567"))
+
+	status, response := callHandler(t, forgotPassword, map[string]string{"email": "alice@example.com"})
+	if status != http.StatusOK {
+		t.Fatalf("forgot password: status = %d (%v), want %d", status, response["message"], http.StatusOK)
+	}
+	sent := waitForSent(t, transport, 1)
+	token := regexp.MustCompile(`\b[0-9a-f]{64}\b`).FindString(sent[0].Body)
+	if token == "" || hashPasswordResetToken(token) != stored {
+		t.Fatalf("emailed token %q does not match the stored hash %q", token, stored)
+	}
+
+	// The first reset claims the token and uses it up in the same transaction
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(claimResetTokenQuery)).
+		WithArgs(stored).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE password_reset_tokens SET used_at = NOW() WHERE token_hash = ?")).
+		WithArgs(stored).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = ? WHERE user_id = ?")).
+		WithArgs(sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ? AND revoked = FALSE")).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, email, phone FROM users WHERE user_id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Alice", "alice@example.com", "91234567"))
+
+	status, response = callHandler(t, resetPassword, map[string]string{"token": token, "password": "new-password"})
+	if status != http.StatusOK {
+		t.Fatalf("first reset: status = %d (%v), want %d", status, response["message"], http.StatusOK)
+	}
+	waitForSent(t, transport, 2)
+
+	// Used up, the token no longer matches
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(claimResetTokenQuery)).
+		WithArgs(stored).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	status, response = callHandler(t, resetPassword, map[string]string{"token": token, "password": "another-password"})
+	if status != http.StatusBadRequest {
+		t.Errorf("second reset: status = %d (%v), want %d", status, response["message"], http.StatusBadRequest)
+	}
+}
+
+// An expired token is refused and changes nothing
+func TestPasswordResetTokenExpires(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	token := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(claimResetTokenQuery)).
+		WithArgs(hashPasswordResetToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	status, response := callHandler(t, resetPassword, map[string]string{"token": token, "password": "new-password"})
+	if status != http.StatusBadRequest {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusBadRequest)
+	}
+}
@@ -10,39 +10,48 @@ import (
 	"strings"
 	"time"
 
-	"math/rand"
 	"strconv"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"golang.org/x/crypto/bcrypt"
+
+	"shared/auth"
+	"shared/money"
 )
 
 // User Struct (req body)
 type User struct {
-	UserID           int    `json:"user_id"`
-	Name             string `json:"name"`
-	Email            string `json:"email"`
-	Phone            string `json:"phone"`
-	Dob              string `json:"dob"`
-	Password         string `json:"password"`
-	MembershipId     string `json:"membership_id"`
-	LicenseNumber    string `json:"license_number"`
-	LicenseExpiry    string `json:"license_expiry"`
-	VerificationCode string `json:"verification_code"`
-	Verified         bool   `json:"verified"`
+	UserID           int           `json:"user_id"`
+	Name             string        `json:"name"`
+	Email            string        `json:"email"`
+	Phone            string        `json:"phone"`
+	Dob              string        `json:"dob"`
+	Password         string        `json:"password"`
+	MembershipId     string        `json:"membership_id"`
+	LicenseNumber    string        `json:"license_number"`
+	LicenseExpiry    string        `json:"license_expiry"`
+	VerificationCode string        `json:"verification_code"`
+	Verified         bool          `json:"verified"`
+	Subscription     *Subscription `json:"subscription,omitempty"`
 }
 
 // Membership struct (req body)
 type Membership struct {
-	MembershipId       string  `json:"membership_id"`
-	HourlyRateDiscount float64 `json:"hourly_rate_discount"`
-	BookingLimit       int     `json:"booking_limit"`
+	MembershipId       string      `json:"membership_id"`
+	HourlyRateDiscount float64     `json:"hourly_rate_discount"`
+	BookingLimit       int         `json:"booking_limit"`       // bookings allowed per booking period
+	BookingPeriod      string      `json:"booking_period"`      // calendar_month or rolling_30_days
+	MaxActiveBookings  int         `json:"max_active_bookings"` // upcoming or ongoing bookings allowed at once
+	MonthlyPrice       money.Money `json:"monthly_price"`
 }
 
 var db *sql.DB
 
+// Base URL of the billing service
+var billingServiceURL = "http://localhost:8081"
+
 // Initialise the user_svc_db database connection
 func initDB() {
 	var err error
@@ -54,20 +63,36 @@ func initDB() {
 }
 
 func main() {
+	// Refuse to start without a proper signing secret
+	auth.LoadSecret()
 	// Call initDB(), to initialise user_svc_db connection
 	initDB()
 	defer db.Close()
+	// Renew paid memberships as their periods end
+	go startMembershipRenewer(getEnvDuration("MEMBERSHIP_RENEWAL_INTERVAL", time.Hour))
 	// Setting up router and API endpoints
 	router := mux.NewRouter()
 	router.HandleFunc("/api/v1/register", registerUser).Methods("POST")
 	router.HandleFunc("/api/v1/verify", verifyUser).Methods("POST")
+	router.HandleFunc("/api/v1/verify/resend", resendVerificationCode).Methods("POST")
 	router.HandleFunc("/api/v1/login", loginUser).Methods("POST")
-	router.HandleFunc("/api/v1/user/{id}", updateUser).Methods("PUT")
-	router.HandleFunc("/api/v1/user/{id}", getUser).Methods("GET")
-	router.HandleFunc("/api/v1/password", updatePassword).Methods("PUT")
-	router.HandleFunc("/api/v1/validate-user/{id}", userExists).Methods("GET")
-	router.HandleFunc("/api/v1/membership/{id}", getMembership).Methods("GET")
-	handler := cors.Default().Handler(router)
+	router.HandleFunc("/api/v1/token/refresh", refreshToken).Methods("POST")
+	router.HandleFunc("/api/v1/logout", auth.RequireAuth(logoutUser)).Methods("POST")
+	router.HandleFunc("/api/v1/user/{id}", auth.RequireAuth(updateUser)).Methods("PUT")
+	router.HandleFunc("/api/v1/user/{id}", auth.RequireAuth(getUser)).Methods("GET")
+	router.HandleFunc("/api/v1/password", auth.RequireAuth(changePassword)).Methods("PUT")
+	router.HandleFunc("/api/v1/password/forgot", forgotPassword).Methods("POST")
+	router.HandleFunc("/api/v1/password/reset", resetPassword).Methods("POST")
+	router.HandleFunc("/api/v1/validate-user/{id}", auth.RequireAuth(auth.RequireService(userExists))).Methods("GET")
+	router.HandleFunc("/api/v1/membership/{id}", auth.RequireAuth(auth.RequireService(getMembership))).Methods("GET")
+	router.HandleFunc("/api/v1/memberships", getMemberships).Methods("GET")
+	router.HandleFunc("/api/v1/subscribe/{id}", auth.RequireAuth(subscribeMembership)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/unlock", auth.RequireAuth(auth.RequireAdmin(unlockAccount))).Methods("POST")
+	router.HandleFunc("/api/v1/notify/{id}", auth.RequireAuth(auth.RequireService(sendNotification))).Methods("POST")
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+	}).Handler(router)
 	fmt.Println("Listening at port 8000")
 	log.Fatal(http.ListenAndServe(":8000", handler))
 }
@@ -107,9 +132,8 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 
 	// Response struct for user registration
 	type RegisterResponse struct {
-		Message          string `json:"message"`
-		VerificationCode string `json:"verification_code"`
-		User             User   `json:"user"`
+		Message string `json:"message"`
+		User    User   `json:"user"`
 	}
 
 	// Create a new instance of User struct
@@ -183,14 +207,11 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	// Assign user membership to be default value (Basic)
 	newUser.MembershipId = "Basic"
 
-	// Assign a random verification code to the user
-	verificationCode := strconv.Itoa(rand.Intn(1000000))
-
-	// Insert the user data into the user_svc_db
-	query := `INSERT INTO users (name, email, phone, dob, password, membership_id, license_number, license_expiry, verification_code, verified) 
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	// Insert the user data into the user_svc_db, the verification code is issued once the user exists
+	query := `INSERT INTO users (name, email, phone, dob, password, membership_id, license_number, license_expiry, verified) 
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := db.Exec(query, newUser.Name, newUser.Email, newUser.Phone, newUser.Dob, hashedPassword, newUser.MembershipId, newUser.LicenseNumber, newUser.LicenseExpiry, verificationCode, false)
+	result, err := db.Exec(query, newUser.Name, newUser.Email, newUser.Phone, newUser.Dob, hashedPassword, newUser.MembershipId, newUser.LicenseNumber, newUser.LicenseExpiry, false)
 	if err != nil {
 		if strings.Contains(err.Error(), "Duplicate entry") {
 			w.WriteHeader(http.StatusConflict)
@@ -221,102 +242,22 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	// Set the user ID in the newUser struct
 	newUser.UserID = int(userID)
 
+	// Send the verification code to the user, never in the response
+	message := "User registered successfully, check your email for the verification code"
+	if err := issueVerificationCode(newUser.UserID); err != nil {
+		log.Println("Failed to send verification code:", err)
+		message = "User registered successfully, but the verification code could not be sent"
+	}
+
 	// Respond with success
 	w.WriteHeader(http.StatusCreated)
 	response := RegisterResponse{
-		Message:          "User registered successfully",
-		VerificationCode: verificationCode,
-		User:             newUser,
+		Message: message,
+		User:    newUser,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-// Creating a post function to verify authentication
-func verifyUser(w http.ResponseWriter, r *http.Request) {
-	// Set the Content-Type once at the start
-	w.Header().Set("Content-Type", "application/json")
-	var verificationRequest struct {
-		Email            string `json:"email"`
-		VerificationCode string `json:"verification_code"`
-	}
-	type LoginResponse struct {
-		Message string `json:"message"`
-		UserId  int    `json:"user_id"`
-	}
-	// Read the request body
-	jsonByte, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	// Unmarshal the JSON into the verificationRequest struct
-	err = json.Unmarshal(jsonByte, &verificationRequest)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := LoginResponse{
-			Message: "Invalid verification data",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Retrieve the user by email
-	var user User
-	var userId int
-	query := `SELECT user_id, email, verification_code, verified FROM users WHERE email = ?`
-	err = db.QueryRow(query, verificationRequest.Email).Scan(&userId, &user.Email, &user.VerificationCode, &user.Verified)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			response := LoginResponse{
-				Message: "User not found",
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
-	}
-	// Check if the user is already verified
-	if user.Verified {
-		w.WriteHeader(http.StatusConflict)
-		response := LoginResponse{
-			Message: "User with the email of " + user.Email + " is already verified",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Check if the verification code matches
-	if user.VerificationCode != verificationRequest.VerificationCode {
-		// Respond with unauthorized if the verification code does not match
-		w.WriteHeader(http.StatusUnauthorized)
-		response := LoginResponse{
-			Message: "Invalid verification code",
-		}
-		json.NewEncoder(w).Encode(response)
-	} else {
-		// Update the user verification status if the verification code matches
-		_, err = db.Exec("UPDATE users SET verified = ? WHERE email = ?", true, verificationRequest.Email)
-		if err != nil {
-			http.Error(w, "Failed to update user verification status", http.StatusInternalServerError)
-			return
-		}
-		// Respond with success
-		w.WriteHeader(http.StatusOK)
-		respsonse := struct {
-			Message string `json:"message"`
-			UserId  int    `json:"user_id"`
-		}{
-			Message: "User verified successfully",
-			UserId:  userId,
-		}
-		json.NewEncoder(w).Encode(respsonse)
-	}
-}
-
 // Creating a post function to login user
 func loginUser(w http.ResponseWriter, r *http.Request) {
 	// Set the Content-Type once at the start
@@ -329,6 +270,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	type LoginResponse struct {
 		Message string `json:"message"`
 		UserId  int    `json:"user_id"`
+		*TokenPair
 	}
 
 	// Read the request body
@@ -345,24 +287,59 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid login data", http.StatusBadRequest)
 		return
 	}
+	// Refuse while the account or the client is locked out, without checking the password
+	accountKey, ipKey := accountAttemptKey(loginRequest.Email), ipAttemptKey(r)
+	lockout, err := loginLockout(accountKey, ipKey)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if lockout > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		response := LoginResponse{
+			Message: "Too many failed login attempts, please try again later",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	var hashedPassword string
 	var userId int
 	// Retrieve the user by email
 	var user User
 	query := `SELECT user_id, email, password, verified FROM users WHERE email = ?`
 	err = db.QueryRow(query, loginRequest.Email).Scan(&userId, &user.Email, &hashedPassword, &user.Verified)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			response := LoginResponse{
-				Message: "User not found",
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			http.Error(w, "Database error", http.StatusInternalServerError)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	found := err == nil
+	if !found {
+		// Still compare a password so unknown emails take as long as wrong passwords
+		hashedPassword = dummyPasswordHash
+	}
+	// Compare the password
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(loginRequest.Password))
+	if err != nil || !found {
+		// Count the failure against both the account and the client
+		if err := recordLoginFailure(accountKey, loginMaxAccountFailures); err != nil {
+			log.Println("Failed to record login failure:", err)
+		}
+		if err := recordLoginFailure(ipKey, loginMaxIPFailures); err != nil {
+			log.Println("Failed to record login failure:", err)
 		}
+		w.WriteHeader(http.StatusUnauthorized)
+		response := LoginResponse{
+			Message: invalidLoginMessage,
+		}
+		json.NewEncoder(w).Encode(response)
 		return
 	}
+	// The password is right, so the account's failures no longer count
+	if err := clearLoginFailures(accountKey); err != nil {
+		log.Println("Failed to clear login failures:", err)
+	}
 	// Check if the user is verified
 	if !user.Verified {
 		w.WriteHeader(http.StatusForbidden)
@@ -372,21 +349,18 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Compare the password
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(loginRequest.Password))
+	// Issue the access and refresh tokens
+	tokens, err := issueTokens(userId)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		response := LoginResponse{
-			Message: "Invalid password",
-		}
-		json.NewEncoder(w).Encode(response)
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
 		return
 	}
 	// Successful login
 	w.WriteHeader(http.StatusOK)
 	response := LoginResponse{
-		Message: "User logged in successfully",
-		UserId:  userId,
+		Message:   "User logged in successfully",
+		UserId:    userId,
+		TokenPair: tokens,
 	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -398,13 +372,12 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 
 	// Response struct for user registration
 	type UpdateResponse struct {
-		Message          string `json:"message"`
-		VerificationCode string `json:"verification_code"`
-		User             User   `json:"user"`
+		Message string `json:"message"`
+		User    User   `json:"user"`
 	}
 
-	// Get user ID from URL params (assuming it's passed)
-	userId := mux.Vars(r)["id"]
+	// Get user ID from the access token
+	userId := auth.UserID(r)
 
 	// Validate the user email is found in db
 	var currentemail string
@@ -446,16 +419,8 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate new verification code if email is updated
-	var verificationCode string
-	setVerificationCode := false
-
-	// Check if the email is being updated
-	if updatedUser.Email != "" && updatedUser.Email != currentemail {
-		// Generate a new verification code if the email has changed
-		verificationCode = strconv.Itoa(rand.Intn(1000000))
-		setVerificationCode = true
-	}
+	// A new email address has to be verified again
+	setVerificationCode := updatedUser.Email != "" && updatedUser.Email != currentemail
 
 	// Validate license expiry date if provided
 	if updatedUser.LicenseExpiry != "" {
@@ -477,20 +442,15 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		email = COALESCE(NULLIF(?, ''), email),
 		name = COALESCE(NULLIF(?, ''), name),
 		phone = COALESCE(NULLIF(?, ''), phone),
-		membership_id = COALESCE(NULLIF(?, ''), membership_id),
 		license_number = COALESCE(NULLIF(?, ''), license_number),
 		license_expiry = COALESCE(NULLIF(?, ''), license_expiry)`
 	if setVerificationCode {
-		updateQuery += `, verification_code = ?, verified = ?`
+		updateQuery += `, verified = FALSE`
 	}
 	updateQuery += ` WHERE user_id = ?`
 
 	// Execute the update query
-	if setVerificationCode {
-		_, err = db.Exec(updateQuery, updatedUser.Email, updatedUser.Name, updatedUser.Phone, updatedUser.MembershipId, updatedUser.LicenseNumber, updatedUser.LicenseExpiry, verificationCode, false, userId)
-	} else {
-		_, err = db.Exec(updateQuery, updatedUser.Email, updatedUser.Name, updatedUser.Phone, updatedUser.MembershipId, updatedUser.LicenseNumber, updatedUser.LicenseExpiry, userId)
-	}
+	_, err = db.Exec(updateQuery, updatedUser.Email, updatedUser.Name, updatedUser.Phone, updatedUser.LicenseNumber, updatedUser.LicenseExpiry, userId)
 
 	if err != nil {
 		fmt.Println(err)
@@ -523,127 +483,34 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Respond with success
-	w.WriteHeader(http.StatusOK)
-	response := UpdateResponse{
-		Message: "User updated successfully",
-		User:    dbuser,
-	}
+	// Send the verification code to the new email address, never in the response
+	message := "User updated successfully"
 	if setVerificationCode {
-		response.VerificationCode = verificationCode
-	}
-	json.NewEncoder(w).Encode(response)
-}
-
-// Create a function to update the password by email
-func updatePassword(w http.ResponseWriter, r *http.Request) {
-	// Set the Content-Type once at the start
-	w.Header().Set("Content-Type", "application/json")
-
-	// Response struct for user registration
-	type UpdatePasswordResponse struct {
-		Message string `json:"message"`
-	}
-
-	// Read the request body
-	var updatedUser struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-
-	// Read and parse the request body into the struct
-	jsonByte, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := UpdatePasswordResponse{
-			Message: "Failed to read request body",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	defer r.Body.Close()
-
-	// Unmarshal the JSON into the updatedUser struct
-	err = json.Unmarshal(jsonByte, &updatedUser)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := UpdatePasswordResponse{
-			Message: "Invalid update data",
+		message = "User updated successfully, check your email for the verification code"
+		userID, _ := strconv.Atoi(userId)
+		if err := issueVerificationCode(userID); err != nil {
+			log.Println("Failed to send verification code:", err)
+			message = "User updated successfully, but the verification code could not be sent"
 		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Validate the user email is found in the database
-	var currentHashedPassword string
-	query := `SELECT password FROM users WHERE email = ?`
-	err = db.QueryRow(query, updatedUser.Email).Scan(&currentHashedPassword)
-	if err != nil {
-		fmt.Println(err)
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			response := UpdatePasswordResponse{
-				Message: "User not found",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-	}
-
-	// Check if the new password is different from the current one
-	err = bcrypt.CompareHashAndPassword([]byte(currentHashedPassword), []byte(updatedUser.Password))
-	if err == nil {
-		// If the passwords are the same
-		w.WriteHeader(http.StatusBadRequest)
-		response := UpdatePasswordResponse{
-			Message: "New password cannot be the same as the current password",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Hash the new password
-	newHashedPassword, err := hashPassword(updatedUser.Password)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := UpdatePasswordResponse{
-			Message: "Failed to hash password",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// SQL query for updating user password
-	updateQuery := `UPDATE users SET password = ? WHERE email = ?`
-
-	// Execute the update query
-	_, err = db.Exec(updateQuery, newHashedPassword, updatedUser.Email)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		response := UpdatePasswordResponse{
-			Message: "Failed to update password",
-		}
-		json.NewEncoder(w).Encode(response)
-		return
 	}
 
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
-	response := UpdatePasswordResponse{
-		Message: "Password updated successfully",
+	response := UpdateResponse{
+		Message: message,
+		User:    dbuser,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
 // Create a function to get user details by ID
 func getUser(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from URL params
-	userId := mux.Vars(r)["id"]
+	// Get user ID from the access token
+	userId := auth.UserID(r)
 
 	// Retrieve the user by ID
 	var user User
-	query := `SELECT user_id, name, email, phone, dob, membership_id, license_number, license_expiry, verified FROM users WHERE user_id = ?`
+	query := `SELECT user_id, name, email, phone, dob, membership_id, COALESCE(license_number, ''), COALESCE(license_expiry, ''), verified FROM users WHERE user_id = ?`
 	err := db.QueryRow(query, userId).Scan(&user.UserID, &user.Name, &user.Email, &user.Phone, &user.Dob, &user.MembershipId, &user.LicenseNumber, &user.LicenseExpiry, &user.Verified)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -654,6 +521,13 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Include the membership renewal
+	user.Subscription, err = getSubscription(user.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	// Respond with the user details
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -671,7 +545,7 @@ func userExists(w http.ResponseWriter, r *http.Request) {
 	}
 	// Query to check if the user exists
 	var foundUser User
-	query := `SELECT user_id, name, email, phone, dob, membership_id, license_number, license_expiry, verified FROM users WHERE user_id = ?`
+	query := `SELECT user_id, name, email, phone, dob, membership_id, COALESCE(license_number, ''), COALESCE(license_expiry, ''), verified FROM users WHERE user_id = ?`
 	err := db.QueryRow(query, userID).Scan(&foundUser.UserID, &foundUser.Name, &foundUser.Email, &foundUser.Phone, &foundUser.Dob, &foundUser.MembershipId, &foundUser.LicenseNumber, &foundUser.LicenseExpiry, &foundUser.Verified)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -713,8 +587,8 @@ func getMembership(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the membership by ID
 	var membership Membership
 
-	query := `SELECT membership_id, hourly_rate_discount, booking_limit FROM memberships WHERE membership_id = ?`
-	err := db.QueryRow(query, membershipId).Scan(&membership.MembershipId, &membership.HourlyRateDiscount, &membership.BookingLimit)
+	query := `SELECT membership_id, hourly_rate_discount, booking_limit, booking_period, max_active_bookings, monthly_price FROM memberships WHERE membership_id = ?`
+	err := db.QueryRow(query, membershipId).Scan(&membership.MembershipId, &membership.HourlyRateDiscount, &membership.BookingLimit, &membership.BookingPeriod, &membership.MaxActiveBookings, &membership.MonthlyPrice)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Membership subscriptions, configurable through the environment
+var (
+	// Length of a paid membership period, after which it renews
+	membershipPeriod = getEnvDuration("MEMBERSHIP_PERIOD", 30*24*time.Hour)
+	// Longest wait for billing to answer a membership charge, as an upgrade holds the user's row locked meanwhile
+	membershipChargeTimeout = getEnvDuration("MEMBERSHIP_CHARGE_TIMEOUT", 10*time.Second)
+)
+
+// Client for membership charges, giving up after membershipChargeTimeout
+var membershipChargeClient = &http.Client{Timeout: membershipChargeTimeout}
+
+// The free tier every user falls back to
+const defaultMembership = "Basic"
+
+// Returned by chargeMembership when the card cannot cover the charge
+var errMembershipPaymentDeclined = errors.New("membership payment declined")
+
+// Membership of a user and its renewal
+type Subscription struct {
+	MembershipId          string  `json:"membership_id"`
+	RenewsAt              *string `json:"renews_at"`
+	CardID                *int    `json:"card_id"`
+	ScheduledMembershipId *string `json:"scheduled_membership_id"`
+}
+
+// Get a membership tier and its price
+func getMembershipTier(membershipId string) (*Membership, error) {
+	var membership Membership
+	query := `SELECT membership_id, hourly_rate_discount, booking_limit, booking_period, max_active_bookings, monthly_price FROM memberships WHERE membership_id = ?`
+	err := db.QueryRow(query, membershipId).Scan(&membership.MembershipId, &membership.HourlyRateDiscount, &membership.BookingLimit, &membership.BookingPeriod, &membership.MaxActiveBookings, &membership.MonthlyPrice)
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
+
+// Idempotency-Key of the charge that upgrades a user to target from the period ending at renewsAt,
+// so a retried upgrade is not charged twice
+func upgradeChargeKey(userId int, renewsAt sql.NullString, target string, cardId int) string {
+	periodEnd := "none"
+	if renewsAt.Valid {
+		periodEnd = renewsAt.String
+	}
+	return fmt.Sprintf("membership-upgrade-%d-%s-%s-%d", userId, periodEnd, target, cardId)
+}
+
+// Idempotency-Key of the charge that renews a user's membership onto target for the period after renewsAt
+func renewalChargeKey(userId int, renewsAt string, target string) string {
+	return fmt.Sprintf("membership-renewal-%d-%s-%s", userId, renewsAt, target)
+}
+
+// Charge a membership to the user's card through the billing service. Billing answers a repeated
+// idempotencyKey with the stored result, so a charge whose reply was lost can be sent again safely.
+func chargeMembership(userId int, cardId int, membershipId string, amount money.Money, description string, idempotencyKey string) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"card_id":       cardId,
+		"membership_id": membershipId,
+		"amount":        amount,
+		"description":   description,
+	})
+	if err != nil {
+		return err
+	}
+	chargeURL := billingServiceURL + "/api/v1/membership-charge/" + strconv.Itoa(userId)
+	req, err := auth.NewServiceRequest(http.MethodPost, chargeURL, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	resp, err := membershipChargeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to charge membership: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPaymentRequired, http.StatusNotFound:
+		return errMembershipPaymentDeclined
+	default:
+		return fmt.Errorf("failed to charge membership, status code: %d", resp.StatusCode)
+	}
+}
+
+// Get the membership tiers and their prices
+func getMemberships(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	type Response struct {
+		Message     string       `json:"message"`
+		Memberships []Membership `json:"memberships"`
+	}
+
+	rows, err := db.Query(`SELECT membership_id, hourly_rate_discount, booking_limit, booking_period, max_active_bookings, monthly_price FROM memberships ORDER BY monthly_price`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var memberships []Membership
+	for rows.Next() {
+		var membership Membership
+		if err := rows.Scan(&membership.MembershipId, &membership.HourlyRateDiscount, &membership.BookingLimit, &membership.BookingPeriod, &membership.MaxActiveBookings, &membership.MonthlyPrice); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		memberships = append(memberships, membership)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Memberships found", memberships})
+}
+
+// Subscribe the user to a membership tier. Upgrades take effect straight away and are charged
+// the price difference for the rest of the current period; downgrades take effect when it ends.
+func subscribeMembership(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	type Response struct {
+		Message      string        `json:"message"`
+		Charged      money.Money   `json:"charged"`
+		Subscription *Subscription `json:"subscription"`
+	}
+
+	var subscribeRequest struct {
+		MembershipId string `json:"membership_id"`
+		CardID       int    `json:"card_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&subscribeRequest); err != nil || subscribeRequest.MembershipId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid subscription data"})
+		return
+	}
+
+	// Get user ID from the access token
+	userId, err := strconv.Atoi(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid user"})
+		return
+	}
+
+	target, err := getMembershipTier(subscribeRequest.MembershipId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{Message: "Membership not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Lock the user's row until the change is saved, so concurrent requests cannot both charge for it
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Current membership, how long is left of its period, the card it renews on, and any charge left unconfirmed
+	var currentId string
+	var renewsAt sql.NullString
+	var remainingSeconds sql.NullInt64
+	var cardId sql.NullInt64
+	var pendingKey sql.NullString
+	var pendingCharge *money.Money
+	query := `
+		SELECT membership_id, membership_renews_at, TIMESTAMPDIFF(SECOND, NOW(), membership_renews_at), membership_card_id, pending_membership_charge_key, pending_membership_charge
+		FROM users
+		WHERE user_id = ?
+		FOR UPDATE`
+	err = tx.QueryRow(query, userId).Scan(&currentId, &renewsAt, &remainingSeconds, &cardId, &pendingKey, &pendingCharge)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{Message: "User not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	current, err := getMembershipTier(currentId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	periodActive := remainingSeconds.Valid && remainingSeconds.Int64 > 0
+
+	var charged money.Money
+	var message string
+	switch {
+	case target.MembershipId == current.MembershipId:
+		// Staying on the current tier cancels any scheduled downgrade
+		result, err := tx.Exec("UPDATE users SET scheduled_membership_id = NULL WHERE user_id = ? AND scheduled_membership_id IS NOT NULL", userId)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(Response{Message: "Already subscribed to this membership"})
+			return
+		}
+		message = "Scheduled membership change cancelled"
+
+	case target.MonthlyPrice < current.MonthlyPrice && periodActive:
+		// Downgrades keep the paid-for tier until the period ends
+		_, err := tx.Exec("UPDATE users SET scheduled_membership_id = ? WHERE user_id = ?", target.MembershipId, userId)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		message = "Membership will change to " + target.MembershipId + " when the current period ends"
+
+	case target.MonthlyPrice <= 0:
+		// Moving to a free tier after the paid period has ended
+		_, err := tx.Exec("UPDATE users SET membership_id = ?, membership_renews_at = NULL, scheduled_membership_id = NULL WHERE user_id = ?", target.MembershipId, userId)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		message = "Membership changed to " + target.MembershipId
+
+	default:
+		// Upgrades are charged now; a card is needed unless one is already on file
+		card := subscribeRequest.CardID
+		if card == 0 && cardId.Valid {
+			card = int(cardId.Int64)
+		}
+		if card == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{Message: "A card is required to pay for the membership"})
+			return
+		}
+
+		// Within a paid period only the difference for the time left is charged, otherwise a new period starts
+		var remaining time.Duration
+		if remainingSeconds.Valid {
+			remaining = time.Duration(remainingSeconds.Int64) * time.Second
+		}
+		chargeKey := upgradeChargeKey(userId, renewsAt, target.MembershipId, card)
+		var prorated bool
+		charged, prorated = upgradeCharge(current.MonthlyPrice, target.MonthlyPrice, remaining, membershipPeriod, chargeKey, pendingKey, pendingCharge)
+		description := target.MembershipId + " membership"
+		if prorated {
+			description = fmt.Sprintf("Upgrade from %s to %s membership for the rest of the period", current.MembershipId, target.MembershipId)
+		}
+		if charged > 0 {
+			err := chargeMembership(userId, card, target.MembershipId, charged, description, chargeKey)
+			if err != nil {
+				log.Println("Failed to charge membership:", err)
+				if errors.Is(err, errMembershipPaymentDeclined) {
+					w.WriteHeader(http.StatusPaymentRequired)
+					json.NewEncoder(w).Encode(Response{Message: "Payment declined, membership not changed"})
+					return
+				}
+				// The charge may still have gone through, so remember it for the retry
+				query = "UPDATE users SET pending_membership_charge_key = ?, pending_membership_charge = ? WHERE user_id = ?"
+				if _, err := tx.Exec(query, chargeKey, charged, userId); err != nil {
+					log.Println("Failed to record pending membership charge:", err)
+				} else if err := tx.Commit(); err != nil {
+					log.Println("Failed to record pending membership charge:", err)
+				}
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(Response{Message: "Failed to charge membership, please try again"})
+				return
+			}
+		}
+
+		if prorated {
+			query = "UPDATE users SET membership_id = ?, membership_card_id = ?, scheduled_membership_id = NULL, pending_membership_charge_key = NULL, pending_membership_charge = NULL WHERE user_id = ?"
+			_, err = tx.Exec(query, target.MembershipId, card, userId)
+		} else {
+			query = "UPDATE users SET membership_id = ?, membership_card_id = ?, scheduled_membership_id = NULL, pending_membership_charge_key = NULL, pending_membership_charge = NULL, membership_renews_at = NOW() + INTERVAL ? SECOND WHERE user_id = ?"
+			_, err = tx.Exec(query, target.MembershipId, card, int64(membershipPeriod.Seconds()), userId)
+		}
+		if err != nil {
+			// The charge went through, so this needs to be fixed by hand
+			log.Printf("Membership of user %d was charged %s but could not be updated: %v", userId, charged, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		message = "Membership changed to " + target.MembershipId
+	}
+	if err := tx.Commit(); err != nil {
+		if charged > 0 {
+			log.Printf("Membership of user %d was charged %s but could not be updated: %v", userId, charged, err)
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	subscription, err := getSubscription(userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{message, charged, subscription})
+}
+
+// Price of an upgrade from currentPrice to targetPrice with remaining left of the period, and whether it is
+// prorated. Within a paid period only the difference for the time left is charged; otherwise a new period
+// starts at the full price. A retry of a charge left pending under chargeKey is charged the same amount,
+// as the prorated price drops over time and billing only replays a charge sent again unchanged.
+func upgradeCharge(currentPrice, targetPrice money.Money, remaining, period time.Duration, chargeKey string, pendingKey sql.NullString, pendingCharge *money.Money) (money.Money, bool) {
+	prorated := remaining > 0 && currentPrice > 0
+	charge := targetPrice
+	if prorated {
+		secondsLeft := int64(min(remaining, period) / time.Second)
+		charge = (targetPrice - currentPrice).MulDiv(secondsLeft, int64(period/time.Second))
+	}
+	if pendingKey.Valid && pendingKey.String == chargeKey && pendingCharge != nil {
+		charge = *pendingCharge
+	}
+	return charge, prorated
+}
+
+// Get the user's membership and its renewal
+func getSubscription(userId int) (*Subscription, error) {
+	var subscription Subscription
+	query := "SELECT membership_id, membership_renews_at, membership_card_id, scheduled_membership_id FROM users WHERE user_id = ?"
+	err := db.QueryRow(query, userId).Scan(&subscription.MembershipId, &subscription.RenewsAt, &subscription.CardID, &subscription.ScheduledMembershipId)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// Periodically renew memberships whose period has ended
+func startMembershipRenewer(interval time.Duration) {
+	log.Printf("Membership renewer started (period: %s, interval: %s)", membershipPeriod, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		renewed, downgraded, err := renewMemberships()
+		if err != nil {
+			log.Println("Failed to renew memberships:", err)
+		} else if renewed > 0 || downgraded > 0 {
+			log.Printf("Renewed %d membership(s), downgraded %d", renewed, downgraded)
+		}
+		<-ticker.C
+	}
+}
+
+// Renew each membership whose period has ended, onto its scheduled tier if a change was asked for.
+// A renewal that cannot be paid, or a change to the free tier, moves the user back to the default membership.
+func renewMemberships() (int, int, error) {
+	type dueMembership struct {
+		userId   int
+		renewsAt string
+		target   string
+		cardId   sql.NullInt64
+	}
+	query := `
+		SELECT user_id, membership_renews_at, COALESCE(scheduled_membership_id, membership_id), membership_card_id
+		FROM users
+		WHERE membership_renews_at IS NOT NULL AND membership_renews_at <= NOW()`
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	var due []dueMembership
+	for rows.Next() {
+		var membership dueMembership
+		if err := rows.Scan(&membership.userId, &membership.renewsAt, &membership.target, &membership.cardId); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		due = append(due, membership)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	renewed, downgraded := 0, 0
+	for _, membership := range due {
+		target, err := getMembershipTier(membership.target)
+		if err != nil {
+			return renewed, downgraded, err
+		}
+
+		// Charge the next period; the period end is part of the condition so a renewal is only applied once,
+		// and part of the Idempotency-Key so a charge whose reply was lost is replayed rather than repeated
+		if target.MonthlyPrice > 0 && membership.cardId.Valid {
+			chargeKey := renewalChargeKey(membership.userId, membership.renewsAt, target.MembershipId)
+			err := chargeMembership(membership.userId, int(membership.cardId.Int64), target.MembershipId, target.MonthlyPrice, target.MembershipId+" membership renewal", chargeKey)
+			if err == nil {
+				query := "UPDATE users SET membership_id = ?, scheduled_membership_id = NULL, membership_renews_at = membership_renews_at + INTERVAL ? SECOND WHERE user_id = ? AND membership_renews_at = ?"
+				if _, err := db.Exec(query, target.MembershipId, int64(membershipPeriod.Seconds()), membership.userId, membership.renewsAt); err != nil {
+					return renewed, downgraded, err
+				}
+				renewed++
+				continue
+			}
+			if !errors.Is(err, errMembershipPaymentDeclined) {
+				// Billing could not be reached, so try again on the next run
+				log.Printf("Failed to renew membership of user %d: %v", membership.userId, err)
+				continue
+			}
+		}
+
+		// Nothing to charge, no card, or the payment was declined
+		query := "UPDATE users SET membership_id = ?, scheduled_membership_id = NULL, membership_renews_at = NULL WHERE user_id = ? AND membership_renews_at = ?"
+		if _, err := db.Exec(query, defaultMembership, membership.userId, membership.renewsAt); err != nil {
+			return renewed, downgraded, err
+		}
+		downgraded++
+		if target.MonthlyPrice > 0 {
+			go func(userId int, membershipId string) {
+				if err := notifyUser(userId, "membership_downgraded", map[string]interface{}{"MembershipID": membershipId, "DefaultMembershipID": defaultMembership}); err != nil {
+					log.Println("Failed to send membership downgrade notice:", err)
+				}
+			}(membership.userId, target.MembershipId)
+		}
+	}
+	return renewed, downgraded, nil
+}
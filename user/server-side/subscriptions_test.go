@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"shared/money"
+)
+
+func TestUpgradeCharge(t *testing.T) {
+	period := 30 * 24 * time.Hour
+	key := "membership-upgrade-3-2024-12-31 00:00:00-VIP-4"
+	pending := money.Money(12_34)
+	tests := []struct {
+		name          string
+		currentPrice  money.Money
+		targetPrice   money.Money
+		remaining     time.Duration
+		pendingKey    sql.NullString
+		pendingCharge *money.Money
+		want          money.Money
+		wantProrated  bool
+	}{
+		{"mid-period upgrade", 20_00, 50_00, 15 * 24 * time.Hour, sql.NullString{}, nil, 15_00, true},
+		{"upgrade with a day left", 20_00, 50_00, 24 * time.Hour, sql.NullString{}, nil, 1_00, true},
+		{"remaining longer than a period", 20_00, 50_00, 45 * 24 * time.Hour, sql.NullString{}, nil, 30_00, true},
+		{"expired period", 20_00, 50_00, -time.Hour, sql.NullString{}, nil, 50_00, false},
+		{"from the free tier", 0, 50_00, 15 * 24 * time.Hour, sql.NullString{}, nil, 50_00, false},
+		{"pending charge replayed", 20_00, 50_00, 14 * 24 * time.Hour, sql.NullString{String: key, Valid: true}, &pending, 12_34, true},
+		{"pending charge of another upgrade", 20_00, 50_00, 15 * 24 * time.Hour, sql.NullString{String: "membership-upgrade-3-none-VIP-4", Valid: true}, &pending, 15_00, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, prorated := upgradeCharge(tt.currentPrice, tt.targetPrice, tt.remaining, period, key, tt.pendingKey, tt.pendingCharge)
+			if got != tt.want || prorated != tt.wantProrated {
+				t.Errorf("upgradeCharge = %v (prorated %t), want %v (prorated %t)", got, prorated, tt.want, tt.wantProrated)
+			}
+		})
+	}
+}
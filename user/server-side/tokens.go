@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"shared/auth"
+)
+
+// Lifetimes of the issued tokens, configurable through the environment
+var (
+	accessTokenTTL  = getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = getEnvDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour)
+)
+
+// Pair of tokens returned on login, verification and refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Read a duration (e.g. "15m") from the environment, falling back to the default if unset or invalid
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+	return duration
+}
+
+// Read an integer from the environment, falling back to the default if unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Generate a random identifier for a refresh token
+func newTokenID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Issue a new access token and a new refresh token for the user, recording the refresh token
+func issueTokens(userID int) (*TokenPair, error) {
+	// The role is read on every issue, so a changed role applies from the next refresh
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE user_id = ?", userID).Scan(&role); err != nil {
+		return nil, err
+	}
+
+	subject := jwt.RegisteredClaims{Subject: strconv.Itoa(userID)}
+	accessToken, err := auth.SignToken(auth.Claims{UserID: userID, Role: role, TokenType: "access", RegisteredClaims: subject}, accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh tokens carry an id so they can be revoked and rotated
+	tokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	subject.ID = tokenID
+	refreshToken, err := auth.SignToken(auth.Claims{UserID: userID, Role: role, TokenType: "refresh", RegisteredClaims: subject}, refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("INSERT INTO refresh_tokens (token_id, user_id, expires_at) VALUES (?, ?, ?)", tokenID, userID, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Revoke every refresh token of the user, e.g. when a revoked token is reused
+func revokeUserTokens(userID int) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = ? AND revoked = FALSE", userID)
+	return err
+}
+
+// Exchange a valid refresh token for a new token pair, revoking the old refresh token
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	type Response struct {
+		Message string `json:"message"`
+		UserId  int    `json:"user_id,omitempty"`
+		*TokenPair
+	}
+
+	// Read the refresh token from the request body
+	var refreshRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&refreshRequest); err != nil || refreshRequest.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid refresh request"})
+		return
+	}
+	defer r.Body.Close()
+
+	// Verify the signature, expiry and type of the token
+	claims, err := auth.ParseToken(refreshRequest.RefreshToken, "refresh")
+	if err != nil || claims.ID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid or expired refresh token"})
+		return
+	}
+
+	// Revoke the token, only succeeding if it was still active
+	result, err := db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE token_id = ? AND user_id = ? AND revoked = FALSE AND expires_at > NOW()", claims.ID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		// A signed but inactive token being replayed means it may have leaked, so end every session of the user
+		var revoked bool
+		err = db.QueryRow("SELECT revoked FROM refresh_tokens WHERE token_id = ?", claims.ID).Scan(&revoked)
+		if err == nil && revoked {
+			if err := revokeUserTokens(claims.UserID); err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{Message: "Invalid or expired refresh token"})
+		return
+	}
+
+	// Issue the rotated pair
+	tokens, err := issueTokens(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Message: "Token refreshed successfully", UserId: claims.UserID, TokenPair: tokens})
+}
+
+// Log the user out by revoking their refresh token
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Read the refresh token from the request body
+	var logoutRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&logoutRequest); err != nil || logoutRequest.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid logout request"})
+		return
+	}
+	defer r.Body.Close()
+
+	// The refresh token must belong to the authenticated user
+	claims, err := auth.ParseToken(logoutRequest.RefreshToken, "refresh")
+	if err != nil || !auth.OwnsResource(r, claims.UserID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{"Invalid or expired refresh token"})
+		return
+	}
+
+	// Revoke the token
+	_, err = db.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE token_id = ?", claims.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"User logged out successfully"})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"shared/auth"
+)
+
+// Verification code limits, configurable through the environment
+var (
+	// How long a code can be used after it is sent
+	verificationCodeTTL = getEnvDuration("VERIFICATION_CODE_TTL", 15*time.Minute)
+	// Wrong guesses allowed before the code is locked and a new one must be requested
+	verificationMaxAttempts = getEnvInt("VERIFICATION_MAX_ATTEMPTS", 5)
+	// Minimum time between two codes sent to the same user
+	verificationResendCooldown = getEnvDuration("VERIFICATION_RESEND_COOLDOWN", time.Minute)
+)
+
+// Generate a random 6-digit verification code, zero-padded
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// Hash a verification code for storage; only the hash is kept in the database. It is keyed with the
+// server secret, as a 6-digit code hashed on its own could be recovered by trying every code.
+func hashVerificationCode(code string) (string, error) {
+	return auth.KeyedHash("verification_code", code)
+}
+
+// Issue a new verification code to the user, replacing any previous one, and send it to them
+func issueVerificationCode(userId int) error {
+	code, err := newVerificationCode()
+	if err != nil {
+		return err
+	}
+	codeHash, err := hashVerificationCode(code)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE users
+		SET verification_code = ?, verification_expires_at = NOW() + INTERVAL ? SECOND, verification_attempts = 0, verification_sent_at = NOW()
+		WHERE user_id = ?`
+	if _, err := db.Exec(query, codeHash, int64(verificationCodeTTL.Seconds()), userId); err != nil {
+		return err
+	}
+	return notifyUser(userId, "verification", map[string]interface{}{"Code": code})
+}
+
+// Creating a post function to verify authentication
+func verifyUser(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+	var verificationRequest struct {
+		Email            string `json:"email"`
+		VerificationCode string `json:"verification_code"`
+	}
+	type LoginResponse struct {
+		Message string `json:"message"`
+		UserId  int    `json:"user_id"`
+		*TokenPair
+	}
+
+	// Unmarshal the JSON into the verificationRequest struct
+	err := json.NewDecoder(r.Body).Decode(&verificationRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := LoginResponse{
+			Message: "Invalid verification data",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// An unknown email, an already verified user and a wrong code all get the same answer,
+	// so the endpoint cannot be used to find out which emails are registered
+	invalidCode := func() {
+		w.WriteHeader(http.StatusUnauthorized)
+		response := LoginResponse{
+			Message: "Invalid verification code",
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+
+	// Retrieve the user by email, with whether their code is still valid
+	var userId int
+	var codeHash sql.NullString
+	var verified, active bool
+	query := `
+		SELECT user_id, verification_code, verified, COALESCE(verification_expires_at > NOW(), FALSE)
+		FROM users
+		WHERE email = ?`
+	err = db.QueryRow(query, verificationRequest.Email).Scan(&userId, &codeHash, &verified, &active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			invalidCode()
+		} else {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if verified {
+		invalidCode()
+		return
+	}
+	// Check the code has not expired
+	if !codeHash.Valid || !active {
+		w.WriteHeader(http.StatusGone)
+		response := LoginResponse{
+			Message: "Verification code has expired, please request a new one",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Use up an attempt before comparing, so concurrent guesses cannot exceed the limit
+	result, err := db.Exec("UPDATE users SET verification_attempts = verification_attempts + 1 WHERE user_id = ? AND verification_attempts < ?", userId, verificationMaxAttempts)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		response := LoginResponse{
+			Message: "Too many incorrect attempts, please request a new verification code",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Check if the verification code matches
+	submitted, err := hashVerificationCode(verificationRequest.VerificationCode)
+	if err != nil {
+		http.Error(w, "Failed to check verification code", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(submitted), []byte(codeHash.String)) != 1 {
+		invalidCode()
+		return
+	}
+
+	// Update the user verification status, unless the code was replaced in the meantime
+	result, err = db.Exec("UPDATE users SET verified = TRUE, verification_code = NULL, verification_expires_at = NULL, verification_attempts = 0 WHERE user_id = ? AND verification_code = ?", userId, codeHash.String)
+	if err != nil {
+		http.Error(w, "Failed to update user verification status", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Failed to update user verification status", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusGone)
+		response := LoginResponse{
+			Message: "Verification code has been replaced, please use the latest one",
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Issue the tokens so the user is signed in straight after verification
+	tokens, err := issueTokens(userId)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+	// Respond with success
+	w.WriteHeader(http.StatusOK)
+	response := LoginResponse{
+		Message:   "User verified successfully",
+		UserId:    userId,
+		TokenPair: tokens,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Send a new verification code to an unverified user, invalidating the previous one
+func resendVerificationCode(w http.ResponseWriter, r *http.Request) {
+	// Set the Content-Type once at the start
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	var resendRequest struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resendRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{"Invalid resend data"})
+		return
+	}
+
+	// The response is the same whether or not the email belongs to an unverified user, or a code was sent
+	// recently, so it cannot be used to find accounts
+	response := Response{"If an unverified account exists for this email, a new verification code has been sent to it"}
+
+	// Retrieve the user by email, with whether a code was sent too recently
+	var userId int
+	var verified, coolingDown bool
+	query := `
+		SELECT user_id, verified, COALESCE(verification_sent_at > NOW() - INTERVAL ? SECOND, FALSE)
+		FROM users
+		WHERE email = ?`
+	err := db.QueryRow(query, int64(verificationResendCooldown.Seconds()), resendRequest.Email).Scan(&userId, &verified, &coolingDown)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && !verified && !coolingDown {
+		// Sent in the background, as a slower answer would also show the account exists
+		go func() {
+			if err := issueVerificationCode(userId); err != nil {
+				log.Println("Failed to send verification code:", err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"shared/auth"
+)
+
+// Point the service at a mock database and an in-memory email transport for the test
+func setUpDBTest(t *testing.T) (sqlmock.Sqlmock, *memoryTransport) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "0123456789abcdef0123456789abcdef")
+	auth.LoadSecret()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &memoryTransport{}
+	previousDB, previousEmail, previousSMS := db, emailTransport, smsTransport
+	db, emailTransport, smsTransport = mockDB, transport, nil
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db, emailTransport, smsTransport = previousDB, previousEmail, previousSMS
+		mockDB.Close()
+	})
+	return mock, transport
+}
+
+// Matches any string argument and keeps it, e.g. to see which hash was stored
+type captureArg struct {
+	value *string
+}
+
+func (a captureArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*a.value = s
+	return ok
+}
+
+// Call a handler with a JSON body and decode its JSON response
+func callHandler(t *testing.T, handler http.HandlerFunc, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload)))
+	var response map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, response
+}
+
+// Expect the code to be issued to user 3 and return where its stored hash will be captured
+func expectIssueCode(mock sqlmock.Sqlmock) *string {
+	var stored string
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verification_code = ?, verification_expires_at = NOW() + INTERVAL ? SECOND, verification_attempts = 0, verification_sent_at = NOW() WHERE user_id = ?")).
+		WithArgs(captureArg{&stored}, int64(verificationCodeTTL.Seconds()), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name, email, phone FROM users WHERE user_id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "email", "phone"}).AddRow("Alice", "alice@example.com", "91234567"))
+	return &stored
+}
+
+// Expect verifyUser to look up alice@example.com
+func expectVerificationLookup(mock sqlmock.Sqlmock, codeHash string, verified, active bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, verification_code, verified, COALESCE(verification_expires_at > NOW(), FALSE)")).
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "verification_code", "verified", "active"}).AddRow(3, codeHash, verified, active))
+}
+
+// The code last sent by email
+func sentCode(t *testing.T, transport *memoryTransport) string {
+	t.Helper()
+	sent := transport.Sent()
+	if len(sent) == 0 {
+		t.Fatal("no verification code was sent")
+	}
+	code := regexp.MustCompile(`\b\d{6}\b`).FindString(sent[len(sent)-1].Body)
+	if code == "" {
+		t.Fatalf("no code in %q", sent[len(sent)-1].Body)
+	}
+	return code
+}
+
+// A new code is stored only as its keyed hash, to expire after the TTL, and sent to the user
+func TestIssueVerificationCode(t *testing.T) {
+	mock, transport := setUpDBTest(t)
+	stored := expectIssueCode(mock)
+
+	if err := issueVerificationCode(3); err != nil {
+		t.Fatal(err)
+	}
+	code := sentCode(t, transport)
+	want, err := hashVerificationCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stored != want || strings.Contains(*stored, code) {
+		t.Errorf("stored %q for code %s, want its hash %q", *stored, code, want)
+	}
+}
+
+// An expired code is refused without using up an attempt
+func TestVerifyUserExpiredCode(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	codeHash, err := hashVerificationCode("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVerificationLookup(mock, codeHash, false, false)
+
+	status, response := callHandler(t, verifyUser, map[string]string{"email": "alice@example.com", "verification_code": "123456"})
+	if status != http.StatusGone {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusGone)
+	}
+}
+
+// Once the attempts are used up the conditional UPDATE changes nothing and even the right code is refused
+func TestVerifyUserAttemptCap(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	codeHash, err := hashVerificationCode("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVerificationLookup(mock, codeHash, false, true)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verification_attempts = verification_attempts + 1 WHERE user_id = ? AND verification_attempts < ?")).
+		WithArgs(3, verificationMaxAttempts).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	status, response := callHandler(t, verifyUser, map[string]string{"email": "alice@example.com", "verification_code": "123456"})
+	if status != http.StatusTooManyRequests {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusTooManyRequests)
+	}
+}
+
+// A resent code replaces the previous one, which is then refused
+func TestResendInvalidatesPreviousCode(t *testing.T) {
+	mock, transport := setUpDBTest(t)
+	first := expectIssueCode(mock)
+	second := expectIssueCode(mock)
+	if err := issueVerificationCode(3); err != nil {
+		t.Fatal(err)
+	}
+	firstCode := sentCode(t, transport)
+	if err := issueVerificationCode(3); err != nil {
+		t.Fatal(err)
+	}
+	if *first == *second {
+		t.Fatal("the resent code has the same hash as the previous one")
+	}
+
+	// The database now holds the second code's hash
+	expectVerificationLookup(mock, *second, false, true)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verification_attempts = verification_attempts + 1")).
+		WithArgs(3, verificationMaxAttempts).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	status, response := callHandler(t, verifyUser, map[string]string{"email": "alice@example.com", "verification_code": firstCode})
+	if status != http.StatusUnauthorized {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusUnauthorized)
+	}
+}
+
+// A code replaced between checking it and marking the user verified does not verify them
+func TestVerifyUserCodeReplacedMeanwhile(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	codeHash, err := hashVerificationCode("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVerificationLookup(mock, codeHash, false, true)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verification_attempts = verification_attempts + 1")).
+		WithArgs(3, verificationMaxAttempts).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verified = TRUE")).
+		WithArgs(3, codeHash).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	status, response := callHandler(t, verifyUser, map[string]string{"email": "alice@example.com", "verification_code": "123456"})
+	if status != http.StatusGone {
+		t.Errorf("status = %d (%v), want %d", status, response["message"], http.StatusGone)
+	}
+}
+
+// Unknown emails get the same answers as a wrong code and a resend to a real account
+func TestVerificationUnknownEmail(t *testing.T) {
+	mock, _ := setUpDBTest(t)
+	codeHash, err := hashVerificationCode("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, verification_code, verified")).
+		WithArgs("nobody@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "verification_code", "verified", "active"}))
+	unknownStatus, unknown := callHandler(t, verifyUser, map[string]string{"email": "nobody@example.com", "verification_code": "654321"})
+	expectVerificationLookup(mock, codeHash, false, true)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET verification_attempts = verification_attempts + 1")).
+		WithArgs(3, verificationMaxAttempts).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	wrongStatus, wrong := callHandler(t, verifyUser, map[string]string{"email": "alice@example.com", "verification_code": "654321"})
+	if unknownStatus != wrongStatus || unknown["message"] != wrong["message"] {
+		t.Errorf("unknown email got %d %v, wrong code got %d %v", unknownStatus, unknown["message"], wrongStatus, wrong["message"])
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, verified")).
+		WithArgs(int64(verificationResendCooldown.Seconds()), "nobody@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "verified", "cooling_down"}))
+	unknownStatus, unknown = callHandler(t, resendVerificationCode, map[string]string{"email": "nobody@example.com"})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, verified")).
+		WithArgs(int64(verificationResendCooldown.Seconds()), "alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "verified", "cooling_down"}).AddRow(3, true, false))
+	verifiedStatus, verified := callHandler(t, resendVerificationCode, map[string]string{"email": "alice@example.com"})
+	if unknownStatus != http.StatusOK || unknownStatus != verifiedStatus || unknown["message"] != verified["message"] {
+		t.Errorf("unknown email got %d %v, verified user got %d %v", unknownStatus, unknown["message"], verifiedStatus, verified["message"])
+	}
+}
@@ -3,14 +3,17 @@ CREATE DATABASE user_svc_db;
 
 USE user_svc_db;
 
--- Attributes of the table (membership_id, hourly_rate_discount, priority_access, booking_limit)
+-- Attributes of the table (membership_id, hourly_rate_discount, priority_access, booking_limit, booking_period, max_active_bookings, monthly_price)
 CREATE TABLE memberships (
     membership_id VARCHAR(20) PRIMARY KEY CHECK (membership_id IN ('Basic', 'Premium', 'VIP')),
     hourly_rate_discount DECIMAL(5, 2) NOT NULL DEFAULT 0.00, 
-    booking_limit INT NOT NULL DEFAULT 0 
+    booking_limit INT NOT NULL DEFAULT 0, -- bookings allowed per booking period
+    booking_period ENUM('calendar_month', 'rolling_30_days') NOT NULL DEFAULT 'calendar_month',
+    max_active_bookings INT NOT NULL DEFAULT 1, -- upcoming or ongoing bookings allowed at once
+    monthly_price DECIMAL(10, 2) NOT NULL DEFAULT 0.00 -- charged every membership period, 0 for free tiers
 );
 
--- Attributes of the table (user_id, name, email, phone, dob, hashed-password, membership_id, verification_code, verified) 
+-- Attributes of the table (user_id, name, email, phone, dob, hashed-password, membership_id, membership_renews_at, membership_card_id, scheduled_membership_id, pending_membership_charge_key, pending_membership_charge, verification_code, verification_expires_at, verification_attempts, verification_sent_at, verified, role) 
 CREATE TABLE users (
 	user_id INT PRIMARY KEY auto_increment,
 	email VARCHAR(255) NOT NULL UNIQUE,
@@ -19,24 +22,68 @@ CREATE TABLE users (
 	dob DATE NOT NULL,  
 	password VARCHAR(255) NOT NULL,
 	membership_id VARCHAR(20) DEFAULT 'Basic',
+    membership_renews_at DATETIME NULL, -- end of the paid period, NULL for free tiers
+    membership_card_id INT NULL, -- card in the billing service charged on renewal
+    scheduled_membership_id VARCHAR(20) NULL, -- downgrade taking effect at the end of the paid period
+    pending_membership_charge_key VARCHAR(255) NULL, -- upgrade charge that may have gone through, resent with the same Idempotency-Key and amount on retry
+    pending_membership_charge DECIMAL(10, 2) NULL,
 	license_number VARCHAR(50),
     license_expiry DATE,        
-	verification_code VARCHAR(6),
+	verification_code CHAR(64), -- HMAC-SHA256 of the latest code sent, keyed with JWT_SECRET, cleared once verified
+    verification_expires_at DATETIME NULL,
+    verification_attempts INT NOT NULL DEFAULT 0,
+    verification_sent_at DATETIME NULL,
     verified BOOLEAN DEFAULT FALSE,
+    role ENUM('user', 'admin') NOT NULL DEFAULT 'user',
     last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-	CONSTRAINT fk_memberships FOREIGN KEY (membership_id) REFERENCES memberships(membership_id) -- reference to membership table
+	CONSTRAINT fk_memberships FOREIGN KEY (membership_id) REFERENCES memberships(membership_id), -- reference to membership table
+    CONSTRAINT fk_scheduled_memberships FOREIGN KEY (scheduled_membership_id) REFERENCES memberships(membership_id)
+);
+
+-- Attributes of the table (token_id, user_id, expires_at, revoked, created_at)
+CREATE TABLE refresh_tokens (
+    token_id CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_refresh_tokens_user FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+-- Attributes of the table (token_hash, user_id, expires_at, used_at, created_at)
+CREATE TABLE password_reset_tokens (
+    token_hash CHAR(64) PRIMARY KEY, -- SHA-256 hash of the token sent to the user
+    user_id INT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL, -- set when the token is used or replaced by a newer one
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_password_reset_tokens_user FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+-- Attributes of the table (attempt_key, failures, last_failure, locked_until)
+-- failed logins are counted per account ('email:...') and per client ('ip:...')
+CREATE TABLE login_attempts (
+    attempt_key VARCHAR(300) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure DATETIME NOT NULL,
+    locked_until DATETIME NULL
 );
 
 -- Insert values into memberships table
-INSERT INTO memberships (membership_id, hourly_rate_discount, booking_limit) 
+INSERT INTO memberships (membership_id, hourly_rate_discount, booking_limit, booking_period, max_active_bookings, monthly_price) 
 VALUES 
-    ('Basic', 0.00, 3),  -- No discount for Basic membership
-    ('Premium', 10.00, 6),  -- 10% discount for Premium
-    ('VIP', 20.00, 10);  -- 20% discount for VIP
+    ('Basic', 0.00, 3, 'calendar_month', 1, 0.00),  -- No discount for Basic membership, free
+    ('Premium', 10.00, 6, 'calendar_month', 2, 19.90),  -- 10% discount for Premium
+    ('VIP', 20.00, 10, 'rolling_30_days', 3, 39.90);  -- 20% discount for VIP
 
 -- Insert values into users table
-INSERT INTO users (email, name, phone, dob, password, membership_id, license_number, license_expiry, verification_code, verified) 
+INSERT INTO users (email, name, phone, dob, password, membership_id, membership_renews_at, membership_card_id, license_number, license_expiry, verification_code, verified) 
+VALUES 
+('john.doe@example.com', 'John Doe', '98765432', '1990-05-12', '$2a$08$xfW2Yas5NJXl1scqBSLef.Evm8FwrXYmQlZAqqYpoZIFBfYssp5wO', 'Basic', NULL, NULL, 'SG12345678', '2025-05-12', NULL, TRUE), -- password: p@ssw0rd
+('jane.smith@example.com', 'Jane Smith', '91234567', '1985-09-23', '$2a$08$ZvJIeHkCQb25vDGtgPR6deL6.L5nSOwQs8.2F0K8qd64Y32DtO5nm', 'Premium', NOW() + INTERVAL 30 DAY, 2, 'SG87654321', '2026-03-15', NULL, TRUE), -- password789
+('alice.johnson@example.com', 'Alice Johnson', '92345678', '2000-02-18', '$2a$08$Ak5mmhVaLwLmrGd54wCQJOFf3tMG.ViZwe2WUNiHX0Iony2ZF9KnG', 'VIP', NOW() + INTERVAL 30 DAY, 3, 'SG13579246', '2024-12-31', NULL, FALSE); -- password456, has to request a verification code
+
+-- Administrator account, can unlock accounts locked out by failed logins
+INSERT INTO users (email, name, phone, dob, password, membership_id, verified, role) 
 VALUES 
-('john.doe@example.com', 'John Doe', '98765432', '1990-05-12', '$2a$08$xfW2Yas5NJXl1scqBSLef.Evm8FwrXYmQlZAqqYpoZIFBfYssp5wO', 'Basic', 'SG12345678', '2025-05-12', '123456', TRUE), -- password: p@ssw0rd
-('jane.smith@example.com', 'Jane Smith', '91234567', '1985-09-23', '$2a$08$ZvJIeHkCQb25vDGtgPR6deL6.L5nSOwQs8.2F0K8qd64Y32DtO5nm', 'Premium', 'SG87654321', '2026-03-15', '654321', TRUE), -- password789
-('alice.johnson@example.com', 'Alice Johnson', '92345678', '2000-02-18', '$2a$08$Ak5mmhVaLwLmrGd54wCQJOFf3tMG.ViZwe2WUNiHX0Iony2ZF9KnG', 'VIP', 'SG13579246', '2024-12-31', '987654', FALSE); -- password456
+('admin@example.com', 'Administrator', '90000000', '1980-01-01', '$2a$08$pTnzqV7AkANtliAwqmfqOeWxn.oAbAEdE5cy1n0TNmal7crA7UElO', 'Basic', TRUE, 'admin'); -- adm1nP@ss
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest period a recurring availability rule may cover
+const maxAvailabilityRuleDays = 366
+
+// Days of the week as stored in availability_rules.weekdays
+var weekdayNames = map[string]time.Weekday{
+	"Mon": time.Monday, "Tue": time.Tuesday, "Wed": time.Wednesday, "Thu": time.Thursday,
+	"Fri": time.Friday, "Sat": time.Saturday, "Sun": time.Sunday,
+}
+
+// Struct to represent an availability window of a vehicle
+type AvailabilityWindow struct {
+	ScheduleID int64  `json:"schedule_id"`
+	VehicleID  int    `json:"vehicle_id"`
+	Date       string `json:"date"`
+	StartTime  string `json:"start_time"`
+	EndTime    string `json:"end_time"`
+	RuleID     *int64 `json:"rule_id"`  // rule the window was generated from, if any
+	Bookings   int    `json:"bookings"` // bookings made in the window that still hold time
+}
+
+// Struct to represent a recurring availability rule, e.g. weekdays 08:00 to 20:00 for 8 weeks
+type AvailabilityRule struct {
+	RuleID    int64    `json:"rule_id"`
+	VehicleID int      `json:"vehicle_id"`
+	Weekdays  []string `json:"weekdays"`
+	StartTime string   `json:"start_time"`
+	EndTime   string   `json:"end_time"`
+	ValidFrom string   `json:"valid_from"`
+	ValidTo   string   `json:"valid_to"`
+}
+
+// Struct to represent a period a vehicle is out for maintenance and cannot be booked
+type MaintenanceBlock struct {
+	BlockID   int64  `json:"block_id"`
+	VehicleID int    `json:"vehicle_id"`
+	StartAt   string `json:"start_at"`
+	EndAt     string `json:"end_at"`
+	Reason    string `json:"reason"`
+}
+
+// Today's date where the vehicles are booked
+func bookingToday() (time.Time, error) {
+	loc, err := bookingLocation()
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// Parse and check the times of an availability window, returning them as "15:04:05"
+func parseWindowTimes(startTime, endTime string) (string, string, string) {
+	start, err := parseTimeOfDay(startTime)
+	if err != nil {
+		return "", "", "Invalid start time"
+	}
+	end, err := parseTimeOfDay(endTime)
+	if err != nil {
+		return "", "", "Invalid end time"
+	}
+	if !end.After(start) {
+		return "", "", "End time must be after start time"
+	}
+	return start.Format("15:04:05"), end.Format("15:04:05"), ""
+}
+
+// Parse a maintenance time, "2006-01-02 15:04" with optional seconds, as wall-clock booking time
+func parseBlockTime(value string) (time.Time, error) {
+	parsed, err := time.Parse("2006-01-02 15:04:05", value)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02 15:04", value)
+}
+
+// Lock a vehicle against concurrent bookings and availability changes, and check it can still be scheduled.
+// Returns the message to respond with and its status when it cannot.
+func lockVehicleForScheduling(tx *sql.Tx, vehicleId string) (string, int, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM vehicles WHERE vehicle_id = ? FOR UPDATE", vehicleId).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "Vehicle not found", http.StatusNotFound, nil
+		}
+		return "", 0, err
+	}
+	if status == vehicleStatusDecommissioned {
+		return "Decommissioned vehicles cannot be scheduled", http.StatusConflict, nil
+	}
+	return "", 0, nil
+}
+
+// Get the availability windows of a vehicle between two dates, keyed by date
+func getWindowsByDate(tx *sql.Tx, vehicleId string, fromDate, toDate string) (map[string][]TimeSlot, error) {
+	rows, err := tx.Query("SELECT date, start_time, end_time FROM schedules WHERE vehicle_id = ? AND date BETWEEN ? AND ?", vehicleId, fromDate, toDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := make(map[string][]TimeSlot)
+	for rows.Next() {
+		var date string
+		var window TimeSlot
+		if err := rows.Scan(&date, &window.StartTime, &window.EndTime); err != nil {
+			return nil, err
+		}
+		windows[date] = append(windows[date], window)
+	}
+	return windows, rows.Err()
+}
+
+// Check whether a window overlaps any of the existing ones on its date; times are all "15:04:05"
+func overlapsWindows(window TimeSlot, existing []TimeSlot) bool {
+	for _, other := range existing {
+		if window.StartTime < other.EndTime && window.EndTime > other.StartTime {
+			return true
+		}
+	}
+	return false
+}
+
+// List the availability windows of a vehicle from ?from (default today) to ?to (admins only)
+func listVehicleSchedules(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message   string               `json:"message"`
+		Schedules []AvailabilityWindow `json:"schedules"`
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	fromDate := r.URL.Query().Get("from")
+	toDate := r.URL.Query().Get("to")
+	if fromDate == "" {
+		today, err := bookingToday()
+		if err != nil {
+			http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+			return
+		}
+		fromDate = today.Format("2006-01-02")
+	}
+	if toDate == "" {
+		toDate = "9999-12-31"
+	}
+	if !isValidDate(fromDate) || !isValidDate(toDate) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid date format", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	query := `
+		SELECT s.schedule_id, s.vehicle_id, s.date, s.start_time, s.end_time, s.rule_id,
+			COUNT(CASE WHEN b.status IN ('Pending', 'Confirmed', 'InProgress', 'Completed') THEN 1 END)
+		FROM schedules s
+		LEFT JOIN bookings b ON b.schedule_id = s.schedule_id
+		WHERE s.vehicle_id = ? AND s.date BETWEEN ? AND ?
+		GROUP BY s.schedule_id
+		ORDER BY s.date, s.start_time`
+	rows, err := db.Query(query, vehicleId, fromDate, toDate)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	schedules := []AvailabilityWindow{}
+	for rows.Next() {
+		var window AvailabilityWindow
+		if err := rows.Scan(&window.ScheduleID, &window.VehicleID, &window.Date, &window.StartTime, &window.EndTime, &window.RuleID, &window.Bookings); err != nil {
+			http.Error(w, "Error reading schedule data", http.StatusInternalServerError)
+			return
+		}
+		schedules = append(schedules, window)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Schedules found", schedules}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Publish a single availability window for a vehicle (admins only)
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message  string              `json:"message"`
+		Schedule *AvailabilityWindow `json:"schedule"`
+	}
+
+	var window AvailabilityWindow
+	if err := json.NewDecoder(r.Body).Decode(&window); err != nil || !isValidDate(window.Date) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid schedule data", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	startTime, endTime, message := parseWindowTimes(window.StartTime, window.EndTime)
+	if message != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{message, nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	window.StartTime, window.EndTime = startTime, endTime
+	today, err := bookingToday()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	if window.Date < today.Format("2006-01-02") {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Schedules cannot be published in the past", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	message, status, err := lockVehicleForScheduling(tx, vehicleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		w.WriteHeader(status)
+		response := Response{message, nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Windows of the same vehicle must not overlap, or the same time could be booked twice
+	existing, err := getWindowsByDate(tx, vehicleId, window.Date, window.Date)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if overlapsWindows(TimeSlot{window.StartTime, window.EndTime}, existing[window.Date]) {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Schedule overlaps an existing availability window", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	result, err := tx.Exec("INSERT INTO schedules (vehicle_id, date, start_time, end_time) VALUES (?, ?, ?, ?)", vehicleId, window.Date, window.StartTime, window.EndTime)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	window.ScheduleID, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	window.VehicleID, _ = strconv.Atoi(vehicleId)
+	window.RuleID = nil
+	window.Bookings = 0
+
+	w.WriteHeader(http.StatusCreated)
+	response := Response{"Schedule created", &window}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Withdraw an availability window that nobody has booked (admins only)
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	scheduleId := mux.Vars(r)["scheduleId"]
+	var vehicleId int
+	err := db.QueryRow("SELECT vehicle_id FROM schedules WHERE schedule_id = ?", scheduleId).Scan(&vehicleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{"Schedule not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the vehicle so no booking can be made in the window while it is removed
+	var lockedVehicleID int
+	if err := tx.QueryRow("SELECT vehicle_id FROM vehicles WHERE vehicle_id = ? FOR UPDATE", vehicleId).Scan(&lockedVehicleID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Bookings keep a reference to their window, so windows that were ever booked stay
+	var bookings int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM bookings WHERE schedule_id = ?", scheduleId).Scan(&bookings); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if bookings > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{"Schedule has bookings and cannot be deleted"})
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM schedules WHERE schedule_id = ?", scheduleId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Schedule deleted"})
+}
+
+// Dates from validFrom to validTo (inclusive) falling on the given weekdays
+func expandRuleDates(weekdays []time.Weekday, validFrom, validTo time.Time) []string {
+	var dates []string
+	for day := validFrom; !day.After(validTo); day = day.AddDate(0, 0, 1) {
+		for _, weekday := range weekdays {
+			if day.Weekday() == weekday {
+				dates = append(dates, day.Format("2006-01-02"))
+				break
+			}
+		}
+	}
+	return dates
+}
+
+// Publish recurring availability, e.g. {"weekdays": ["Mon", "Tue", "Wed", "Thu", "Fri"], "start_time": "08:00",
+// "end_time": "20:00", "weeks": 8}, expanding it into a window on each matching date (admins only).
+// The period starts at valid_from (default today) and ends at valid_to or after the given number of weeks.
+// If any window would overlap an existing one, nothing is created.
+func createAvailabilityRule(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message          string            `json:"message"`
+		Rule             *AvailabilityRule `json:"rule"`
+		WindowsCreated   int               `json:"windows_created"`
+		ConflictingDates []string          `json:"conflicting_dates,omitempty"`
+	}
+
+	var ruleRequest struct {
+		AvailabilityRule
+		Weeks int `json:"weeks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&ruleRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid availability rule data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	rule := ruleRequest.AvailabilityRule
+
+	// Check the days and times
+	var weekdays []time.Weekday
+	for _, name := range rule.Weekdays {
+		weekday, ok := weekdayNames[name]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			response := Response{Message: "Weekdays must be among Mon, Tue, Wed, Thu, Fri, Sat and Sun"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		weekdays = append(weekdays, weekday)
+	}
+	if len(weekdays) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "At least one weekday is required"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	startTime, endTime, message := parseWindowTimes(rule.StartTime, rule.EndTime)
+	if message != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: message}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	rule.StartTime, rule.EndTime = startTime, endTime
+
+	// Work out the period the rule covers
+	today, err := bookingToday()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	validFrom := today
+	if rule.ValidFrom != "" {
+		validFrom, err = time.Parse("2006-01-02", rule.ValidFrom)
+		if err != nil || validFrom.Before(today) {
+			w.WriteHeader(http.StatusBadRequest)
+			response := Response{Message: "Valid from must be a date from today onwards"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	var validTo time.Time
+	switch {
+	case rule.ValidTo != "":
+		validTo, err = time.Parse("2006-01-02", rule.ValidTo)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			response := Response{Message: "Invalid valid to date"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	case ruleRequest.Weeks > 0:
+		validTo = validFrom.AddDate(0, 0, 7*ruleRequest.Weeks-1)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Either valid to or a number of weeks is required"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if validTo.Before(validFrom) || validTo.Sub(validFrom) >= maxAvailabilityRuleDays*24*time.Hour {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "An availability rule must cover between 1 and 366 days"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	rule.ValidFrom = validFrom.Format("2006-01-02")
+	rule.ValidTo = validTo.Format("2006-01-02")
+	dates := expandRuleDates(weekdays, validFrom, validTo)
+	if len(dates) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "None of the weekdays fall within the period"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	message, status, err := lockVehicleForScheduling(tx, vehicleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		w.WriteHeader(status)
+		response := Response{Message: message}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Check none of the windows overlaps an existing one
+	existing, err := getWindowsByDate(tx, vehicleId, rule.ValidFrom, rule.ValidTo)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var conflicting []string
+	for _, date := range dates {
+		if overlapsWindows(TimeSlot{rule.StartTime, rule.EndTime}, existing[date]) {
+			conflicting = append(conflicting, date)
+		}
+	}
+	if len(conflicting) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Availability overlaps existing windows, nothing was created", ConflictingDates: conflicting}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Save the rule and expand it into bookable windows
+	query := "INSERT INTO availability_rules (vehicle_id, weekdays, start_time, end_time, valid_from, valid_to) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, vehicleId, strings.Join(rule.Weekdays, ","), rule.StartTime, rule.EndTime, rule.ValidFrom, rule.ValidTo)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rule.RuleID, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, date := range dates {
+		_, err := tx.Exec("INSERT INTO schedules (vehicle_id, date, start_time, end_time, rule_id) VALUES (?, ?, ?, ?, ?)", vehicleId, date, rule.StartTime, rule.EndTime, rule.RuleID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rule.VehicleID, _ = strconv.Atoi(vehicleId)
+
+	w.WriteHeader(http.StatusCreated)
+	response := Response{Message: "Availability rule created", Rule: &rule, WindowsCreated: len(dates)}
+	json.NewEncoder(w).Encode(response)
+}
+
+// List the recurring availability rules of a vehicle (admins only)
+func listAvailabilityRules(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string             `json:"message"`
+		Rules   []AvailabilityRule `json:"rules"`
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	query := "SELECT rule_id, vehicle_id, weekdays, start_time, end_time, valid_from, valid_to FROM availability_rules WHERE vehicle_id = ? ORDER BY valid_from, rule_id"
+	rows, err := db.Query(query, vehicleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []AvailabilityRule{}
+	for rows.Next() {
+		var rule AvailabilityRule
+		var weekdays string
+		if err := rows.Scan(&rule.RuleID, &rule.VehicleID, &weekdays, &rule.StartTime, &rule.EndTime, &rule.ValidFrom, &rule.ValidTo); err != nil {
+			http.Error(w, "Error reading availability rule data", http.StatusInternalServerError)
+			return
+		}
+		rule.Weekdays = strings.Split(weekdays, ",")
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Availability rules found", rules}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Delete a recurring availability rule with its windows from today on (admins only).
+// Past windows and those that were booked are kept as one-off windows, so bookings are unaffected.
+func deleteAvailabilityRule(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message        string `json:"message"`
+		WindowsRemoved int64  `json:"windows_removed"`
+		WindowsKept    int64  `json:"windows_kept"`
+	}
+
+	ruleId := mux.Vars(r)["ruleId"]
+	var vehicleId int
+	err := db.QueryRow("SELECT vehicle_id FROM availability_rules WHERE rule_id = ?", ruleId).Scan(&vehicleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Response{Message: "Availability rule not found"})
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	today, err := bookingToday()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the vehicle so no booking can be made in the windows while they are removed
+	var lockedVehicleID int
+	if err := tx.QueryRow("SELECT vehicle_id FROM vehicles WHERE vehicle_id = ? FOR UPDATE", vehicleId).Scan(&lockedVehicleID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Remove the upcoming windows nobody booked, then detach the rest from the rule
+	query := `
+		DELETE s FROM schedules s
+		LEFT JOIN bookings b ON b.schedule_id = s.schedule_id
+		WHERE s.rule_id = ? AND s.date >= ? AND b.booking_id IS NULL`
+	result, err := tx.Exec(query, ruleId, today.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	result, err = tx.Exec("UPDATE schedules SET rule_id = NULL WHERE rule_id = ?", ruleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	kept, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM availability_rules WHERE rule_id = ?", ruleId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Availability rule deleted", removed, kept})
+}
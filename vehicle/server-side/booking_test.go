@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+)
+
+// These tests need a MySQL server they can create databases on, given as a DSN such as
+// "root:password@tcp(127.0.0.1:3306)/". They are skipped when TEST_MYSQL_DSN is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN is not set")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the schema into a scratch database of its own
+	schema, err := os.ReadFile("../vehicle_svc_db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("vehicle_svc_test_%d", time.Now().UnixNano())
+	cfg.DBName = ""
+	cfg.MultiStatements = true
+	admin, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err := admin.Exec(strings.ReplaceAll(string(schema), "vehicle_svc_db", name)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cleanup, err := sql.Open("mysql", cfg.FormatDSN())
+		if err == nil {
+			cleanup.Exec("DROP DATABASE " + name)
+			cleanup.Close()
+		}
+	})
+
+	cfg.DBName = name
+	cfg.MultiStatements = false
+	testDB, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	return testDB
+}
+
+// Point the service at a test database and a stand-in user service that knows every user
+func setUpBookingTest(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "vehicle-service-test-secret-32-bytes")
+	auth.LoadSecret()
+
+	previousDB, previousURL := db, userServiceURL
+	db = openTestDB(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/validate-user/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		fmt.Sscan(mux.Vars(r)["id"], &id)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "User is valid",
+			"user":    User{UserID: id, MembershipId: "Basic", LicenseExpiry: "2099-12-31", Verified: true},
+		})
+	})
+	router.HandleFunc("/api/v1/membership/{id}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    "Membership found",
+			"membership": Membership{MembershipId: "Basic", BookingLimit: 100, BookingPeriod: "calendar_month", MaxActiveBookings: 100},
+		})
+	})
+	userService := httptest.NewServer(router)
+	userServiceURL = userService.URL
+
+	t.Cleanup(func() {
+		userService.Close()
+		db, userServiceURL = previousDB, previousURL
+	})
+}
+
+// Send a booking request as the given user
+func requestBooking(t *testing.T, handler http.Handler, userID int, scheduleID int64, body string) int {
+	token, err := auth.SignToken(auth.Claims{UserID: userID, Role: "user", TokenType: "access"}, time.Minute)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	url := fmt.Sprintf("/api/v1/create-booking-session/%d/%d", userID, scheduleID)
+	r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestConcurrentBookingsOfTheSameSlot(t *testing.T) {
+	setUpBookingTest(t)
+
+	// A vehicle available all day tomorrow
+	result, err := db.Exec("INSERT INTO vehicles (type, brand, model, license_plate, hourly_rate) VALUES ('Sedan', 'Test', 'Race', 'TEST1', 20.00)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehicleID, _ := result.LastInsertId()
+	date := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	result, err = db.Exec("INSERT INTO schedules (vehicle_id, date, start_time, end_time) VALUES (?, ?, '08:00:00', '20:00:00')", vehicleID, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleID, _ := result.LastInsertId()
+
+	router := mux.NewRouter()
+	router.Use(auth.Authenticate)
+	router.HandleFunc("/api/v1/create-booking-session/{id}/{scheduleId}", createBookingSession).Methods("POST")
+
+	// Different users ask for overlapping times at once, so only the slot can make them fail
+	const requests = 20
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	statuses := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			body := `{"start_time": "10:00", "end_time": "12:00"}`
+			if i%2 == 1 {
+				body = `{"start_time": "11:00", "end_time": "13:00"}`
+			}
+			statuses[i] = requestBooking(t, router, 1000+i, scheduleID, body)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != requests-1 {
+		t.Errorf("got statuses %v, want one %d and %d %d", counts, http.StatusCreated, requests-1, http.StatusConflict)
+	}
+
+	var booked int
+	if err := db.QueryRow("SELECT COUNT(*) FROM bookings WHERE schedule_id = ?", scheduleID).Scan(&booked); err != nil {
+		t.Fatal(err)
+	}
+	if booked != 1 {
+		t.Errorf("%d bookings were stored for the slot, want 1", booked)
+	}
+}
+
+// Point the service at a mock database, which checks the statements are run in order
+func setUpMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousDB := db
+	db = mockDB
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db = previousDB
+		mockDB.Close()
+	})
+	return mock
+}
+
+// claimTimeSlot locks the vehicle row before it counts overlapping bookings, so two
+// transactions claiming the same vehicle count one after the other, and stops at a retired vehicle
+func TestClaimTimeSlotLocksBeforeCounting(t *testing.T) {
+	start, _ := time.Parse("15:04", "10:00")
+	end, _ := time.Parse("15:04", "12:00")
+	tests := []struct {
+		name        string
+		status      string
+		maintenance int
+		overlapping int
+		want        bool
+	}{
+		{"free", vehicleStatusActive, 0, 0, true},
+		{"overlapping booking", vehicleStatusActive, 0, 1, false},
+		{"maintenance", vehicleStatusActive, 1, 0, false},
+		{"retired vehicle", "Retired", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := setUpMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT vehicle_id, status FROM vehicles WHERE vehicle_id = ? FOR UPDATE")).
+				WithArgs("7").
+				WillReturnRows(sqlmock.NewRows([]string{"vehicle_id", "status"}).AddRow("7", tt.status))
+			if tt.status == vehicleStatusActive {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM maintenance_blocks")).
+					WithArgs("7", "2030-01-02 12:00:00", "2030-01-02 10:00:00").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.maintenance))
+				if tt.maintenance == 0 {
+					mock.ExpectQuery(regexp.QuoteMeta("FROM bookings b")).
+						WithArgs("7", "2030-01-02", int64(42), "12:00:00", "10:00:00").
+						WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.overlapping))
+				}
+			}
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			claimed, err := claimTimeSlot(tx, "7", "2030-01-02", start, end, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed != tt.want {
+				t.Errorf("claimed = %t, want %t", claimed, tt.want)
+			}
+		})
+	}
+}
+
+// A booking locks the user's quota row, creating it first so a user with no bookings yet is locked too,
+// before counting their bookings
+func TestLockBookingQuotaBeforeCounting(t *testing.T) {
+	mock := setUpMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO booking_quota (user_id) VALUES (?)")).
+		WithArgs("5").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM booking_quota WHERE user_id = ? FOR UPDATE")).
+		WithArgs("5").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("5"))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM bookings")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(rollingBookingWindow.Seconds()), "5").
+		WillReturnRows(sqlmock.NewRows([]string{"used", "active", "until_oldest_leaves"}).AddRow(0, 0, nil))
+	mock.ExpectRollback()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := lockBookingQuota(tx, "5"); err != nil {
+		t.Fatal(err)
+	}
+	membership := &Membership{MembershipId: "Basic", BookingLimit: 3, BookingPeriod: bookingPeriodCalendarMonth, MaxActiveBookings: 2}
+	quota, err := countBookingQuota(tx, "5", membership)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Remaining != 3 || quota.ActiveRemaining != 2 {
+		t.Errorf("remaining = %d, active remaining = %d, want 3 and 2", quota.Remaining, quota.ActiveRemaining)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+
+	"shared/money"
+)
+
+// Statuses of a vehicle in the fleet. Only active vehicles can be booked; offline vehicles keep
+// their existing bookings, and decommissioned vehicles are retired for good.
+const (
+	vehicleStatusActive         = "Active"
+	vehicleStatusOffline        = "Offline"
+	vehicleStatusDecommissioned = "Decommissioned"
+)
+
+// Struct to represent a vehicle of the fleet
+type Vehicle struct {
+	VehicleID    int         `json:"vehicle_id"`
+	Type         string      `json:"type"`
+	Brand        string      `json:"brand"`
+	Model        string      `json:"model"`
+	LicensePlate string      `json:"license_plate"`
+	HourlyRate   money.Money `json:"hourly_rate"`
+	Status       string      `json:"status"`
+}
+
+// Struct to represent a booking moved to another vehicle on decommissioning
+type ReassignedBooking struct {
+	BookingID  int64 `json:"booking_id"`
+	ScheduleID int64 `json:"schedule_id"`
+	VehicleID  int   `json:"vehicle_id"`
+}
+
+// Normalise a vehicle's fields and check them, returning what is wrong or an empty string
+func validateVehicle(vehicle *Vehicle) string {
+	vehicle.Type = strings.TrimSpace(vehicle.Type)
+	vehicle.Brand = strings.TrimSpace(vehicle.Brand)
+	vehicle.Model = strings.TrimSpace(vehicle.Model)
+	vehicle.LicensePlate = strings.ToUpper(strings.TrimSpace(vehicle.LicensePlate))
+	switch {
+	case vehicle.Type == "" || vehicle.Brand == "" || vehicle.Model == "":
+		return "Type, brand and model are required"
+	case vehicle.LicensePlate == "" || len(vehicle.LicensePlate) > 20:
+		return "License plate is required and must be at most 20 characters"
+	case vehicle.HourlyRate <= 0:
+		return "Hourly rate must be positive"
+	}
+	return ""
+}
+
+// Check whether an error is MySQL rejecting a duplicate unique key, i.e. the license plate
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// Get a vehicle by id
+func getVehicleByID(q queryRower, vehicleId string) (*Vehicle, error) {
+	var vehicle Vehicle
+	query := "SELECT vehicle_id, type, brand, model, license_plate, hourly_rate, status FROM vehicles WHERE vehicle_id = ?"
+	err := q.QueryRow(query, vehicleId).Scan(&vehicle.VehicleID, &vehicle.Type, &vehicle.Brand, &vehicle.Model, &vehicle.LicensePlate, &vehicle.HourlyRate, &vehicle.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &vehicle, nil
+}
+
+// List every vehicle of the fleet with its status (admins only)
+func listFleetVehicles(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message  string    `json:"message"`
+		Vehicles []Vehicle `json:"vehicles"`
+	}
+
+	rows, err := db.Query("SELECT vehicle_id, type, brand, model, license_plate, hourly_rate, status FROM vehicles ORDER BY vehicle_id")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vehicles := []Vehicle{}
+	for rows.Next() {
+		var vehicle Vehicle
+		if err := rows.Scan(&vehicle.VehicleID, &vehicle.Type, &vehicle.Brand, &vehicle.Model, &vehicle.LicensePlate, &vehicle.HourlyRate, &vehicle.Status); err != nil {
+			http.Error(w, "Error reading vehicle data", http.StatusInternalServerError)
+			return
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Vehicles found", vehicles}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Add a vehicle to the fleet (admins only)
+func createVehicle(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string   `json:"message"`
+		Vehicle *Vehicle `json:"vehicle"`
+	}
+
+	var vehicle Vehicle
+	if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid vehicle data", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if message := validateVehicle(&vehicle); message != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{message, nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	vehicle.Status = vehicleStatusActive
+
+	query := "INSERT INTO vehicles (type, brand, model, license_plate, hourly_rate, status) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := db.Exec(query, vehicle.Type, vehicle.Brand, vehicle.Model, vehicle.LicensePlate, vehicle.HourlyRate, vehicle.Status)
+	if err != nil {
+		if isDuplicateKey(err) {
+			w.WriteHeader(http.StatusConflict)
+			response := Response{"A vehicle with this license plate already exists", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vehicleId, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vehicle.VehicleID = int(vehicleId)
+
+	w.WriteHeader(http.StatusCreated)
+	response := Response{"Vehicle created", &vehicle}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Edit a vehicle's details; fields left out keep their value (admins only).
+// A new hourly rate applies to new bookings, existing ones keep their price.
+func updateVehicle(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string   `json:"message"`
+		Vehicle *Vehicle `json:"vehicle"`
+	}
+
+	var updateRequest struct {
+		Type         *string      `json:"type"`
+		Brand        *string      `json:"brand"`
+		Model        *string      `json:"model"`
+		LicensePlate *string      `json:"license_plate"`
+		HourlyRate   *money.Money `json:"hourly_rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&updateRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid vehicle data", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	vehicle, err := getVehicleByID(db, vehicleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Vehicle not found", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if vehicle.Status == vehicleStatusDecommissioned {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Decommissioned vehicles cannot be edited", vehicle}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Apply the given fields and check the result
+	if updateRequest.Type != nil {
+		vehicle.Type = *updateRequest.Type
+	}
+	if updateRequest.Brand != nil {
+		vehicle.Brand = *updateRequest.Brand
+	}
+	if updateRequest.Model != nil {
+		vehicle.Model = *updateRequest.Model
+	}
+	if updateRequest.LicensePlate != nil {
+		vehicle.LicensePlate = *updateRequest.LicensePlate
+	}
+	if updateRequest.HourlyRate != nil {
+		vehicle.HourlyRate = *updateRequest.HourlyRate
+	}
+	if message := validateVehicle(vehicle); message != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{message, nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	query := "UPDATE vehicles SET type = ?, brand = ?, model = ?, license_plate = ?, hourly_rate = ? WHERE vehicle_id = ? AND status <> ?"
+	result, err := db.Exec(query, vehicle.Type, vehicle.Brand, vehicle.Model, vehicle.LicensePlate, vehicle.HourlyRate, vehicle.VehicleID, vehicleStatusDecommissioned)
+	if err != nil {
+		if isDuplicateKey(err) {
+			w.WriteHeader(http.StatusConflict)
+			response := Response{"A vehicle with this license plate already exists", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		// Either nothing changed or the vehicle was decommissioned meanwhile, so report its current state
+		vehicle, err = getVehicleByID(db, vehicleId)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if vehicle.Status == vehicleStatusDecommissioned {
+			w.WriteHeader(http.StatusConflict)
+			response := Response{"Decommissioned vehicles cannot be edited", vehicle}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Vehicle updated", vehicle}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Take a vehicle offline or bring it back, e.g. for maintenance (admins only).
+// An offline vehicle cannot be booked but keeps its existing bookings.
+func setVehicleStatus(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string   `json:"message"`
+		Vehicle *Vehicle `json:"vehicle"`
+	}
+
+	var statusRequest struct {
+		Status string `json:"status"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&statusRequest)
+	if err != nil || (statusRequest.Status != vehicleStatusActive && statusRequest.Status != vehicleStatusOffline) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Status must be Active or Offline", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Decommissioned vehicles stay retired
+	vehicleId := mux.Vars(r)["vehicleId"]
+	result, err := db.Exec("UPDATE vehicles SET status = ? WHERE vehicle_id = ? AND status <> ?", statusRequest.Status, vehicleId, vehicleStatusDecommissioned)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	vehicle, err := getVehicleByID(db, vehicleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Vehicle not found", nil}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 && vehicle.Status == vehicleStatusDecommissioned {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Decommissioned vehicles cannot be brought back", vehicle}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Vehicle is now " + vehicle.Status, vehicle}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Retire a vehicle for good (admins only). Unpaid booking sessions on it are expired. Upcoming
+// confirmed bookings make the request fail, unless ?reassign=true is given, in which case each is
+// moved to a free active vehicle of the same type at the same time, keeping its price. If any
+// cannot be moved, nothing changes.
+func decommissionVehicle(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message          string              `json:"message"`
+		Vehicle          *Vehicle            `json:"vehicle"`
+		Reassigned       []ReassignedBooking `json:"reassigned,omitempty"`
+		BlockingBookings []int64             `json:"blocking_bookings,omitempty"`
+	}
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	reassign := r.URL.Query().Get("reassign") == "true"
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the vehicle so no booking can be made on it while it is being retired
+	var lockedVehicleID int
+	err = tx.QueryRow("SELECT vehicle_id FROM vehicles WHERE vehicle_id = ? FOR UPDATE", vehicleId).Scan(&lockedVehicleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{Message: "Vehicle not found"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vehicle, err := getVehicleByID(tx, vehicleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{Message: "Vehicle not found"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if vehicle.Status == vehicleStatusDecommissioned {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Vehicle is already decommissioned", Vehicle: vehicle}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Expire the unpaid sessions, billing then refuses to invoice or confirm them
+	query := `
+		UPDATE bookings b
+		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
+		SET b.status = 'SessionExpired', b.expired_at = NOW()
+		WHERE s.vehicle_id = ? AND b.status = 'Pending'`
+	if _, err := tx.Exec(query, vehicleId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Find the bookings still to come or under way on the vehicle
+	type upcomingBooking struct {
+		bookingId int64
+		userId    string
+		status    string
+		date      string
+		startTime string
+		endTime   string
+	}
+	query = `
+		SELECT b.booking_id, b.user_id, b.status, s.date, b.start_time, b.end_time
+		FROM bookings b
+		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE s.vehicle_id = ? AND b.status IN ('Confirmed', 'InProgress') AND s.date >= CURDATE()
+		ORDER BY s.date, b.start_time`
+	rows, err := tx.Query(query, vehicleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var upcoming []upcomingBooking
+	for rows.Next() {
+		var booking upcomingBooking
+		if err := rows.Scan(&booking.bookingId, &booking.userId, &booking.status, &booking.date, &booking.startTime, &booking.endTime); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		upcoming = append(upcoming, booking)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A vehicle out on a trip cannot be retired until it is back
+	for _, booking := range upcoming {
+		if booking.status == "InProgress" {
+			w.WriteHeader(http.StatusConflict)
+			response := Response{Message: "Vehicle is out on a trip", Vehicle: vehicle, BlockingBookings: []int64{booking.bookingId}}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if len(upcoming) > 0 && !reassign {
+		var blocking []int64
+		for _, booking := range upcoming {
+			blocking = append(blocking, booking.bookingId)
+		}
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Vehicle has upcoming confirmed bookings, reassign them to decommission it", Vehicle: vehicle, BlockingBookings: blocking}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Move each booking to the closest priced free vehicle of the same type
+	var reassigned []ReassignedBooking
+	var unassignable []int64
+	candidateQuery := `
+		SELECT s.schedule_id, v.vehicle_id
+		FROM schedules s
+		INNER JOIN vehicles v ON s.vehicle_id = v.vehicle_id
+		WHERE v.vehicle_id <> ? AND v.status = 'Active' AND v.type = ?
+		AND s.date = ? AND s.start_time <= ? AND s.end_time >= ?
+		ORDER BY ABS(v.hourly_rate - ?), v.vehicle_id`
+	for _, booking := range upcoming {
+		startTime, err := parseTimeOfDay(booking.startTime)
+		if err != nil {
+			http.Error(w, "Failed to parse booking time", http.StatusInternalServerError)
+			return
+		}
+		endTime, err := parseTimeOfDay(booking.endTime)
+		if err != nil {
+			http.Error(w, "Failed to parse booking time", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := tx.Query(candidateQuery, vehicle.VehicleID, vehicle.Type, booking.date, booking.startTime, booking.endTime, vehicle.HourlyRate)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var candidates []ReassignedBooking
+		for rows.Next() {
+			candidate := ReassignedBooking{BookingID: booking.bookingId}
+			if err := rows.Scan(&candidate.ScheduleID, &candidate.VehicleID); err != nil {
+				rows.Close()
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			candidates = append(candidates, candidate)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		moved := false
+		for _, candidate := range candidates {
+			claimed, err := claimTimeSlot(tx, strconv.Itoa(candidate.VehicleID), booking.date, startTime, endTime, booking.bookingId)
+			if err != nil {
+				http.Error(w, "Failed to check existing bookings", http.StatusInternalServerError)
+				return
+			}
+			if !claimed {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE bookings SET schedule_id = ? WHERE booking_id = ?", candidate.ScheduleID, booking.bookingId); err != nil {
+				http.Error(w, "Failed to reassign booking", http.StatusInternalServerError)
+				return
+			}
+			reassigned = append(reassigned, candidate)
+			moved = true
+			break
+		}
+		if !moved {
+			unassignable = append(unassignable, booking.bookingId)
+		}
+	}
+	if len(unassignable) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "No free vehicle of the same type for some bookings, nothing was changed", Vehicle: vehicle, BlockingBookings: unassignable}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Retire the vehicle; its remaining availability windows are no longer listed
+	if _, err := tx.Exec("UPDATE vehicles SET status = ? WHERE vehicle_id = ?", vehicleStatusDecommissioned, vehicleId); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	vehicle.Status = vehicleStatusDecommissioned
+
+	// Tell the renters their booking moved to another vehicle; every upcoming booking was moved, in order
+	for i, moved := range reassigned {
+		log.Printf("Booking %d moved from vehicle %d to vehicle %d", moved.BookingID, vehicle.VehicleID, moved.VehicleID)
+		booking := upcoming[i]
+		go notifyUser(booking.userId, "booking_vehicle_changed", map[string]interface{}{"BookingID": booking.bookingId, "Date": booking.date, "StartTime": booking.startTime, "EndTime": booking.endTime})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{Message: "Vehicle decommissioned", Vehicle: vehicle, Reassigned: reassigned}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Get the time blocked out for maintenance between two dates, keyed by vehicle id and date like
+// getBookedRanges. Blocks spanning several days are split at midnight.
+func getMaintenanceRanges(fromDate, toDate string) (map[string][]timeRange, error) {
+	query := `
+		SELECT vehicle_id, start_at, end_at
+		FROM maintenance_blocks
+		WHERE DATE(start_at) <= ? AND end_at > ?`
+	rows, err := db.Query(query, toDate, fromDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	from, err := time.Parse("2006-01-02", fromDate)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse("2006-01-02", toDate)
+	if err != nil {
+		return nil, err
+	}
+	midnight, _ := parseTimeOfDay("00:00:00")
+
+	blocked := make(map[string][]timeRange)
+	for rows.Next() {
+		var vehicleID, startAt, endAt string
+		if err := rows.Scan(&vehicleID, &startAt, &endAt); err != nil {
+			return nil, err
+		}
+		start, err := parseBlockTime(startAt)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseBlockTime(endAt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Walk the days the block covers within the requested dates
+		firstDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		if firstDay.Before(from) {
+			firstDay = from
+		}
+		for day := firstDay; day.Before(end) && !day.After(to); day = day.AddDate(0, 0, 1) {
+			dayStart, dayEnd := day, day.AddDate(0, 0, 1)
+			if start.After(dayStart) {
+				dayStart = start
+			}
+			if end.Before(dayEnd) {
+				dayEnd = end
+			}
+			// Express the range as times of day, the end of the day being midnight of the next one
+			key := vehicleID + "/" + day.Format("2006-01-02")
+			blocked[key] = append(blocked[key], timeRange{midnight.Add(dayStart.Sub(day)), midnight.Add(dayEnd.Sub(day))})
+		}
+	}
+	return blocked, rows.Err()
+}
+
+// Check whether a time range on a vehicle falls within a maintenance block
+func overlapsMaintenance(tx *sql.Tx, vehicleID string, date string, startTime, endTime time.Time) (bool, error) {
+	var blocks int
+	query := "SELECT COUNT(*) FROM maintenance_blocks WHERE vehicle_id = ? AND start_at < ? AND end_at > ?"
+	err := tx.QueryRow(query, vehicleID, date+" "+endTime.Format("15:04:05"), date+" "+startTime.Format("15:04:05")).Scan(&blocks)
+	return blocks > 0, err
+}
+
+// Block out a period for maintenance, during which the vehicle cannot be booked (admins only).
+// Refused if bookings still hold time in the period, so they must be moved or cancelled first.
+func createMaintenanceBlock(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message             string            `json:"message"`
+		Block               *MaintenanceBlock `json:"block"`
+		ConflictingBookings []int64           `json:"conflicting_bookings,omitempty"`
+	}
+
+	var block MaintenanceBlock
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid maintenance data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	start, err := parseBlockTime(block.StartAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid start, expected YYYY-MM-DD HH:MM"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	end, err := parseBlockTime(block.EndAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Invalid end, expected YYYY-MM-DD HH:MM"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if !end.After(start) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "End must be after start"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	block.StartAt = start.Format("2006-01-02 15:04:05")
+	block.EndAt = end.Format("2006-01-02 15:04:05")
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	message, status, err := lockVehicleForScheduling(tx, vehicleId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		w.WriteHeader(status)
+		response := Response{Message: message}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Bookings holding time in the period must be dealt with first
+	query := `
+		SELECT b.booking_id
+		FROM bookings b
+		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE s.vehicle_id = ? AND b.status IN ('Pending', 'Confirmed', 'InProgress')
+		AND TIMESTAMP(s.date, b.start_time) < ? AND TIMESTAMP(s.date, b.end_time) > ?
+		ORDER BY s.date, b.start_time`
+	rows, err := tx.Query(query, vehicleId, block.EndAt, block.StartAt)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var conflicting []int64
+	for rows.Next() {
+		var bookingId int64
+		if err := rows.Scan(&bookingId); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		conflicting = append(conflicting, bookingId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(conflicting) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{Message: "Bookings hold time in the maintenance period", ConflictingBookings: conflicting}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	result, err := tx.Exec("INSERT INTO maintenance_blocks (vehicle_id, start_at, end_at, reason) VALUES (?, ?, ?, ?)", vehicleId, block.StartAt, block.EndAt, block.Reason)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	block.BlockID, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	block.VehicleID, _ = strconv.Atoi(vehicleId)
+
+	w.WriteHeader(http.StatusCreated)
+	response := Response{Message: "Maintenance scheduled", Block: &block}
+	json.NewEncoder(w).Encode(response)
+}
+
+// List the maintenance blocks of a vehicle that have not ended (admins only)
+func listMaintenanceBlocks(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string             `json:"message"`
+		Blocks  []MaintenanceBlock `json:"blocks"`
+	}
+
+	// Maintenance times are in Singapore time, so compare against the current time there
+	loc, err := bookingLocation()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().In(loc).Format("2006-01-02 15:04:05")
+
+	vehicleId := mux.Vars(r)["vehicleId"]
+	query := "SELECT block_id, vehicle_id, start_at, end_at, COALESCE(reason, '') FROM maintenance_blocks WHERE vehicle_id = ? AND end_at > ? ORDER BY start_at"
+	rows, err := db.Query(query, vehicleId, now)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocks := []MaintenanceBlock{}
+	for rows.Next() {
+		var block MaintenanceBlock
+		if err := rows.Scan(&block.BlockID, &block.VehicleID, &block.StartAt, &block.EndAt, &block.Reason); err != nil {
+			http.Error(w, "Error reading maintenance data", http.StatusInternalServerError)
+			return
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Maintenance blocks found", blocks}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Cancel a maintenance block, making the time bookable again (admins only)
+func deleteMaintenanceBlock(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	blockId := mux.Vars(r)["blockId"]
+	result, err := db.Exec("DELETE FROM maintenance_blocks WHERE block_id = ?", blockId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{"Maintenance block not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{"Maintenance block deleted"})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"shared/auth"
+)
+
+// Ask the user service to send the user a notification. Notifications are best effort,
+// so failures are only logged and never fail the request that triggered them.
+func notifyUser(userId string, templateName string, data map[string]interface{}) {
+	payload, err := json.Marshal(map[string]interface{}{"template": templateName, "data": data})
+	if err != nil {
+		log.Println("Failed to encode notification:", err)
+		return
+	}
+	notifyURL := userServiceURL + "/api/v1/notify/" + userId
+	resp, err := auth.ServicePost(notifyURL, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		log.Println("Failed to send", templateName, "notification:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to send %s notification, status code: %d", templateName, resp.StatusCode)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"shared/auth"
+)
+
+// Periods over which a membership's booking limit applies
+const (
+	bookingPeriodCalendarMonth = "calendar_month"
+	bookingPeriodRolling30Days = "rolling_30_days"
+)
+
+// Length of the rolling booking period
+const rollingBookingWindow = 30 * 24 * time.Hour
+
+// How the periods are described to the user
+var bookingPeriodNames = map[string]string{
+	bookingPeriodCalendarMonth: "calendar month",
+	bookingPeriodRolling30Days: "30 days",
+}
+
+// A user's bookings against their membership's limits
+type BookingQuota struct {
+	MembershipId      string `json:"membership_id"`
+	Period            string `json:"period"`
+	PeriodStart       string `json:"period_start"`
+	ResetsAt          string `json:"resets_at,omitempty"` // when a booking next becomes available again, if any are used
+	BookingLimit      int    `json:"booking_limit"`
+	Used              int    `json:"used"`
+	Remaining         int    `json:"remaining"`
+	MaxActiveBookings int    `json:"max_active_bookings"`
+	Active            int    `json:"active"`
+	ActiveRemaining   int    `json:"active_remaining"`
+}
+
+// Implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Start of the booking period containing now, and when it ends (zero for rolling periods,
+// which have no fixed end)
+func bookingPeriodBounds(period string, now time.Time) (time.Time, time.Time) {
+	if period == bookingPeriodRolling30Days {
+		return now.Add(-rollingBookingWindow), time.Time{}
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Lock the user's booking quota until the transaction ends, creating its row on first use. Locking
+// the bookings themselves would lock nothing for a user who has none, so concurrent first bookings
+// could both be counted against an empty quota.
+func lockBookingQuota(tx *sql.Tx, userID string) error {
+	if _, err := tx.Exec("INSERT IGNORE INTO booking_quota (user_id) VALUES (?)", userID); err != nil {
+		return err
+	}
+	var locked string
+	return tx.QueryRow("SELECT user_id FROM booking_quota WHERE user_id = ? FOR UPDATE", userID).Scan(&locked)
+}
+
+// Count the user's bookings in the current period and those still active. Bookings count from
+// when they are made; cancelled and expired ones do not count.
+func countBookingQuota(q queryRower, userID string, membership *Membership) (*BookingQuota, error) {
+	// Periods follow Singapore time, like the booking times
+	loc, err := bookingLocation()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(loc)
+	periodStart, periodEnd := bookingPeriodBounds(membership.BookingPeriod, now)
+	sincePeriodStart := int64(now.Sub(periodStart).Seconds())
+
+	query := `
+		SELECT
+			COUNT(CASE WHEN created_at >= NOW() - INTERVAL ? SECOND THEN 1 END),
+			COUNT(CASE WHEN status IN ('Pending', 'Confirmed', 'InProgress') THEN 1 END),
+			TIMESTAMPDIFF(SECOND, NOW(), MIN(CASE WHEN created_at >= NOW() - INTERVAL ? SECOND THEN created_at END) + INTERVAL ? SECOND)
+		FROM bookings
+		WHERE user_id = ? AND status IN ('Pending', 'Confirmed', 'InProgress', 'Completed')`
+	quota := BookingQuota{
+		MembershipId:      membership.MembershipId,
+		Period:            membership.BookingPeriod,
+		PeriodStart:       periodStart.Format("2006-01-02 15:04:05"),
+		BookingLimit:      membership.BookingLimit,
+		MaxActiveBookings: membership.MaxActiveBookings,
+	}
+	var untilOldestLeaves sql.NullInt64
+	err = q.QueryRow(query, sincePeriodStart, sincePeriodStart, int64(rollingBookingWindow.Seconds()), userID).Scan(&quota.Used, &quota.Active, &untilOldestLeaves)
+	if err != nil {
+		return nil, err
+	}
+	quota.Remaining = max(quota.BookingLimit-quota.Used, 0)
+	quota.ActiveRemaining = max(quota.MaxActiveBookings-quota.Active, 0)
+
+	// A calendar month resets at its end; a rolling period frees a booking when the oldest one leaves it
+	if quota.Used > 0 {
+		if !periodEnd.IsZero() {
+			quota.ResetsAt = periodEnd.Format("2006-01-02 15:04:05")
+		} else if untilOldestLeaves.Valid {
+			quota.ResetsAt = now.Add(time.Duration(untilOldestLeaves.Int64) * time.Second).Format("2006-01-02 15:04:05")
+		}
+	}
+	return &quota, nil
+}
+
+// Get the user's booking usage and what is left of their membership's limits
+func getBookingQuota(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message string        `json:"message"`
+		Quota   *BookingQuota `json:"quota"`
+	}
+
+	// Get user_id from the access token
+	userID := auth.UserID(r)
+
+	// Validate user ID
+	user, err := validateUser(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"User not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	membership, err := getMembershipDetails(user.MembershipId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Membership not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	quota, err := countBookingQuota(db, userID, membership)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Failed to query booking count", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Booking quota found", quota}
+	json.NewEncoder(w).Encode(response)
+}
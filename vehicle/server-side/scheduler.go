@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// Periodically expire booking sessions that were never paid for
+func startBookingSessionSweeper(ttl time.Duration, interval time.Duration) {
+	log.Printf("Booking session sweeper started (ttl: %s, interval: %s)", ttl, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expired, err := expireBookingSessions(ttl)
+		if err != nil {
+			log.Println("Failed to expire booking sessions:", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d abandoned booking session(s)", expired)
+		}
+		<-ticker.C
+	}
+}
+
+// Mark 'Pending' bookings older than the ttl as 'SessionExpired', which frees their time range
+func expireBookingSessions(ttl time.Duration) (int64, error) {
+	// The expiry time is recorded on the booking so billing can refuse to invoice it
+	query := `
+		UPDATE bookings
+		SET status = 'SessionExpired', expired_at = NOW()
+		WHERE status = 'Pending' AND created_at < NOW() - INTERVAL ? SECOND
+	`
+	result, err := db.Exec(query, int64(ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Periodically complete bookings whose booked time has passed
+func startBookingCompleter(overdueGrace time.Duration, interval time.Duration) {
+	log.Printf("Booking completer started (overdue grace: %s, interval: %s)", overdueGrace, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		completed, err := completeFinishedBookings(overdueGrace)
+		if err != nil {
+			log.Println("Failed to complete finished bookings:", err)
+		} else if completed > 0 {
+			log.Printf("Completed %d finished booking(s)", completed)
+		}
+		<-ticker.C
+	}
+}
+
+// Mark 'Confirmed' bookings whose end time has passed as 'Completed'. Trips still 'InProgress'
+// are completed once the overdue grace has also passed, recording that moment as the return time.
+func completeFinishedBookings(overdueGrace time.Duration) (int64, error) {
+	// Booking times are in Singapore time, so compare against the current time there
+	loc, err := bookingLocation()
+	if err != nil {
+		return 0, err
+	}
+	currentTime := time.Now().In(loc)
+	now := currentTime.Format("2006-01-02 15:04:05")
+	overdue := currentTime.Add(-overdueGrace).Format("2006-01-02 15:04:05")
+
+	// Bookings that were never picked up
+	query := `
+		UPDATE bookings b
+		JOIN schedules s ON b.schedule_id = s.schedule_id
+		SET b.status = 'Completed'
+		WHERE b.status = 'Confirmed' AND TIMESTAMP(s.date, b.end_time) < ?
+	`
+	result, err := db.Exec(query, now)
+	if err != nil {
+		return 0, err
+	}
+	completed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// Trips that were never ended, closed one at a time so each gets its final invoice
+	query = `
+		SELECT b.booking_id, b.user_id
+		FROM bookings b
+		JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE b.status = 'InProgress' AND TIMESTAMP(s.date, b.end_time) < ?
+	`
+	rows, err := db.Query(query, overdue)
+	if err != nil {
+		return completed, err
+	}
+	type overdueTrip struct{ bookingId, userId int }
+	var trips []overdueTrip
+	for rows.Next() {
+		var trip overdueTrip
+		if err := rows.Scan(&trip.bookingId, &trip.userId); err != nil {
+			rows.Close()
+			return completed, err
+		}
+		trips = append(trips, trip)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return completed, err
+	}
+
+	for _, trip := range trips {
+		result, err := db.Exec("UPDATE bookings SET status = 'Completed', actual_end = ? WHERE booking_id = ? AND status = 'InProgress'", now, trip.bookingId)
+		if err != nil {
+			return completed, err
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+			continue
+		}
+		completed++
+		if err := requestFinalInvoice(strconv.Itoa(trip.userId), strconv.Itoa(trip.bookingId)); err != nil {
+			log.Println("Failed to request final invoice for booking", trip.bookingId, ":", err)
+		}
+	}
+	return completed, nil
+}
+
+// Periodically retry the refunds of cancelled bookings that billing could not be reached for
+func startRefundRetrier(interval time.Duration) {
+	log.Printf("Refund retrier started (interval: %s)", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		refunded, err := retryPendingRefunds()
+		if err != nil {
+			log.Println("Failed to retry pending refunds:", err)
+		} else if refunded > 0 {
+			log.Printf("Refunded %d cancelled booking(s)", refunded)
+		}
+		<-ticker.C
+	}
+}
+
+// Send the refund of each cancelled booking still waiting for one, with the notice it was cancelled at.
+// Billing refunds a booking once, so a refund whose reply was lost is not paid twice.
+func retryPendingRefunds() (int, error) {
+	rows, err := db.Query("SELECT booking_id, user_id, cancelled_hours_before FROM bookings WHERE status = 'Cancelled' AND refund_status = 'Pending'")
+	if err != nil {
+		return 0, err
+	}
+	type pendingRefund struct {
+		bookingId, userId int
+		hoursBeforeStart  float64
+	}
+	var refunds []pendingRefund
+	for rows.Next() {
+		var refund pendingRefund
+		if err := rows.Scan(&refund.bookingId, &refund.userId, &refund.hoursBeforeStart); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		refunds = append(refunds, refund)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	refunded := 0
+	for _, refund := range refunds {
+		if err := refundCancelledBooking(strconv.Itoa(refund.userId), strconv.Itoa(refund.bookingId), refund.hoursBeforeStart); err != nil {
+			log.Println("Failed to refund booking", refund.bookingId, ":", err)
+			continue
+		}
+		refunded++
+	}
+	return refunded, nil
+}
+
+// Periodically retry settling the price difference of modified bookings that billing could not be reached for
+func startAdjustmentRetrier(interval time.Duration) {
+	log.Printf("Adjustment retrier started (interval: %s)", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		adjusted, err := retryPendingAdjustments()
+		if err != nil {
+			log.Println("Failed to retry pending adjustments:", err)
+		} else if adjusted > 0 {
+			log.Printf("Settled the price difference of %d modified booking(s)", adjusted)
+		}
+		<-ticker.C
+	}
+}
+
+// Settle each modified booking still waiting for billing to adjust its payment to the new total
+func retryPendingAdjustments() (int, error) {
+	rows, err := db.Query("SELECT booking_id FROM bookings WHERE adjustment_status = 'Pending' AND status <> 'Cancelled'")
+	if err != nil {
+		return 0, err
+	}
+	var bookingIds []int
+	for rows.Next() {
+		var bookingId int
+		if err := rows.Scan(&bookingId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		bookingIds = append(bookingIds, bookingId)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	adjusted := 0
+	for _, bookingId := range bookingIds {
+		if _, err := settleBookingPayment(strconv.Itoa(bookingId)); err != nil {
+			log.Println("Failed to adjust payment for booking", bookingId, ":", err)
+			continue
+		}
+		adjusted++
+	}
+	return adjusted, nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shared/auth"
+	"shared/money"
+)
+
+// Vehicle search limits
+const (
+	defaultSearchDays  = 7   // dates searched when no end date is given
+	maxSearchDays      = 31  // widest date range a search may cover
+	defaultSearchLimit = 20  // results per page when no limit is given
+	maxSearchLimit     = 100 // most results a page may hold
+)
+
+// Columns results are ordered by for each sort, ending with a unique column so the order is total
+var searchSortColumns = map[string][]string{
+	"start_time": {"s.date", "s.start_time", "s.schedule_id"},
+	"price":      {"v.hourly_rate", "s.date", "s.start_time", "s.schedule_id"},
+}
+
+// Struct to represent a bookable free time range found by a search
+type VehicleSearchResult struct {
+	ScheduleID         int         `json:"schedule_id"`
+	VehicleID          string      `json:"vehicle_id"`
+	Type               string      `json:"type"`
+	Brand              string      `json:"brand"`
+	Model              string      `json:"model"`
+	LicensePlate       string      `json:"license_plate"`
+	HourlyRate         money.Money `json:"hourly_rate"`
+	Date               string      `json:"date"`
+	StartTime          string      `json:"start_time"`
+	EndTime            string      `json:"end_time"`
+	BaseCost           money.Money `json:"base_cost"`
+	MembershipDiscount money.Money `json:"membership_discount"`
+	EstimatedCost      money.Money `json:"estimated_cost"` // for the calling user's membership, before promo codes
+}
+
+// Position in the search results, handed to the client as an opaque cursor.
+// Keys are the sort column values of the window to resume from, Slot the first of its free ranges not yet returned.
+type searchCursor struct {
+	Sort string   `json:"sort"`
+	Keys []string `json:"keys"`
+	Slot int      `json:"slot"`
+}
+
+func encodeSearchCursor(cursor searchCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(value string, sort string) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor searchCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.Sort != sort || len(cursor.Keys) != len(searchSortColumns[sort]) || cursor.Slot < 0 {
+		return nil, strconv.ErrSyntax
+	}
+	return &cursor, nil
+}
+
+// Search the free time of active vehicles. Query parameters, all optional:
+// from and to (dates, default today and a week on), start_time and end_time (a time range that must be free),
+// type, brand, min_rate and max_rate (hourly rate), sort (start_time or price), limit and cursor (from next_cursor).
+func searchVehicles(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Struct for response
+	type Response struct {
+		Message    string                `json:"message"`
+		Results    []VehicleSearchResult `json:"results"`
+		NextCursor string                `json:"next_cursor,omitempty"`
+	}
+	badRequest := func(message string) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: message}
+		json.NewEncoder(w).Encode(response)
+	}
+	params := r.URL.Query()
+
+	// Dates to search, from today at the earliest
+	today, err := bookingToday()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	fromDate := today
+	if value := params.Get("from"); value != "" {
+		fromDate, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			badRequest("Invalid from date")
+			return
+		}
+		if fromDate.Before(today) {
+			fromDate = today
+		}
+	}
+	toDate := fromDate.AddDate(0, 0, defaultSearchDays-1)
+	if value := params.Get("to"); value != "" {
+		toDate, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			badRequest("Invalid to date")
+			return
+		}
+	}
+	if toDate.Before(fromDate) || toDate.Sub(fromDate) >= maxSearchDays*24*time.Hour {
+		badRequest("The date range must cover between 1 and 31 days from today onwards")
+		return
+	}
+	from, to := fromDate.Format("2006-01-02"), toDate.Format("2006-01-02")
+
+	// Optional time range that must be free
+	var requested *timeRange
+	if params.Get("start_time") != "" || params.Get("end_time") != "" {
+		startTime, err := parseTimeOfDay(params.Get("start_time"))
+		if err != nil {
+			badRequest("Invalid start time")
+			return
+		}
+		endTime, err := parseTimeOfDay(params.Get("end_time"))
+		if err != nil {
+			badRequest("Invalid end time")
+			return
+		}
+		if !endTime.After(startTime) {
+			badRequest("End time must be after start time")
+			return
+		}
+		requested = &timeRange{startTime, endTime}
+	}
+
+	// Sort and page
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = "start_time"
+	}
+	sortColumns, ok := searchSortColumns[sort]
+	if !ok {
+		badRequest("Sort must be start_time or price")
+		return
+	}
+	limit := defaultSearchLimit
+	if value := params.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			badRequest("Limit must be between 1 and 100")
+			return
+		}
+	}
+	var cursor *searchCursor
+	if value := params.Get("cursor"); value != "" {
+		cursor, err = decodeSearchCursor(value, sort)
+		if err != nil {
+			badRequest("Invalid cursor")
+			return
+		}
+	}
+
+	// Filters on the vehicle and its windows
+	conditions := []string{"v.status = 'Active'", "s.date BETWEEN ? AND ?"}
+	args := []interface{}{from, to}
+	if value := params.Get("type"); value != "" {
+		conditions = append(conditions, "v.type = ?")
+		args = append(args, value)
+	}
+	if value := params.Get("brand"); value != "" {
+		conditions = append(conditions, "v.brand = ?")
+		args = append(args, value)
+	}
+	for _, rate := range []struct{ param, condition string }{{"min_rate", "v.hourly_rate >= ?"}, {"max_rate", "v.hourly_rate <= ?"}} {
+		if value := params.Get(rate.param); value != "" {
+			parsed, err := money.Parse(value)
+			if err != nil || parsed < 0 {
+				badRequest("Invalid " + strings.Replace(rate.param, "_", " ", 1))
+				return
+			}
+			conditions = append(conditions, rate.condition)
+			args = append(args, parsed)
+		}
+	}
+	if requested != nil {
+		conditions = append(conditions, "s.start_time <= ? AND s.end_time >= ?")
+		args = append(args, requested.start.Format("15:04:05"), requested.end.Format("15:04:05"))
+	}
+
+	// Estimate costs with the user's membership discount
+	user, err := validateUser(auth.UserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{Message: "User not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	membership, err := getMembershipDetails(user.MembershipId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{Message: "Membership not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Time already taken in the searched dates
+	booked, err := getBookedRanges(from, to)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Read the windows in sort order, in batches, until the page is full. Windows without the
+	// wanted free time are skipped, so a page may need more than one batch.
+	results := []VehicleSearchResult{}
+	var nextCursor string
+	batchSize := limit + 10
+	for nextCursor == "" {
+		query := `
+			SELECT s.schedule_id, v.vehicle_id, v.type, v.brand, v.model, v.license_plate, v.hourly_rate, s.date, s.start_time, s.end_time
+			FROM vehicles v
+			INNER JOIN schedules s ON v.vehicle_id = s.vehicle_id
+			WHERE ` + strings.Join(conditions, " AND ")
+		queryArgs := args
+		if cursor != nil {
+			// Resume from the cursor's window, whose free ranges before cursor.Slot are skipped below
+			query += " AND (" + strings.Join(sortColumns, ", ") + ") >= (" + strings.TrimSuffix(strings.Repeat("?, ", len(sortColumns)), ", ") + ")"
+			for _, key := range cursor.Keys {
+				queryArgs = append(queryArgs, key)
+			}
+		}
+		query += " ORDER BY " + strings.Join(sortColumns, ", ") + " LIMIT " + strconv.Itoa(batchSize)
+
+		rows, err := db.Query(query, queryArgs...)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		read := 0
+		for rows.Next() {
+			read++
+			var window VehicleSchedules
+			err := rows.Scan(&window.ScheduleID, &window.VehicleID, &window.Type, &window.Brand, &window.Model, &window.LicensePlate, &window.HourlyRate, &window.Date, &window.StartTime, &window.EndTime)
+			if err != nil {
+				rows.Close()
+				http.Error(w, "Error reading vehicle data", http.StatusInternalServerError)
+				return
+			}
+			keys := searchSortKeys(sort, window)
+			skip := 0
+			if cursor != nil && strings.Join(keys, "|") == strings.Join(cursor.Keys, "|") {
+				skip = cursor.Slot
+			}
+
+			slots, err := searchFreeRanges(window, booked[window.VehicleID+"/"+window.Date], requested)
+			if err != nil {
+				rows.Close()
+				http.Error(w, "Error computing free slots", http.StatusInternalServerError)
+				return
+			}
+			for i := skip; i < len(slots); i++ {
+				if len(results) == limit {
+					// The page is full, the next one starts with this free range
+					nextCursor = encodeSearchCursor(searchCursor{sort, keys, i})
+					break
+				}
+				baseCost, membershipDiscount, _, _, estimatedCost, err := calculateAmount(window.HourlyRate, slots[i].start, slots[i].end, membership.HourlyRateDiscount, "")
+				if err != nil {
+					rows.Close()
+					http.Error(w, "Failed to calculate amount", http.StatusInternalServerError)
+					return
+				}
+				results = append(results, VehicleSearchResult{
+					ScheduleID:         window.ScheduleID,
+					VehicleID:          window.VehicleID,
+					Type:               window.Type,
+					Brand:              window.Brand,
+					Model:              window.Model,
+					LicensePlate:       window.LicensePlate,
+					HourlyRate:         window.HourlyRate,
+					Date:               window.Date,
+					StartTime:          slots[i].start.Format("15:04:05"),
+					EndTime:            slots[i].end.Format("15:04:05"),
+					BaseCost:           baseCost,
+					MembershipDiscount: membershipDiscount,
+					EstimatedCost:      estimatedCost,
+				})
+			}
+			if nextCursor != "" {
+				break
+			}
+			// Carry on after this window
+			cursor = &searchCursor{sort, keys, len(slots)}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error iterating over rows", http.StatusInternalServerError)
+			return
+		}
+		// The last batch was short, so there are no more windows
+		if read < batchSize {
+			break
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Search results found", results, nextCursor}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Values of the sort columns for a window, in the same order as searchSortColumns
+func searchSortKeys(sort string, window VehicleSchedules) []string {
+	if sort == "price" {
+		return []string{window.HourlyRate.String(), window.Date, window.StartTime, strconv.Itoa(window.ScheduleID)}
+	}
+	return []string{window.Date, window.StartTime, strconv.Itoa(window.ScheduleID)}
+}
+
+// Free ranges of a window that a search returns: every free gap, or only the requested range if it is free
+func searchFreeRanges(window VehicleSchedules, booked []timeRange, requested *timeRange) ([]timeRange, error) {
+	freeSlots, err := findFreeSlots(window.StartTime, window.EndTime, booked)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []timeRange
+	for _, slot := range freeSlots {
+		start, err := parseTimeOfDay(slot.StartTime)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(slot.EndTime)
+		if err != nil {
+			return nil, err
+		}
+		if requested == nil {
+			ranges = append(ranges, timeRange{start, end})
+		} else if !start.After(requested.start) && !end.Before(requested.end) {
+			ranges = append(ranges, *requested)
+		}
+	}
+	return ranges, nil
+}
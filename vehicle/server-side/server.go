@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"strconv"
@@ -13,43 +19,60 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/money"
 )
 
 // Struct to represent the vehicle schedule data
 type VehicleSchedules struct {
-	ScheduleID   int     `json:"schedule_id"`
-	VehicleID    string  `json:"vehicle_id"`
-	Type         string  `json:"type"`
-	Brand        string  `json:"brand"`
-	Model        string  `json:"model"`
-	LicensePlate string  `json:"license_plate"`
-	HourlyRate   float64 `json:"hourly_rate"`
-	Date         string  `json:"date"`
-	StartTime    string  `json:"start_time"`
-	EndTime      string  `json:"end_time"`
-	BaseCost     float64 `json:"base_cost"`
+	ScheduleID   int         `json:"schedule_id"`
+	VehicleID    string      `json:"vehicle_id"`
+	Type         string      `json:"type"`
+	Brand        string      `json:"brand"`
+	Model        string      `json:"model"`
+	LicensePlate string      `json:"license_plate"`
+	HourlyRate   money.Money `json:"hourly_rate"`
+	Date         string      `json:"date"`
+	StartTime    string      `json:"start_time"`
+	EndTime      string      `json:"end_time"`
+	BaseCost     money.Money `json:"base_cost"`
+	FreeSlots    []TimeSlot  `json:"free_slots,omitempty"`
+}
+
+// Struct to represent a range of time within a schedule (req body)
+type TimeSlot struct {
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// Parsed time range used when computing free gaps
+type timeRange struct {
+	start time.Time
+	end   time.Time
 }
 
 // Struct to represent the vehicle booking details
 type VehicleBookingDetails struct {
-	BookingID          int64   `json:"booking_id"`
-	ScheduleID         int64   `json:"schedule_id"`
-	UserID             int     `json:"user_id"`
-	Status             string  `json:"status"`
-	BaseCost           float64 `json:"base_cost"`
-	PromotionCode      *string `json:"promo_code"`
-	MembershipDiscount float64 `json:"membership_discount"`
-	PromotionDiscount  float64 `json:"promotion_discount"`
-	DiscountApplied    float64 `json:"discount_applied"`
-	TotalAmount        float64 `json:"total_amount"`
-	Type               string  `json:"type"`
-	Brand              string  `json:"brand"`
-	Model              string  `json:"model"`
-	LicensePlate       string  `json:"license_plate"`
-	ScheduleDate       string  `json:"date"`
-	StartTime          string  `json:"start_time"`
-	EndTime            string  `json:"end_time"`
-	HourlyRate         float64 `json:"hourly_rate"`
+	BookingID          int64       `json:"booking_id"`
+	ScheduleID         int64       `json:"schedule_id"`
+	UserID             int         `json:"user_id"`
+	Status             string      `json:"status"`
+	BaseCost           money.Money `json:"base_cost"`
+	PromotionCode      *string     `json:"promo_code"`
+	MembershipDiscount money.Money `json:"membership_discount"`
+	PromotionDiscount  money.Money `json:"promotion_discount"`
+	DiscountApplied    money.Money `json:"discount_applied"`
+	TotalAmount        money.Money `json:"total_amount"`
+	Type               string      `json:"type"`
+	Brand              string      `json:"brand"`
+	Model              string      `json:"model"`
+	LicensePlate       string      `json:"license_plate"`
+	ScheduleDate       string      `json:"date"`
+	StartTime          string      `json:"start_time"`
+	EndTime            string      `json:"end_time"`
+	HourlyRate         money.Money `json:"hourly_rate"`
 }
 
 // User Struct (req body)
@@ -71,7 +94,9 @@ type User struct {
 type Membership struct {
 	MembershipId       string  `json:"membership_id"`
 	HourlyRateDiscount float64 `json:"hourly_rate_discount"`
-	BookingLimit       int     `json:"booking_limit"`
+	BookingLimit       int     `json:"booking_limit"`       // bookings allowed per booking period
+	BookingPeriod      string  `json:"booking_period"`      // calendar_month or rolling_30_days
+	MaxActiveBookings  int     `json:"max_active_bookings"` // upcoming or ongoing bookings allowed at once
 }
 
 // Struct to represent promotion details
@@ -83,8 +108,24 @@ type Promotion struct {
 	ValidTo           string  `json:"valid_to"`
 }
 
+var (
+	// The promo code does not exist
+	errPromoCodeNotFound = errors.New("promo code not found")
+	// The promo code exists but is outside its validity dates
+	errPromoCodeNotValid = errors.New("promo code not valid")
+	// The promotion service could not be reached or failed, so the code could not be checked
+	errPromotionServiceUnavailable = errors.New("promotion service unavailable")
+)
+
 var db *sql.DB
 
+// Base URLs of the other services
+var (
+	userServiceURL      = "http://localhost:8000"
+	promotionServiceURL = "http://localhost:8080"
+	billingServiceURL   = "http://localhost:8081"
+)
+
 // Initialise the user_svc_db database connection
 func initDB() {
 	var err error
@@ -96,28 +137,75 @@ func initDB() {
 }
 
 func main() {
+	// Refuse to start without a proper signing secret
+	auth.LoadSecret()
 	// Call initDB(), to initialise user_svc_db connection
 	initDB()
 	defer db.Close()
 	// Setting up router and API endpoints
 	router := mux.NewRouter()
-	handler := cors.Default().Handler(router)
+	router.Use(auth.Authenticate)
+	router.Use(idempotency.Middleware(db, getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)))
+	handler := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "Idempotency-Key"},
+	}).Handler(router)
 	router.HandleFunc("/api/v1/vehicles/{date}", getVehicles).Methods("GET")
 	router.HandleFunc("/api/v1/vehicle/{scheduleId}", getVehicleDetails).Methods("GET")
+	router.HandleFunc("/api/v1/vehicle-search", searchVehicles).Methods("GET")
 	router.HandleFunc("/api/v1/rental-history/{id}", getRentalHistory).Methods("GET")
 	router.HandleFunc("/api/v1/upcoming-rentals/{id}", getUpcomingRental).Methods("GET")
+	router.HandleFunc("/api/v1/booking-quota/{id}", getBookingQuota).Methods("GET")
 	router.HandleFunc("/api/v1/create-booking-session/{id}/{scheduleId}", createBookingSession).Methods("POST")
 	router.HandleFunc("/api/v1/add-promotion-code/{id}/{bookingId}/{promoCode}", addPromotionCode).Methods("POST")
 	router.HandleFunc("/api/v1/cancel-booking-session/{id}/{bookingId}", deleteBookingSession).Methods("DELETE")
 	router.HandleFunc("/api/v1/cancel-booking/{id}/{bookingId}", deleteBooking).Methods("DELETE")
-	router.HandleFunc("/api/v1/verify-booking/{id}/{bookingId}", verifyBooking).Methods("GET")
-	router.HandleFunc("/api/v1/confirm-booking/{id}/{bookingId}", confirmBooking).Methods("POST")
+	router.HandleFunc("/api/v1/verify-booking/{id}/{bookingId}", auth.RequireService(verifyBooking)).Methods("GET")
+	router.HandleFunc("/api/v1/confirm-booking/{id}/{bookingId}", auth.RequireService(confirmBooking)).Methods("POST")
 	router.HandleFunc("/api/v1/vehicle-by-hourly-rate/{hourlyRate}", getVehicleDetailsByHourlyRate).Methods("GET")
 	router.HandleFunc("/api/v1/update-booking/{id}/{bookingId}/{scheduleId}", updateBooking).Methods("PUT")
+	router.HandleFunc("/api/v1/start-trip/{id}/{bookingId}", startTrip).Methods("POST")
+	router.HandleFunc("/api/v1/end-trip/{id}/{bookingId}", endTrip).Methods("POST")
+	router.HandleFunc("/api/v1/trip-details/{id}/{bookingId}", auth.RequireService(getTripDetails)).Methods("GET")
+	router.HandleFunc("/api/v1/admin/vehicles", auth.RequireAdmin(listFleetVehicles)).Methods("GET")
+	router.HandleFunc("/api/v1/admin/vehicles", auth.RequireAdmin(createVehicle)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}", auth.RequireAdmin(updateVehicle)).Methods("PUT")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/status", auth.RequireAdmin(setVehicleStatus)).Methods("PUT")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}", auth.RequireAdmin(decommissionVehicle)).Methods("DELETE")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/schedules", auth.RequireAdmin(listVehicleSchedules)).Methods("GET")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/schedules", auth.RequireAdmin(createSchedule)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/schedules/{scheduleId}", auth.RequireAdmin(deleteSchedule)).Methods("DELETE")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/availability-rules", auth.RequireAdmin(listAvailabilityRules)).Methods("GET")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/availability-rules", auth.RequireAdmin(createAvailabilityRule)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/availability-rules/{ruleId}", auth.RequireAdmin(deleteAvailabilityRule)).Methods("DELETE")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/maintenance", auth.RequireAdmin(listMaintenanceBlocks)).Methods("GET")
+	router.HandleFunc("/api/v1/admin/vehicles/{vehicleId}/maintenance", auth.RequireAdmin(createMaintenanceBlock)).Methods("POST")
+	router.HandleFunc("/api/v1/admin/maintenance/{blockId}", auth.RequireAdmin(deleteMaintenanceBlock)).Methods("DELETE")
+	// Start the background job that expires abandoned booking sessions
+	go startBookingSessionSweeper(getEnvDuration("BOOKING_SESSION_TTL", 15*time.Minute), getEnvDuration("BOOKING_SWEEP_INTERVAL", time.Minute))
+	// Start the background job that completes bookings whose booked time has passed
+	go startBookingCompleter(getEnvDuration("TRIP_OVERDUE_GRACE", 2*time.Hour), getEnvDuration("BOOKING_COMPLETE_INTERVAL", time.Minute))
+	// Start the background job that retries refunds of cancelled bookings billing could not be reached for
+	go startRefundRetrier(getEnvDuration("REFUND_RETRY_INTERVAL", time.Minute))
+	go startAdjustmentRetrier(getEnvDuration("ADJUSTMENT_RETRY_INTERVAL", time.Minute))
 	fmt.Println("Listening at port 9000")
 	log.Fatal(http.ListenAndServe(":9000", handler))
 }
 
+// Read a duration (e.g. "15m") from the environment, falling back to the default if unset or invalid
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid %s value %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
 // Validate date
 func isValidDate(date string) bool {
 	_, err := time.Parse("2006-01-02", date)
@@ -133,10 +221,10 @@ func validateUser(userId string) (*User, error) {
 	}
 
 	// URL of the user service
-	userServiceURL := "http://localhost:8000/api/v1/validate-user/" + userId
+	validateURL := userServiceURL + "/api/v1/validate-user/" + userId
 
 	// Send GET request to the user service to validate the user
-	resp, err := http.Get(userServiceURL)
+	resp, err := auth.ServiceGet(validateURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user data: %v", err)
 	}
@@ -162,6 +250,157 @@ func validateUser(userId string) (*User, error) {
 	}
 }
 
+// Parse a time of day given as HH:MM or HH:MM:SS
+func parseTimeOfDay(value string) (time.Time, error) {
+	parsed, err := time.Parse("15:04:05", value)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse("15:04", value)
+}
+
+// Resolve the requested time slot against the availability window, defaulting to the whole window
+func resolveRequestedSlot(requested TimeSlot, windowStart, windowEnd string) (time.Time, time.Time, error) {
+	windowStartFmt, err := parseTimeOfDay(windowStart)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to parse start time")
+	}
+	windowEndFmt, err := parseTimeOfDay(windowEnd)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to parse end time")
+	}
+	// No time given, book the whole window
+	if requested.StartTime == "" && requested.EndTime == "" {
+		return windowStartFmt, windowEndFmt, nil
+	}
+	startTime, err := parseTimeOfDay(requested.StartTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start time format")
+	}
+	endTime, err := parseTimeOfDay(requested.EndTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end time format")
+	}
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end time must be after start time")
+	}
+	if startTime.Before(windowStartFmt) || endTime.After(windowEndFmt) {
+		return time.Time{}, time.Time{}, fmt.Errorf("requested time is outside the vehicle's availability")
+	}
+	return startTime, endTime, nil
+}
+
+// Lock the vehicle and check that the time range is still free, returns false if it overlaps another booking
+// or a maintenance block, or the vehicle was taken out of service
+func claimTimeSlot(tx *sql.Tx, vehicleID string, date string, startTime, endTime time.Time, excludeBookingID int64) (bool, error) {
+	// Locking the vehicle row serialises concurrent bookings of the same vehicle,
+	// so the overlap check below cannot be raced by another transaction
+	var lockedVehicleID string
+	var status string
+	err := tx.QueryRow(`SELECT vehicle_id, status FROM vehicles WHERE vehicle_id = ? FOR UPDATE`, vehicleID).Scan(&lockedVehicleID, &status)
+	if err != nil {
+		return false, err
+	}
+	if status != vehicleStatusActive {
+		return false, nil
+	}
+	if blocked, err := overlapsMaintenance(tx, vehicleID, date, startTime, endTime); err != nil || blocked {
+		return false, err
+	}
+	var overlapping int
+	overlapQuery := `
+		SELECT COUNT(*)
+		FROM bookings b
+		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE s.vehicle_id = ? AND s.date = ? AND b.booking_id <> ?
+		AND b.status IN ('Pending', 'Confirmed', 'InProgress', 'Completed')
+		AND b.start_time < ? AND b.end_time > ?
+	`
+	err = tx.QueryRow(overlapQuery, vehicleID, date, excludeBookingID, endTime.Format("15:04:05"), startTime.Format("15:04:05")).Scan(&overlapping)
+	if err != nil {
+		return false, err
+	}
+	return overlapping == 0, nil
+}
+
+// Get the time ranges already booked or blocked for maintenance between two dates, keyed by vehicle id and date
+func getBookedRanges(fromDate, toDate string) (map[string][]timeRange, error) {
+	query := `
+		SELECT s.vehicle_id, s.date, b.start_time, b.end_time
+		FROM bookings b
+		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE s.date BETWEEN ? AND ?
+		AND b.status IN ('Pending', 'Confirmed', 'InProgress', 'Completed')
+	`
+	rows, err := db.Query(query, fromDate, toDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	booked := make(map[string][]timeRange)
+	for rows.Next() {
+		var vehicleID, date, startTime, endTime string
+		if err := rows.Scan(&vehicleID, &date, &startTime, &endTime); err != nil {
+			return nil, err
+		}
+		startTimeFmt, err := parseTimeOfDay(startTime)
+		if err != nil {
+			return nil, err
+		}
+		endTimeFmt, err := parseTimeOfDay(endTime)
+		if err != nil {
+			return nil, err
+		}
+		key := vehicleID + "/" + date
+		booked[key] = append(booked[key], timeRange{startTimeFmt, endTimeFmt})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Time out for maintenance cannot be booked either
+	blocked, err := getMaintenanceRanges(fromDate, toDate)
+	if err != nil {
+		return nil, err
+	}
+	for key, ranges := range blocked {
+		booked[key] = append(booked[key], ranges...)
+	}
+	return booked, nil
+}
+
+// Compute the free gaps left in an availability window after removing the booked ranges
+func findFreeSlots(windowStart, windowEnd string, booked []timeRange) ([]TimeSlot, error) {
+	windowStartFmt, err := parseTimeOfDay(windowStart)
+	if err != nil {
+		return nil, err
+	}
+	windowEndFmt, err := parseTimeOfDay(windowEnd)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(booked, func(i, j int) bool { return booked[i].start.Before(booked[j].start) })
+
+	var freeSlots []TimeSlot
+	cursor := windowStartFmt
+	for _, slot := range booked {
+		if !slot.end.After(windowStartFmt) || !slot.start.Before(windowEndFmt) {
+			continue
+		}
+		if slot.start.After(cursor) {
+			freeSlots = append(freeSlots, TimeSlot{cursor.Format("15:04:05"), slot.start.Format("15:04:05")})
+		}
+		if slot.end.After(cursor) {
+			cursor = slot.end
+		}
+	}
+	if windowEndFmt.After(cursor) {
+		freeSlots = append(freeSlots, TimeSlot{cursor.Format("15:04:05"), windowEndFmt.Format("15:04:05")})
+	}
+	return freeSlots, nil
+}
+
 // Get membership details
 func getMembershipDetails(membershipId string) (*Membership, error) {
 	// Struct for response from the user service
@@ -171,10 +410,10 @@ func getMembershipDetails(membershipId string) (*Membership, error) {
 	}
 
 	// URL of the user service
-	membershipServiceURL := "http://localhost:8000/api/v1/membership/" + membershipId
+	membershipURL := userServiceURL + "/api/v1/membership/" + membershipId
 
 	// Send GET request to the user service to validate the user
-	resp, err := http.Get(membershipServiceURL)
+	resp, err := auth.ServiceGet(membershipURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get membership data: %v", err)
 	}
@@ -209,12 +448,12 @@ func getPromotionByPromoCode(promocode string) (*Promotion, error) {
 	}
 
 	// URL of the promotion service
-	promotionServiceURL := "http://localhost:8080/api/v1/promotions/" + promocode
+	promotionURL := promotionServiceURL + "/api/v1/promotions/" + promocode
 
 	// Send GET request to the promotion service
-	resp, err := http.Get(promotionServiceURL)
+	resp, err := auth.ServiceGet(promotionURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get promotion data: %v", err)
+		return nil, fmt.Errorf("%w: %v", errPromotionServiceUnavailable, err)
 	}
 	defer resp.Body.Close()
 
@@ -225,58 +464,157 @@ func getPromotionByPromoCode(promocode string) (*Promotion, error) {
 	case http.StatusOK:
 		// Decode the response into the Response struct
 		err := json.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode promotion data: %v", err)
+		if err != nil || response.Promotion == nil {
+			return nil, fmt.Errorf("%w: failed to decode promotion data: %v", errPromotionServiceUnavailable, err)
 		}
 		return response.Promotion, nil
 
 	case http.StatusNotFound:
-		return nil, fmt.Errorf("promotion not found")
+		return nil, errPromoCodeNotFound
 
 	default:
-		return nil, fmt.Errorf("failed to get promotion data, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("%w: status code %d", errPromotionServiceUnavailable, resp.StatusCode)
 	}
 }
 
-// Calculate the total cost of the booking
-func calculateAmount(vehicleHourlyRate float64, startTime, endTime time.Time, membershipDiscount float64, promoCode string) (float64, float64, float64, float64, float64, error) {
-	// Calculate the duration in hours
-	duration := endTime.Sub(startTime).Hours()
+// Ask the billing service to refund a cancelled booking according to its refund policy, and record that
+// it was refunded. Billing refunds a booking only once, so this is safe to repeat until it succeeds.
+func refundCancelledBooking(userId string, bookingId string, hoursBeforeStart float64) error {
+	// URL of the billing service
+	refundURL := billingServiceURL + "/api/v1/refund-booking/" + userId + "/" + bookingId
 
-	// Calculate the base amount
-	baseAmount := vehicleHourlyRate * duration
+	// Prepare JSON payload with how far ahead the booking was cancelled
+	jsonData, err := json.Marshal(struct {
+		HoursBeforeStart float64 `json:"hours_before_start"`
+	}{hoursBeforeStart})
+	if err != nil {
+		return err
+	}
+
+	// Send POST request to the billing service
+	resp, err := auth.ServicePost(refundURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to request refund: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// Nothing was paid for this booking, so there is nothing to refund
+	default:
+		return fmt.Errorf("failed to refund booking, status code: %d", resp.StatusCode)
+	}
+	_, err = db.Exec("UPDATE bookings SET refund_status = 'Done' WHERE booking_id = ?", bookingId)
+	return err
+}
+
+// Ask the billing service to charge or refund the difference between what was paid for a booking
+// and its current price, and record that it is settled. Billing adjusts to the total it is sent, so
+// sending the same total again changes nothing and this is safe to repeat until it succeeds.
+func settleBookingPayment(bookingId string) (string, error) {
+	// Struct for response from the billing service
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Send the booking as it is now, so a retry after later changes settles the latest price
+	var userId string
+	var date, startTime, endTime string
+	var totalAmount money.Money
+	query := `SELECT b.user_id, s.date, b.start_time, b.end_time, b.total_amount
+		FROM bookings b JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE b.booking_id = ?`
+	err := db.QueryRow(query, bookingId).Scan(&userId, &date, &startTime, &endTime, &totalAmount)
+	if err != nil {
+		return "", err
+	}
+
+	// URL of the billing service
+	adjustURL := billingServiceURL + "/api/v1/adjust-booking/" + userId + "/" + bookingId
+
+	// Prepare JSON payload with the new total
+	details := fmt.Sprintf("Changed booking %s to %s from %s to %s", bookingId, date, strings.TrimSuffix(startTime, ":00"), strings.TrimSuffix(endTime, ":00"))
+	jsonData, err := json.Marshal(struct {
+		TotalAmount money.Money `json:"total_amount"`
+		Details     string      `json:"details"`
+	}{totalAmount, details})
+	if err != nil {
+		return "", err
+	}
+
+	// Send POST request to the billing service
+	resp, err := auth.ServicePost(adjustURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to adjust booking payment: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var message string
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return "", fmt.Errorf("failed to decode adjustment: %v", err)
+		}
+		message = response.Message
+
+	case http.StatusNotFound:
+		// Nothing was paid for this booking, so there is nothing to adjust
+		message = "No price difference"
+
+	default:
+		return "", fmt.Errorf("failed to adjust booking payment, status code: %d", resp.StatusCode)
+	}
+
+	// Settled, unless the booking was changed again meanwhile and still needs the newer price sent
+	_, err = db.Exec("UPDATE bookings SET adjustment_status = 'Done' WHERE booking_id = ? AND adjustment_status = 'Pending' AND total_amount = ?", bookingId, totalAmount)
+	if err != nil {
+		return "", err
+	}
+	return message, nil
+}
+
+// Calculate the total cost of the booking
+func calculateAmount(vehicleHourlyRate money.Money, startTime, endTime time.Time, membershipDiscount float64, promoCode string) (money.Money, money.Money, money.Money, money.Money, money.Money, error) {
+	// Calculate the base amount for the booked time, by the second
+	baseAmount := rentalCost(vehicleHourlyRate, endTime.Sub(startTime))
 
 	// Apply membership discount
-	membershipDiscountAmount := baseAmount * (membershipDiscount / 100)
+	membershipDiscountAmount := baseAmount.Percent(membershipDiscount)
 	discountedAmountAfterMembership := baseAmount - membershipDiscountAmount
 
-	// Initialize total discount and total amount after membership discount
-	totalDiscount := membershipDiscountAmount
-	totalAmount := discountedAmountAfterMembership
 	// Apply promo code discount
+	promotionDiscountAmount := money.Money(0)
 	if promoCode != "" {
 		// Apply promo discount on the amount after membership discount
 		promotion, err := getPromotionByPromoCode(promoCode)
 		if err != nil {
-			return 0, 0, 0, 0, 0, fmt.Errorf("promo code not found")
+			return 0, 0, 0, 0, 0, err
 		}
 		// Compare the current date with the promotion valid from and valid to dates
 		currentDate := time.Now().Format("2006-01-02")
 		if currentDate < promotion.ValidFrom || currentDate > promotion.ValidTo {
-			return 0, 0, 0, 0, 0, fmt.Errorf("promo code not valid")
+			return 0, 0, 0, 0, 0, errPromoCodeNotValid
 		}
 		promotionDiscount := promotion.PromotionDiscount
-		promotionDiscountAmount := discountedAmountAfterMembership * (promotionDiscount / 100)
-		totalDiscount += promotionDiscountAmount
-		totalAmount -= promotionDiscountAmount
-		return baseAmount, membershipDiscountAmount, promotionDiscountAmount, totalDiscount, totalAmount, nil
+		promotionDiscountAmount = discountedAmountAfterMembership.Percent(promotionDiscount)
 	}
 
+	// Each part is rounded to cents so that the total is exactly the sum of the parts billing itemises
+	totalDiscount := membershipDiscountAmount + promotionDiscountAmount
+	totalAmount := baseAmount - totalDiscount
+
 	// Return base amount, membership discount, promo discount, total discount, and final total amount
-	return baseAmount, membershipDiscountAmount, 0, totalDiscount, totalAmount, nil
+	return baseAmount, membershipDiscountAmount, promotionDiscountAmount, totalDiscount, totalAmount, nil
+}
+
+// Cost of renting at an hourly rate for a duration, rounded to the nearest cent
+func rentalCost(hourlyRate money.Money, duration time.Duration) money.Money {
+	return hourlyRate.MulDiv(int64(duration/time.Second), int64(time.Hour/time.Second))
 }
 
-// Get all vehicles that has not been reserved and from given the date
+// Get the free time slots of every vehicle available on the given date
 func getVehicles(w http.ResponseWriter, r *http.Request) {
 	// Set the header to application/json
 	w.Header().Set("Content-Type", "application/json")
@@ -295,12 +633,19 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Query to get all vehicles that has not been reserved and from given the date
+	// Get the time already booked on the given date
+	booked, err := getBookedRanges(date, date)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// Query to get all availability windows on the given date
 	query := `
 		SELECT s.schedule_id, v.vehicle_id, v.type, v.brand, v.model, v.license_plate, v.hourly_rate, s.date, s.start_time, s.end_time
 		FROM vehicles v
 		INNER JOIN schedules s ON v.vehicle_id = s.vehicle_id
-		WHERE s.date = ? AND s.is_reserved = 0;
+		WHERE s.date = ? AND v.status = 'Active'
+		ORDER BY v.vehicle_id, s.start_time;
 	`
 	rows, err := db.Query(query, date)
 	if err != nil {
@@ -317,6 +662,16 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
 			log.Println("Error reading vehicle data:", err)
 			return
 		}
+		// Only return windows that still have free time in them
+		vehicle.FreeSlots, err = findFreeSlots(vehicle.StartTime, vehicle.EndTime, booked[vehicle.VehicleID+"/"+vehicle.Date])
+		if err != nil {
+			http.Error(w, "Error reading vehicle data", http.StatusInternalServerError)
+			log.Println("Error computing free slots:", err)
+			return
+		}
+		if len(vehicle.FreeSlots) == 0 {
+			continue
+		}
 		vehicles = append(vehicles, vehicle)
 	}
 	// Check for errors during the iteration
@@ -368,23 +723,18 @@ func getVehicleDetails(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	// Calculate the base cost of the vehicle
-	startTime, err := time.Parse("15:04:05", vehicle.StartTime)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse start time", nil}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	endTime, err := time.Parse("15:04:05", vehicle.EndTime)
+	// Calculate the base cost for the requested time, or the whole window if none is given
+	requested := TimeSlot{r.URL.Query().Get("start_time"), r.URL.Query().Get("end_time")}
+	startTime, endTime, err := resolveRequestedSlot(requested, vehicle.StartTime, vehicle.EndTime)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse end time", nil}
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{err.Error(), nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	baseCost := vehicle.HourlyRate * endTime.Sub(startTime).Hours()
-	vehicle.BaseCost = baseCost
+	vehicle.StartTime = startTime.Format("15:04:05")
+	vehicle.EndTime = endTime.Format("15:04:05")
+	vehicle.BaseCost = rentalCost(vehicle.HourlyRate, endTime.Sub(startTime))
 
 	w.WriteHeader(http.StatusOK)
 	response := Response{"Vehicle found", &vehicle}
@@ -397,8 +747,8 @@ func getRentalHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	// Variable to hold the rental history
 	var history []VehicleBookingDetails
-	// Get the user email from the URL
-	userId := mux.Vars(r)["id"]
+	// Get the user id from the access token
+	userId := auth.UserID(r)
 	// Struct for response
 	type Response struct {
 		Message  string                  `json:"message"`
@@ -425,14 +775,14 @@ func getRentalHistory(w http.ResponseWriter, r *http.Request) {
 		v.model AS vehicle_model,
 		v.license_plate,
 		s.date AS schedule_date,
-		s.start_time,
-		s.end_time
+		b.start_time,
+		b.end_time
 	FROM bookings b
 	JOIN schedules s ON b.schedule_id = s.schedule_id
 	JOIN vehicles v ON s.vehicle_id = v.vehicle_id
 	WHERE b.user_id = ? 
 	AND b.status = 'Completed'
-	ORDER BY s.date DESC, s.start_time DESC, s.end_time DESC;`
+	ORDER BY s.date DESC, b.start_time DESC, b.end_time DESC;`
 
 	rows, err := db.Query(query, userId)
 	if err != nil {
@@ -477,8 +827,8 @@ func getUpcomingRental(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	// Variable to hold the rental history
 	var history []VehicleBookingDetails
-	// Get the user email from the URL
-	userId := mux.Vars(r)["id"]
+	// Get the user id from the access token
+	userId := auth.UserID(r)
 	// Struct for response
 	type Response struct {
 		Message  string                  `json:"message"`
@@ -495,12 +845,12 @@ func getUpcomingRental(w http.ResponseWriter, r *http.Request) {
 	}
 	// SQL query to get rental history for the user
 	query := `SELECT b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount,
-			v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, s.start_time, s.end_time, v.hourly_rate
+			v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, b.start_time, b.end_time, v.hourly_rate
 			  FROM bookings b
 			  JOIN schedules s ON b.schedule_id = s.schedule_id
 			  JOIN vehicles v ON s.vehicle_id = v.vehicle_id
-			  WHERE b.user_id = ? AND b.status = 'Confirmed' AND s.date >= CURDATE()
-			  ORDER BY s.date ASC, s.start_time ASC, s.end_time ASC;`
+			  WHERE b.user_id = ? AND b.status IN ('Confirmed', 'InProgress') AND s.date >= CURDATE()
+			  ORDER BY s.date ASC, b.start_time ASC, b.end_time ASC;`
 
 	rows, err := db.Query(query, userId)
 	if err != nil {
@@ -550,8 +900,8 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		Booking *VehicleBookingDetails `json:"booking"`
 	}
 
-	// Get user_id and schedule_id from the URL parameters
-	userID := mux.Vars(r)["id"]
+	// Get user_id from the access token and schedule_id from the URL parameters
+	userID := auth.UserID(r)
 	scheduleID := mux.Vars(r)["scheduleId"]
 
 	// Validate user ID
@@ -572,14 +922,25 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch schedule date and reservation status in a single query
+	// Read the requested time range, an empty body books the whole availability window
+	var requestedSlot TimeSlot
+	err = json.NewDecoder(r.Body).Decode(&requestedSlot)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid booking time data", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Fetch the schedule's availability window and the vehicle's rate in a single query
 	var scheduleDate string
-	var isReserved bool
-	var vehicleHourlyRate float64
+	var vehicleID string
+	var vehicleHourlyRate money.Money
 	var startTime, endTime string
-	query := `SELECT s.date, s.is_reserved, s.start_time, s.end_time, v.hourly_rate
+	var vehicleStatus string
+	query := `SELECT s.date, s.vehicle_id, s.start_time, s.end_time, v.hourly_rate, v.status
 			  FROM schedules s INNER JOIN vehicles v ON s.vehicle_id = v.vehicle_id WHERE schedule_id = ?`
-	err = db.QueryRow(query, scheduleID).Scan(&scheduleDate, &isReserved, &startTime, &endTime, &vehicleHourlyRate)
+	err = db.QueryRow(query, scheduleID).Scan(&scheduleDate, &vehicleID, &startTime, &endTime, &vehicleHourlyRate, &vehicleStatus)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -592,6 +953,12 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	if vehicleStatus != vehicleStatusActive {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Vehicle is not available for booking", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	// Compare the license expiry date with the schedule date
 	scheduleDateTime, err := time.Parse("2006-01-02", scheduleDate)
@@ -608,15 +975,16 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the schedule is already reserved
-	if isReserved {
-		w.WriteHeader(http.StatusConflict)
-		response := Response{"Schedule is already reserved", nil}
+	// Check the requested time lies within the availability window
+	startTimeFmt, endTimeFmt, err := resolveRequestedSlot(requestedSlot, startTime, endTime)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{err.Error(), nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Check if user exceeded their booking limit
+	// Get the membership for its discount and booking limits
 	membership, err := getMembershipDetails(user.MembershipId)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -625,59 +993,74 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var bookingCount int
-	countQuery := `
-		SELECT COUNT(*) 
-		FROM bookings 
-		WHERE user_id = ? AND (status = 'Confirmed' OR status = 'Completed')
-	`
-	err = db.QueryRow(countQuery, userID).Scan(&bookingCount)
+	// Calculate the amount for the exact requested duration
+	baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount, err := calculateAmount(vehicleHourlyRate, startTimeFmt, endTimeFmt, membership.HourlyRateDiscount, "")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to query booking count", nil}
+		response := Response{"Failed to calculate amount", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	if bookingCount >= membership.BookingLimit {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{
-			Message: fmt.Sprintf("You have exceeded the booking limit of %d", membership.BookingLimit),
-			Booking: nil,
-		}
+	// Start a transaction so the overlap check and the booking insert succeed or fail together
+	tx, err := db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := Response{"Failed to start transaction", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	defer tx.Rollback()
 
-	// Calculate the amount using the calculateAmount function
-	membershipDiscount := membership.HourlyRateDiscount
-	startTimeFmt, err := time.Parse("15:04:05", startTime)
+	// Claim the time range, only one concurrent request can book an overlapping range
+	claimed, err := claimTimeSlot(tx, vehicleID, scheduleDate, startTimeFmt, endTimeFmt, 0)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse start time", nil}
+		response := Response{"Failed to check existing bookings", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	endTimeFmt, err := time.Parse("15:04:05", endTime)
-	if err != nil {
+	if !claimed {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Requested time overlaps an existing booking", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Check the user is within their membership's booking limits, locking their quota
+	// so concurrent requests cannot both take the last one
+	if err := lockBookingQuota(tx, userID); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse end time", nil}
+		response := Response{"Failed to query booking count", nil}
 		json.NewEncoder(w).Encode(response)
+		return
 	}
-	baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount, err := calculateAmount(vehicleHourlyRate, startTimeFmt, endTimeFmt, membershipDiscount, "")
+	quota, err := countBookingQuota(tx, userID, membership)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to calculate amount", nil}
+		response := Response{"Failed to query booking count", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if quota.ActiveRemaining == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{fmt.Sprintf("You have reached the limit of %d active bookings", quota.MaxActiveBookings), nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if quota.Remaining == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{fmt.Sprintf("You have reached the booking limit of %d per %s", quota.BookingLimit, bookingPeriodNames[quota.Period]), nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Create the booking
 	insertQuery := `
-		INSERT INTO bookings (schedule_id, user_id, status, base_cost, membership_discount, promotion_discount, discount_applied, total_amount)
-		VALUES (?, ?, 'Pending', ?, ?, ?, ?, ?)
+		INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, membership_discount, promotion_discount, discount_applied, total_amount)
+		VALUES (?, ?, 'Pending', ?, ?, ?, ?, ?, ?, ?)
 	`
-	result, err := db.Exec(insertQuery, scheduleID, userID, baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount)
+	result, err := tx.Exec(insertQuery, scheduleID, userID, startTimeFmt.Format("15:04:05"), endTimeFmt.Format("15:04:05"), baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		response := Response{"Failed to create booking", nil}
@@ -694,12 +1077,10 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Mark schedule as reserved
-	updateQuery := `UPDATE schedules SET is_reserved = TRUE WHERE schedule_id = ?`
-	_, err = db.Exec(updateQuery, scheduleID)
-	if err != nil {
+	// Commit the reservation
+	if err := tx.Commit(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to update schedule", nil}
+		response := Response{"Failed to create booking", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
@@ -710,7 +1091,7 @@ func createBookingSession(w http.ResponseWriter, r *http.Request) {
 		SELECT 
 			b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount,
 			v.type, v.brand, v.model, v.license_plate, 
-			s.date AS schedule_date, s.start_time, s.end_time
+			s.date AS schedule_date, b.start_time, b.end_time
 		FROM bookings b
 		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
 		INNER JOIN vehicles v ON s.vehicle_id = v.vehicle_id
@@ -758,8 +1139,8 @@ func addPromotionCode(w http.ResponseWriter, r *http.Request) {
 		Booking *VehicleBookingDetails `json:"booking"`
 	}
 
-	// Extract user ID, booking ID, and promo code from the URL
-	userID := mux.Vars(r)["id"]
+	// Get the user ID from the access token, and booking ID and promo code from the URL
+	userID := auth.UserID(r)
 	bookingIDStr := mux.Vars(r)["bookingId"]
 	promoCode := mux.Vars(r)["promoCode"]
 
@@ -782,10 +1163,10 @@ func addPromotionCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get booking details
-	var vehicleHourlyRate float64
+	var vehicleHourlyRate money.Money
 	var startTime, endTime string
 	query := `
-        SELECT v.hourly_rate, s.start_time, s.end_time
+        SELECT v.hourly_rate, b.start_time, b.end_time
         FROM bookings b
         INNER JOIN schedules s ON b.schedule_id = s.schedule_id
         INNER JOIN vehicles v ON s.vehicle_id = v.vehicle_id
@@ -833,16 +1214,22 @@ func addPromotionCode(w http.ResponseWriter, r *http.Request) {
 	// Calculate the new total amount after applying the promotion discount
 	_, _, promotionDiscountAmt, totalDiscountAmt, totalAmt, err := calculateAmount(vehicleHourlyRate, startTimeFmt, endTimeFmt, membershipDiscount, promoCode)
 	if err != nil {
-		if err.Error() == "promo code not found" {
+		if errors.Is(err, errPromoCodeNotFound) {
 			w.WriteHeader(http.StatusBadRequest) // Use 400 for client-side error
 			response := Response{"Promo Code Not Found", nil}
 			json.NewEncoder(w).Encode(response)
 			return
-		} else if err.Error() == "promo code not valid" {
+		} else if errors.Is(err, errPromoCodeNotValid) {
 			w.WriteHeader(http.StatusBadRequest) // Use 400 for client-side error
 			response := Response{"Promo Code Not Valid", nil}
 			json.NewEncoder(w).Encode(response)
 			return
+		} else if errors.Is(err, errPromotionServiceUnavailable) {
+			log.Println("Failed to check promo code:", err)
+			w.WriteHeader(http.StatusBadGateway)
+			response := Response{"Failed to check the promo code, please try again", nil}
+			json.NewEncoder(w).Encode(response)
+			return
 		}
 		// For other errors, use internal server error
 		w.WriteHeader(http.StatusInternalServerError)
@@ -871,7 +1258,7 @@ func addPromotionCode(w http.ResponseWriter, r *http.Request) {
 		SELECT 
 			b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount,
 			v.type, v.brand, v.model, v.license_plate, 
-			s.date AS schedule_date, s.start_time, s.end_time
+			s.date AS schedule_date, b.start_time, b.end_time
 		FROM bookings b
 		INNER JOIN schedules s ON b.schedule_id = s.schedule_id
 		INNER JOIN vehicles v ON s.vehicle_id = v.vehicle_id
@@ -918,8 +1305,8 @@ func deleteBookingSession(w http.ResponseWriter, r *http.Request) {
 		BookingID *int64 `json:"booking_id"` // Nullable BookingID
 	}
 
-	// Get user_id and booking_id from the URL parameters
-	userID := mux.Vars(r)["id"]
+	// Get user_id from the access token and booking_id from the URL parameters
+	userID := auth.UserID(r)
 	bookingIDStr := mux.Vars(r)["bookingId"]
 
 	// Validate user before proceeding
@@ -942,13 +1329,13 @@ func deleteBookingSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query to get the booking session for the user
-	var scheduleID int64
+	var status string
 	selectQuery := `
-		SELECT schedule_id
+		SELECT status
 		FROM bookings
 		WHERE booking_id = ? AND user_id = ? AND status = 'Pending'
 	`
-	err = db.QueryRow(selectQuery, bookingID, userID).Scan(&scheduleID)
+	err = db.QueryRow(selectQuery, bookingID, userID).Scan(&status)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -962,10 +1349,10 @@ func deleteBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update the booking status to "SessionExpired"
+	// Update the booking status to "SessionExpired", which frees its time range
 	updateBookingQuery := `
 		UPDATE bookings
-		SET status = 'SessionExpired'
+		SET status = 'SessionExpired', expired_at = NOW()
 		WHERE booking_id = ?
 	`
 	_, err = db.Exec(updateBookingQuery, bookingID)
@@ -976,20 +1363,10 @@ func deleteBookingSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update the schedule to mark it as not reserved
-	updateScheduleQuery := `UPDATE schedules SET is_reserved = FALSE WHERE schedule_id = ?`
-	_, err = db.Exec(updateScheduleQuery, scheduleID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to update schedule", nil}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
 	response := Response{
-		Message:   "Booking session expired and schedule updated successfully",
+		Message:   "Booking session expired successfully",
 		BookingID: &bookingID, // Return the booking ID
 	}
 	json.NewEncoder(w).Encode(response)
@@ -1000,9 +1377,9 @@ func deleteBooking(w http.ResponseWriter, r *http.Request) {
 	// Set the header to application/json
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get the booking_id and user_id from the URL
+	// Get the booking_id from the URL and user_id from the access token
 	bookingId := mux.Vars(r)["bookingId"]
-	userId := mux.Vars(r)["id"]
+	userId := auth.UserID(r)
 
 	// Struct for response
 	type Response struct {
@@ -1020,7 +1397,7 @@ func deleteBooking(w http.ResponseWriter, r *http.Request) {
 
 	// Query to get the booking details to check status and timing
 	query := `
-        SELECT b.status, s.date, s.start_time
+        SELECT b.status, s.date, b.start_time
         FROM bookings b
         JOIN schedules s ON b.schedule_id = s.schedule_id
         WHERE b.booking_id = ? AND b.user_id = ?;
@@ -1072,65 +1449,47 @@ func deleteBooking(w http.ResponseWriter, r *http.Request) {
 	// Get the current time in Singapore Time (SGT)
 	currentTime := time.Now().In(loc)
 
-	// Calculate the time remaining
-	timeRemaining := scheduledDatetime.Sub(currentTime)
+	// How far ahead of the start it is cancelled decides the refund, under billing's refund policy
+	hoursBeforeStart := scheduledDatetime.Sub(currentTime).Hours()
 
-	fmt.Println("Time Remaining:", timeRemaining)
-	fmt.Println("Scheduled Time in SGT:", scheduledDatetime)
-	fmt.Println("Current Time in SGT:", currentTime)
-
-	// Check if the cancellation is within 24 hours
-	if timeRemaining < 24*time.Hour {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{Message: "Cancellation must be done at least 24 hours before the booking"}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// SQL query to update booking status and related schedule
-	cancelQueryStep1 := `
+	// Cancel the booking and record the refund it is owed; cancelled bookings no longer hold their time range
+	cancelQuery := `
 		UPDATE bookings
-		SET status = 'Cancelled'
-		WHERE booking_id = ? AND user_id = ?;
-	`
-
-	cancelQueryStep2 := `
-		UPDATE schedules
-		SET is_reserved = FALSE
-		WHERE schedule_id = (
-			SELECT schedule_id
-			FROM bookings
-			WHERE booking_id = ? AND user_id = ?
-		);
+		SET status = 'Cancelled', refund_status = 'Pending', cancelled_hours_before = ?
+		WHERE booking_id = ? AND user_id = ? AND status = 'Confirmed';
 	`
-	// Start a transaction
-	tx, err := db.Begin()
+	// Update the booking status, unless a concurrent request already cancelled it
+	result, err := db.Exec(cancelQuery, hoursBeforeStart, bookingId, userId)
 	if err != nil {
-		log.Fatalf("Failed to begin transaction: %v", err)
+		log.Println("Failed to update booking status:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
-
-	// Step 1: Update the booking status
-	_, err = tx.Exec(cancelQueryStep1, bookingId, userId)
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		tx.Rollback() // Roll back the transaction on error
-		log.Fatalf("Failed to update booking status: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
-
-	// Step 2: Update the schedule's is_reserved field
-	_, err = tx.Exec(cancelQueryStep2, bookingId, userId)
-	if err != nil {
-		tx.Rollback() // Roll back the transaction on error
-		log.Fatalf("Failed to update schedule: %v", err)
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{Message: "Only confirmed bookings can be cancelled"}
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		log.Fatalf("Failed to commit transaction: %v", err)
+	// Refund now that the cancellation is committed; if billing cannot be reached, the refund retrier sends it later
+	message := "Booking cancelled successfully"
+	if err := refundCancelledBooking(userId, bookingId, hoursBeforeStart); err != nil {
+		log.Println("Failed to refund booking, it will be retried:", err)
+		message = "Booking cancelled successfully, your refund is being processed"
 	}
 
+	// Let the user know the booking is cancelled
+	go notifyUser(userId, "booking_cancelled", map[string]interface{}{"BookingID": bookingId})
+
 	// Send the response as a JSON message
 	w.WriteHeader(http.StatusOK)
-	response := Response{Message: "Booking cancelled successfully"}
+	response := Response{Message: message}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -1139,8 +1498,8 @@ func verifyBooking(w http.ResponseWriter, r *http.Request) {
 	// Set the header to application/json
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get the booking_id and user_id from the URL
-	userId := mux.Vars(r)["id"]
+	// Get the user_id from the access token and booking_id from the URL
+	userId := auth.UserID(r)
 	bookingId := mux.Vars(r)["bookingId"]
 
 	// Struct for response
@@ -1162,11 +1521,11 @@ func verifyBooking(w http.ResponseWriter, r *http.Request) {
 	// Query to get the booking details to check status
 	query := `
 		SELECT b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount,
-		v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, s.start_time, s.end_time
+		v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, b.start_time, b.end_time, v.hourly_rate
 		FROM bookings b
 		JOIN schedules s ON b.schedule_id = s.schedule_id
 		JOIN vehicles v ON s.vehicle_id = v.vehicle_id
-		WHERE b.booking_id = ? AND b.user_id = ? AND b.status = 'Pending';
+		WHERE b.booking_id = ? AND b.user_id = ?;
 	`
 	// Execute the query to retrieve booking details
 	var bookingDetails VehicleBookingDetails
@@ -1188,6 +1547,7 @@ func verifyBooking(w http.ResponseWriter, r *http.Request) {
 		&bookingDetails.ScheduleDate,
 		&bookingDetails.StartTime,
 		&bookingDetails.EndTime,
+		&bookingDetails.HourlyRate,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1200,6 +1560,19 @@ func verifyBooking(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// Expired sessions are reported separately so that billing can refuse to invoice them
+	if bookingDetails.Status == "SessionExpired" {
+		w.WriteHeader(http.StatusGone)
+		response := Response{"Booking session expired", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if bookingDetails.Status != "Pending" {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Booking not found or not in 'Pending' status", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	response := Response{Message: "Booking found", Booking: &bookingDetails}
 	json.NewEncoder(w).Encode(response)
@@ -1210,8 +1583,8 @@ func confirmBooking(w http.ResponseWriter, r *http.Request) {
 	// Set the header to application/json
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get the booking_id and user_id from the URL
-	userId := mux.Vars(r)["id"]
+	// Get the user_id from the access token and booking_id from the URL
+	userId := auth.UserID(r)
 	bookingId := mux.Vars(r)["bookingId"]
 
 	// Struct for response
@@ -1251,13 +1624,14 @@ func confirmBooking(w http.ResponseWriter, r *http.Request) {
 
 	// Query to get the booking details to check status
 	query := `
-        SELECT status
-        FROM bookings
-        WHERE booking_id = ? AND user_id = ?
+        SELECT b.status, s.date, b.start_time, b.end_time
+        FROM bookings b
+        JOIN schedules s ON b.schedule_id = s.schedule_id
+        WHERE b.booking_id = ? AND b.user_id = ?
     `
 	// Execute the query to retrieve booking details
-	var status string
-	err = db.QueryRow(query, bookingId, userId).Scan(&status)
+	var status, date, startTime, endTime string
+	err = db.QueryRow(query, bookingId, userId).Scan(&status, &date, &startTime, &endTime)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -1269,24 +1643,46 @@ func confirmBooking(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// Confirming twice is harmless, so billing can safely retry after a lost response.
+	// Trips that started or finished were confirmed too, e.g. when paying their final invoice.
+	if status == "Confirmed" || status == "InProgress" || status == "Completed" {
+		w.WriteHeader(http.StatusOK)
+		response := Response{Message: "Booking already confirmed"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	if status != "Pending" {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusConflict)
 		response := Response{"Only pending bookings can be confirmed"}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Update the booking status to 'Confirmed'
+	// Update the booking status to 'Confirmed', unless the session expired in the meantime
 	updateQuery := `
         UPDATE bookings
         SET status = 'Confirmed'
-        WHERE booking_id = ? AND user_id = ?;
+        WHERE booking_id = ? AND user_id = ? AND status = 'Pending';
     `
-	_, err = db.Exec(updateQuery, bookingId, userId)
+	result, err := db.Exec(updateQuery, bookingId, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Only pending bookings can be confirmed"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Let the user know the booking is confirmed
+	go notifyUser(userId, "booking_confirmed", map[string]interface{}{"BookingID": bookingId, "Date": date, "StartTime": startTime, "EndTime": endTime})
 
 	// Send the response as a JSON message
 	w.WriteHeader(http.StatusOK)
@@ -1307,12 +1703,18 @@ func getVehicleDetailsByHourlyRate(w http.ResponseWriter, r *http.Request) {
 		Message string             `json:"message"`
 		Vehicle []VehicleSchedules `json:"vehicles"`
 	}
+	// Get the time already booked from today onwards
+	booked, err := getBookedRanges(time.Now().Format("2006-01-02"), "9999-12-31")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 	// Query to get the vehicle details
 	query := `
 		SELECT s.schedule_id, v.vehicle_id, v.type, v.brand, v.model, v.license_plate, v.hourly_rate, s.date, s.start_time, s.end_time
 		FROM vehicles v
 		INNER JOIN schedules s ON v.vehicle_id = s.vehicle_id
-		WHERE v.hourly_rate = ? AND s.date >= CURDATE() AND s.is_reserved = FALSE;
+		WHERE v.hourly_rate = ? AND s.date >= CURDATE() AND v.status = 'Active';
 	`
 	rows, err := db.Query(query, hourlyRate)
 	if err != nil {
@@ -1329,6 +1731,16 @@ func getVehicleDetailsByHourlyRate(w http.ResponseWriter, r *http.Request) {
 			log.Println("Error reading vehicle data:", err)
 			return
 		}
+		// Only return windows that still have free time in them
+		vehicle.FreeSlots, err = findFreeSlots(vehicle.StartTime, vehicle.EndTime, booked[vehicle.VehicleID+"/"+vehicle.Date])
+		if err != nil {
+			http.Error(w, "Error reading vehicle data", http.StatusInternalServerError)
+			log.Println("Error computing free slots:", err)
+			return
+		}
+		if len(vehicle.FreeSlots) == 0 {
+			continue
+		}
 		vehicle.BaseCost = vehicle.HourlyRate
 		vehicles = append(vehicles, vehicle)
 	}
@@ -1354,8 +1766,8 @@ func getVehicleDetailsByHourlyRate(w http.ResponseWriter, r *http.Request) {
 func updateBooking(w http.ResponseWriter, r *http.Request) {
 	// Set the header to application/json
 	w.Header().Set("Content-Type", "application/json")
-	// Get the booking_id and user_id from the URL
-	userId := mux.Vars(r)["id"]
+	// Get the user_id from the access token and booking_id from the URL
+	userId := auth.UserID(r)
 	bookingId := mux.Vars(r)["bookingId"]
 	scheduleId := mux.Vars(r)["scheduleId"]
 	// Struct for response
@@ -1364,26 +1776,40 @@ func updateBooking(w http.ResponseWriter, r *http.Request) {
 		VehicleBookingDetails *VehicleBookingDetails `json:"booking"`
 	}
 	// Validate user before proceeding
-	_, err := validateUser(userId)
+	user, err := validateUser(userId)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		response := Response{"User not found", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	bookingID, err := strconv.ParseInt(bookingId, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid booking ID format", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// Read the requested time range, an empty body takes the whole availability window
+	var requestedSlot TimeSlot
+	err = json.NewDecoder(r.Body).Decode(&requestedSlot)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid booking time data", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 	// Query to get the booking details to check status
-	query := `SELECT s.schedule_id, s.start_time, s.end_time, s.date, b.status, v.hourly_rate
+	query := `SELECT b.start_time, s.date, b.status, b.promo_code
 	FROM bookings b
 	JOIN schedules s ON b.schedule_id = s.schedule_id
-	JOIN vehicles v ON s.vehicle_id = v.vehicle_id
 	WHERE booking_id = ? AND user_id = ?`
 	// Execute the query to retrieve booking details
 	var bookedstatus string
-	var bookedscheduleId int64
-	var bookedvehicleHourlyRate float64
-	var bookedscheduleStartTime, bookedscheduleEndTime string
+	var bookedscheduleStartTime string
 	var bookedscheduleDate string
-	err = db.QueryRow(query, bookingId, userId).Scan(&bookedscheduleId, &bookedscheduleStartTime, &bookedscheduleEndTime, &bookedscheduleDate, &bookedstatus, &bookedvehicleHourlyRate)
+	var bookedPromoCode *string
+	err = db.QueryRow(query, bookingId, userId).Scan(&bookedscheduleStartTime, &bookedscheduleDate, &bookedstatus, &bookedPromoCode)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
@@ -1437,19 +1863,20 @@ func updateBooking(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query to get the schedule details
-	query = `SELECT s.date, s.start_time, s.end_time, v.hourly_rate, s.is_reserved
+	query = `SELECT s.date, s.vehicle_id, s.start_time, s.end_time, v.hourly_rate, v.status
 			 FROM schedules s JOIN vehicles v ON s.vehicle_id = v.vehicle_id
 			 WHERE schedule_id = ? `
 	// Execute the query to retrieve schedule details
 	var date string
+	var vehicleID string
 	var scheduleStartTime, scheduleEndTime string
-	var vehicleHourlyRate float64
-	var scheduleStatus bool
-	err = db.QueryRow(query, scheduleId).Scan(&date, &scheduleStartTime, &scheduleEndTime, &vehicleHourlyRate, &scheduleStatus)
+	var vehicleHourlyRate money.Money
+	var vehicleStatus string
+	err = db.QueryRow(query, scheduleId).Scan(&date, &vehicleID, &scheduleStartTime, &scheduleEndTime, &vehicleHourlyRate, &vehicleStatus)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
-			response := Response{"Schedule not found or already reserved", nil}
+			response := Response{"Schedule not found", nil}
 			json.NewEncoder(w).Encode(response)
 		} else {
 			fmt.Println(err)
@@ -1459,88 +1886,134 @@ func updateBooking(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	// Check if the schedule is already reserved
-	if scheduleStatus {
+	if vehicleStatus != vehicleStatusActive {
 		w.WriteHeader(http.StatusConflict)
-		response := Response{"Schedule is already reserved", nil}
+		response := Response{"Vehicle is not available for booking", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check if the booking is for the same vehicle type
-	if bookedvehicleHourlyRate != vehicleHourlyRate {
+	// Check the requested time lies within the availability window
+	scheduleStartTimeFmt, scheduleEndTimeFmt, err := resolveRequestedSlot(requestedSlot, scheduleStartTime, scheduleEndTime)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Booking is for a different vehicle type", nil}
+		response := Response{err.Error(), nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Check duration of the booking
-	bookedscheduleStartTimeFmt, err := time.Parse("15:04:05", bookedscheduleStartTime)
+	// Cannot move the booking to a time that has already passed
+	newStartDateTime, err := time.ParseInLocation("2006-01-02 15:04", date+" "+scheduleStartTimeFmt.Format("15:04"), loc)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse start time", nil}
+		response := Response{"Failed to parse schedule date", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if !newStartDateTime.After(currentTime) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Cannot move a booking to a time that has already passed", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// Reprice the booking for the new schedule and time range
+	membership, err := getMembershipDetails(user.MembershipId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := Response{"Membership not found", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	promoCode := ""
+	if bookedPromoCode != nil {
+		promoCode = *bookedPromoCode
+	}
+	baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount, err := calculateAmount(vehicleHourlyRate, scheduleStartTimeFmt, scheduleEndTimeFmt, membership.HourlyRateDiscount, promoCode)
+	if errors.Is(err, errPromoCodeNotFound) || errors.Is(err, errPromoCodeNotValid) {
+		// Keep the promo code only while it is still valid, otherwise price without it
+		promoCode = ""
+		baseAmount, membershipDiscount, promotionDiscount, totalDiscount, totalAmount, err = calculateAmount(vehicleHourlyRate, scheduleStartTimeFmt, scheduleEndTimeFmt, membership.HourlyRateDiscount, "")
+	}
+	if errors.Is(err, errPromotionServiceUnavailable) {
+		// Do not drop a code that may still be valid just because it could not be checked
+		log.Println("Failed to check promo code:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		response := Response{"Failed to check the promo code, please try again", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	bookedscheduleEndTimeFmt, err := time.Parse("15:04:05", bookedscheduleEndTime)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse end time", nil}
+		response := Response{"Failed to calculate amount", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	scheduleStartTimeFmt, err := time.Parse("15:04:05", scheduleStartTime)
+	var newPromoCode *string
+	if promoCode != "" {
+		newPromoCode = &promoCode
+	}
+	// Start a transaction so the overlap check and the booking update succeed or fail together
+	tx, err := db.Begin()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse start time", nil}
+		response := Response{"Failed to start transaction", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	scheduleEndTimeFmt, err := time.Parse("15:04:05", scheduleEndTime)
+	defer tx.Rollback()
+	// Lock the booking and check it is still confirmed, as it may have been cancelled or started since it was read
+	err = tx.QueryRow("SELECT status FROM bookings WHERE booking_id = ? AND user_id = ? FOR UPDATE", bookingId, userId).Scan(&bookedstatus)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to parse end time", nil}
+		response := Response{"Database error", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Calculate the duration
-	bookedDuration := bookedscheduleEndTimeFmt.Sub(bookedscheduleStartTimeFmt)
-	newDuration := scheduleEndTimeFmt.Sub(scheduleStartTimeFmt)
-	if bookedDuration != newDuration {
-		w.WriteHeader(http.StatusBadRequest)
-		response := Response{"Booking duration does not match the schedule duration", nil}
+	if bookedstatus != "Confirmed" {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Booking is no longer confirmed and cannot be updated", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Update the booking with the new schedule details
-	updateQuery := `UPDATE bookings SET schedule_id = ? WHERE booking_id = ? AND user_id = ?`
-	_, err = db.Exec(updateQuery, scheduleId, bookingId, userId)
+	// Claim the new time range, ignoring the booking's own current range
+	claimed, err := claimTimeSlot(tx, vehicleID, date, scheduleStartTimeFmt, scheduleEndTimeFmt, bookingID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to update booking", nil}
+		response := Response{"Failed to check existing bookings", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Update the schedule to mark it as reserved
-	updateScheduleQuery := `UPDATE schedules SET is_reserved = TRUE WHERE schedule_id = ?`
-	_, err = db.Exec(updateScheduleQuery, scheduleId)
+	if !claimed {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Requested time overlaps an existing booking", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	// Update the booking with the new schedule details and price, marking the price difference as still to be settled
+	updateQuery := `UPDATE bookings
+	SET schedule_id = ?, start_time = ?, end_time = ?, base_cost = ?, promo_code = ?, membership_discount = ?, promotion_discount = ?, discount_applied = ?, total_amount = ?, adjustment_status = 'Pending'
+	WHERE booking_id = ? AND user_id = ? AND status = 'Confirmed'`
+	_, err = tx.Exec(updateQuery, scheduleId, scheduleStartTimeFmt.Format("15:04:05"), scheduleEndTimeFmt.Format("15:04:05"), baseAmount, newPromoCode, membershipDiscount, promotionDiscount, totalDiscount, totalAmount, bookingId, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to update schedule", nil}
+		response := Response{"Failed to update booking", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	// Update the schedule to mark it as not reserved
-	updateScheduleQuery = `UPDATE schedules SET is_reserved = FALSE WHERE schedule_id = ?`
-	_, err = db.Exec(updateScheduleQuery, bookedscheduleId)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		response := Response{"Failed to update schedule", nil}
+		response := Response{"Failed to update booking", nil}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	// Settle the price difference with billing now that the change is committed;
+	// if billing cannot be reached, the adjustment retrier settles it later
+	adjustmentMessage, err := settleBookingPayment(bookingId)
+	if err != nil {
+		log.Println("Failed to adjust booking payment, it will be retried:", err)
+		adjustmentMessage = "The price difference will be settled shortly"
+	}
 	// Fetch booking details
 	var bookingDetails VehicleBookingDetails
-	selectQuery := `SELECT b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount, v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, s.start_time, s.end_time 
+	selectQuery := `SELECT b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount, v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, b.start_time, b.end_time 
 					FROM bookings b JOIN schedules s ON b.schedule_id = s.schedule_id 
 					JOIN vehicles v ON s.vehicle_id = v.vehicle_id WHERE b.booking_id = ?`
 	err = db.QueryRow(selectQuery, bookingId).Scan(&bookingDetails.BookingID, &bookingDetails.ScheduleID, &bookingDetails.UserID, &bookingDetails.Status, &bookingDetails.BaseCost, &bookingDetails.PromotionCode, &bookingDetails.MembershipDiscount, &bookingDetails.PromotionDiscount, &bookingDetails.DiscountApplied, &bookingDetails.TotalAmount, &bookingDetails.Type, &bookingDetails.Brand, &bookingDetails.Model, &bookingDetails.LicensePlate, &bookingDetails.ScheduleDate, &bookingDetails.StartTime, &bookingDetails.EndTime)
@@ -1551,6 +2024,6 @@ func updateBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	response := Response{"Booking updated successfully", &bookingDetails}
+	response := Response{"Booking updated successfully. " + adjustmentMessage, &bookingDetails}
 	json.NewEncoder(w).Encode(response)
 }
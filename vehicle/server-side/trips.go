@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"shared/auth"
+)
+
+// Odometer and battery readings taken at pickup or return (req body)
+type TripReading struct {
+	Odometer     *float64 `json:"odometer"`
+	BatteryLevel *int     `json:"battery_level"`
+}
+
+// Booking together with how the trip actually went, used by billing for the final invoice
+type TripDetails struct {
+	VehicleBookingDetails
+	ActualStart   *string  `json:"actual_start"`
+	ActualEnd     *string  `json:"actual_end"`
+	StartOdometer *float64 `json:"start_odometer"`
+	EndOdometer   *float64 `json:"end_odometer"`
+	StartBattery  *int     `json:"start_battery"`
+	EndBattery    *int     `json:"end_battery"`
+}
+
+// How early a trip may be started before the booked start time
+var tripEarlyStart = getEnvDuration("TRIP_EARLY_START", 15*time.Minute)
+
+// Validate the readings of a pickup or return
+func validateTripReading(reading TripReading) error {
+	if reading.Odometer == nil || *reading.Odometer < 0 {
+		return fmt.Errorf("odometer reading is required")
+	}
+	if reading.BatteryLevel == nil || *reading.BatteryLevel < 0 || *reading.BatteryLevel > 100 {
+		return fmt.Errorf("battery level must be between 0 and 100")
+	}
+	return nil
+}
+
+// Load the Singapore timezone used for all booking times
+func bookingLocation() (*time.Location, error) {
+	return time.LoadLocation("Asia/Singapore")
+}
+
+// Start a confirmed trip, recording the pickup time and readings
+func startTrip(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the user_id from the access token and booking_id from the URL
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["bookingId"]
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Read the pickup readings
+	var reading TripReading
+	err := json.NewDecoder(r.Body).Decode(&reading)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid trip data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := validateTripReading(reading); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Query to get the booked date and time range
+	query := `
+		SELECT b.status, s.date, b.start_time, b.end_time
+		FROM bookings b
+		JOIN schedules s ON b.schedule_id = s.schedule_id
+		WHERE b.booking_id = ? AND b.user_id = ?
+	`
+	var status, date, startTime, endTime string
+	err = db.QueryRow(query, bookingId, userId).Scan(&status, &date, &startTime, &endTime)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Booking not found"}
+			json.NewEncoder(w).Encode(response)
+		} else {
+			fmt.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if status != "Confirmed" {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Only confirmed bookings can be started"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The trip can only start shortly before and during the booked time
+	loc, err := bookingLocation()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	bookedStart, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+startTime, loc)
+	if err != nil {
+		http.Error(w, "Error parsing scheduled time", http.StatusInternalServerError)
+		return
+	}
+	bookedEnd, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+endTime, loc)
+	if err != nil {
+		http.Error(w, "Error parsing scheduled time", http.StatusInternalServerError)
+		return
+	}
+	currentTime := time.Now().In(loc)
+	if currentTime.Before(bookedStart.Add(-tripEarlyStart)) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Trip cannot be started yet"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if !currentTime.Before(bookedEnd) {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Booking has already ended"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Start the trip, unless a concurrent request already did
+	updateQuery := `
+		UPDATE bookings
+		SET status = 'InProgress', actual_start = ?, start_odometer = ?, start_battery = ?
+		WHERE booking_id = ? AND user_id = ? AND status = 'Confirmed'
+	`
+	result, err := db.Exec(updateQuery, currentTime.Format("2006-01-02 15:04:05"), *reading.Odometer, *reading.BatteryLevel, bookingId, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Only confirmed bookings can be started"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Trip started successfully"}
+	json.NewEncoder(w).Encode(response)
+}
+
+// End a trip in progress, recording the return time and readings and completing the booking
+func endTrip(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the user_id from the access token and booking_id from the URL
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["bookingId"]
+
+	// Struct for response
+	type Response struct {
+		Message string `json:"message"`
+	}
+
+	// Read the return readings
+	var reading TripReading
+	err := json.NewDecoder(r.Body).Decode(&reading)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Invalid trip data"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := validateTripReading(reading); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Query to get the trip's starting readings
+	query := `SELECT status, start_odometer FROM bookings WHERE booking_id = ? AND user_id = ?`
+	var status string
+	var startOdometer sql.NullFloat64
+	err = db.QueryRow(query, bookingId, userId).Scan(&status, &startOdometer)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Booking not found"}
+			json.NewEncoder(w).Encode(response)
+		} else {
+			fmt.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if status != "InProgress" {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Only trips in progress can be ended"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if startOdometer.Valid && *reading.Odometer < startOdometer.Float64 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := Response{"Odometer reading cannot be lower than at pickup"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Complete the booking, unless a concurrent request already did
+	loc, err := bookingLocation()
+	if err != nil {
+		http.Error(w, "Error loading Singapore timezone", http.StatusInternalServerError)
+		return
+	}
+	currentTime := time.Now().In(loc)
+	updateQuery := `
+		UPDATE bookings
+		SET status = 'Completed', actual_end = ?, end_odometer = ?, end_battery = ?
+		WHERE booking_id = ? AND user_id = ? AND status = 'InProgress'
+	`
+	result, err := db.Exec(updateQuery, currentTime.Format("2006-01-02 15:04:05"), *reading.Odometer, *reading.BatteryLevel, bookingId, userId)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Only trips in progress can be ended"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Bill the actual usage; the final invoice can still be requested from billing if this fails
+	if err := requestFinalInvoice(userId, bookingId); err != nil {
+		log.Println("Failed to request final invoice for booking", bookingId, ":", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Trip ended successfully"}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Get a completed booking with its actual pickup and return (called by the billing service)
+func getTripDetails(w http.ResponseWriter, r *http.Request) {
+	// Set the header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get the user_id and booking_id from the URL
+	userId := auth.UserID(r)
+	bookingId := mux.Vars(r)["bookingId"]
+
+	// Struct for response
+	type Response struct {
+		Message string       `json:"message"`
+		Trip    *TripDetails `json:"trip"`
+	}
+
+	// Query to get the booking, its vehicle and the recorded trip
+	query := `
+		SELECT b.booking_id, b.schedule_id, b.user_id, b.status, b.base_cost, b.promo_code, b.membership_discount, b.promotion_discount, b.discount_applied, b.total_amount,
+		v.type, v.brand, v.model, v.license_plate, s.date AS schedule_date, b.start_time, b.end_time, v.hourly_rate,
+		b.actual_start, b.actual_end, b.start_odometer, b.end_odometer, b.start_battery, b.end_battery
+		FROM bookings b
+		JOIN schedules s ON b.schedule_id = s.schedule_id
+		JOIN vehicles v ON s.vehicle_id = v.vehicle_id
+		WHERE b.booking_id = ? AND b.user_id = ?
+	`
+	var trip TripDetails
+	err := db.QueryRow(query, bookingId, userId).Scan(
+		&trip.BookingID,
+		&trip.ScheduleID,
+		&trip.UserID,
+		&trip.Status,
+		&trip.BaseCost,
+		&trip.PromotionCode,
+		&trip.MembershipDiscount,
+		&trip.PromotionDiscount,
+		&trip.DiscountApplied,
+		&trip.TotalAmount,
+		&trip.Type,
+		&trip.Brand,
+		&trip.Model,
+		&trip.LicensePlate,
+		&trip.ScheduleDate,
+		&trip.StartTime,
+		&trip.EndTime,
+		&trip.HourlyRate,
+		&trip.ActualStart,
+		&trip.ActualEnd,
+		&trip.StartOdometer,
+		&trip.EndOdometer,
+		&trip.StartBattery,
+		&trip.EndBattery,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			response := Response{"Booking not found", nil}
+			json.NewEncoder(w).Encode(response)
+		} else {
+			fmt.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	// Usage is only final once the booking is completed
+	if trip.Status != "Completed" {
+		w.WriteHeader(http.StatusConflict)
+		response := Response{"Booking is not completed yet", nil}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := Response{"Trip found", &trip}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Ask the billing service to issue the final invoice for a completed trip
+func requestFinalInvoice(userId, bookingId string) error {
+	finalInvoiceURL := billingServiceURL + "/api/v1/final-invoice/" + userId + "/" + bookingId
+	resp, err := auth.ServicePost(finalInvoiceURL, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("failed to request final invoice: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to issue final invoice, status code: %d", resp.StatusCode)
+	}
+	return nil
+}
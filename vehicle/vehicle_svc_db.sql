@@ -2,43 +2,108 @@
 CREATE DATABASE vehicle_svc_db;
 USE vehicle_svc_db;
 
--- attributes of the table(vehicle_id, type, brand, model, license_plate, hourly_rate)
+-- attributes of the table(vehicle_id, type, brand, model, license_plate, hourly_rate, status)
 CREATE TABLE vehicles (
     vehicle_id INT PRIMARY KEY AUTO_INCREMENT,
     type VARCHAR(50) NOT NULL,
     brand VARCHAR(50) NOT NULL,
     model VARCHAR(50) NOT NULL,
     license_plate VARCHAR(20) UNIQUE NOT NULL,
-    hourly_rate DECIMAL(8, 2) NOT NULL
+    hourly_rate DECIMAL(10, 2) NOT NULL CHECK (hourly_rate > 0),
+    status ENUM('Active', 'Offline', 'Decommissioned') NOT NULL DEFAULT 'Active' -- only active vehicles can be booked
 );
 
--- attributes of the table (schedule_id, vehicle_id, date, end_time, start_time, is_reserved)
+-- attributes of the table (rule_id, vehicle_id, weekdays, start_time, end_time, valid_from, valid_to, created_at)
+-- recurring availability, expanded into a schedules row on each matching date when created
+CREATE TABLE availability_rules (
+    rule_id INT PRIMARY KEY AUTO_INCREMENT,
+    vehicle_id INT NOT NULL,
+    weekdays SET('Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat', 'Sun') NOT NULL,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    valid_from DATE NOT NULL,
+    valid_to DATE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id)
+);
+
+-- attributes of the table (schedule_id, vehicle_id, date, end_time, start_time, rule_id)
+-- each row is an availability window, bookings take any free range inside it
 CREATE TABLE schedules (
     schedule_id INT PRIMARY KEY AUTO_INCREMENT,
     vehicle_id INT NOT NULL,
     date DATE NOT NULL,
     start_time TIME NOT NULL,
     end_time TIME NOT NULL,
-    is_reserved BOOLEAN DEFAULT FALSE,
+    rule_id INT NULL, -- set when the window was generated from a recurring rule
+    INDEX idx_schedules_vehicle_date (vehicle_id, date),
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id),
+    FOREIGN KEY (rule_id) REFERENCES availability_rules(rule_id)
+);
+
+-- attributes of the table (block_id, vehicle_id, start_at, end_at, reason, created_at)
+-- periods a vehicle is out for maintenance, in Singapore time; no booking may overlap them
+CREATE TABLE maintenance_blocks (
+    block_id INT PRIMARY KEY AUTO_INCREMENT,
+    vehicle_id INT NOT NULL,
+    start_at DATETIME NOT NULL,
+    end_at DATETIME NOT NULL,
+    reason VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_maintenance_vehicle (vehicle_id, start_at),
     FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id)
 );
 
--- attributes of the table (booking_id, schedule_id, user_id, status, base_cost, promotion_id, membership_discount, promotion_discount, discount_applied, total_amount, last_updated)
+-- attributes of the table (booking_id, schedule_id, user_id, status, start_time, end_time, base_cost, promotion_id, membership_discount, promotion_discount, discount_applied, total_amount, created_at, expired_at, refund_status, cancelled_hours_before, adjustment_status, last_updated)
 CREATE TABLE bookings (
     booking_id INT PRIMARY KEY AUTO_INCREMENT,
     schedule_id INT NOT NULL,
 	user_id INT NOT NULL,
-    status ENUM('Confirmed', 'Pending','Cancelled','Completed','SessionExpired') DEFAULT 'Pending',
-    base_cost DECIMAL(5, 2) NOT NULL,
+    status ENUM('Confirmed', 'Pending','Cancelled','InProgress','Completed','SessionExpired') DEFAULT 'Pending',
+    start_time TIME NOT NULL, -- booked range within the schedule's window
+    end_time TIME NOT NULL,
+    base_cost DECIMAL(10, 2) NOT NULL,
 	promo_code VARCHAR(20),
-    membership_discount DECIMAL(5, 2) DEFAULT 0.00,
-    promotion_discount DECIMAL(5, 2) DEFAULT 0.00,
-    discount_applied DECIMAL(5, 2) DEFAULT 0.00,
-    total_amount DECIMAL(5, 2) NOT NULL,
+    membership_discount DECIMAL(10, 2) DEFAULT 0.00,
+    promotion_discount DECIMAL(10, 2) DEFAULT 0.00,
+    discount_applied DECIMAL(10, 2) DEFAULT 0.00,
+    total_amount DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expired_at TIMESTAMP NULL, -- set when a pending session expires
+    refund_status ENUM('Pending', 'Done') NULL, -- set when a confirmed booking is cancelled, Done once billing has refunded it
+    cancelled_hours_before DECIMAL(10, 2) NULL, -- how long before the start it was cancelled, which decides the refund
+    adjustment_status ENUM('Pending', 'Done') NULL, -- set when a booking is repriced, Done once billing has settled the difference
+    actual_start DATETIME NULL, -- pickup time and readings, set when the trip starts
+    start_odometer DECIMAL(8, 1) NULL,
+    start_battery INT NULL,
+    actual_end DATETIME NULL, -- return time and readings, set when the trip ends
+    end_odometer DECIMAL(8, 1) NULL,
+    end_battery INT NULL,
     last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_bookings_user (user_id, status), -- counting a user's bookings against their membership limits
     FOREIGN KEY (schedule_id) REFERENCES schedules(schedule_id)
 );
 
+-- Attributes of the table (user_id, created_at)
+-- One row per user who has booked, locked while their bookings are counted against their membership limits
+CREATE TABLE booking_quota (
+    user_id INT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Attributes of the table (scope, idempotency_key, request_hash, status_code, content_type, response_body, created_at)
+-- Responses to requests sent with an Idempotency-Key, replayed when the request is retried
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(20) NOT NULL, -- user id of the caller, or 'service'
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL, -- SHA-256 of the method, path and body
+    status_code INT NULL, -- not set while the first request is still running
+    content_type VARCHAR(100) NULL,
+    response_body MEDIUMBLOB NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, idempotency_key)
+);
+
 -- insert values into vehcile table
 INSERT INTO vehicles (type, brand, model, license_plate, hourly_rate) 
 VALUES 
@@ -50,86 +115,86 @@ VALUES
 
 -- insert values into schedule tab
 -- Adding schedules for Vehicle 1 (Toyota Corolla)
-INSERT INTO schedules (vehicle_id, date, start_time, end_time, is_reserved)
+INSERT INTO schedules (vehicle_id, date, start_time, end_time)
 VALUES
-(1, '2024-12-04', '08:00:00', '12:00:00', TRUE), -- booked 
-(1, '2024-12-07', '08:00:00', '12:00:00', FALSE), 
-(1, '2024-12-07', '14:00:00', '18:00:00', FALSE),
-(1, '2024-12-09', '14:00:00', '18:00:00', FALSE), 
-(1, '2024-12-09', '08:00:00', '12:00:00', TRUE);  -- booked 
+(1, '2024-12-04', '08:00:00', '12:00:00'), -- booked 
+(1, '2024-12-07', '08:00:00', '12:00:00'), 
+(1, '2024-12-07', '14:00:00', '18:00:00'),
+(1, '2024-12-09', '14:00:00', '18:00:00'), 
+(1, '2024-12-09', '08:00:00', '12:00:00');  -- booked 
 
 -- Adding schedules for Vehicle 2 (Honda CR-V)
-INSERT INTO schedules (vehicle_id, date, start_time, end_time, is_reserved)
+INSERT INTO schedules (vehicle_id, date, start_time, end_time)
 VALUES
-(2, '2024-12-15', '08:00:00', '20:00:00', FALSE),   
-(2, '2024-12-16', '08:00:00', '20:00:00', FALSE),
-(2, '2024-12-17', '08:00:00', '20:00:00', FALSE), 
-(2, '2024-12-18', '08:00:00', '20:00:00', TRUE),   -- booked 
-(2, '2024-12-19', '08:00:00', '20:00:00', FALSE);
+(2, '2024-12-15', '08:00:00', '20:00:00'),   
+(2, '2024-12-16', '08:00:00', '20:00:00'),
+(2, '2024-12-17', '08:00:00', '20:00:00'), 
+(2, '2024-12-18', '08:00:00', '20:00:00'),   -- booked 
+(2, '2024-12-19', '08:00:00', '20:00:00');
 
 -- Adding schedules for Vehicle 3 (BMW 5 Series)
-INSERT INTO schedules (vehicle_id, date, start_time, end_time, is_reserved)
+INSERT INTO schedules (vehicle_id, date, start_time, end_time)
 VALUES
-(3, '2024-12-20', '08:00:00', '14:00:00', FALSE), 
-(3, '2024-12-20', '16:00:00', '22:00:00', TRUE),  -- booked  
-(3, '2024-12-21', '10:00:00', '14:00:00', FALSE), 
-(3, '2024-12-21', '16:00:00', '20:00:00', FALSE), 
-(3, '2024-12-22', '16:00:00', '18:00:00', FALSE); -- booked 
+(3, '2024-12-20', '08:00:00', '14:00:00'), 
+(3, '2024-12-20', '16:00:00', '22:00:00'),  -- booked  
+(3, '2024-12-21', '10:00:00', '14:00:00'), 
+(3, '2024-12-21', '16:00:00', '20:00:00'), 
+(3, '2024-12-22', '16:00:00', '18:00:00'); -- booked 
 
 -- Adding schedules for Vehicle 4 (Volkswagen Golf)
-INSERT INTO schedules (vehicle_id, date, start_time, end_time, is_reserved)
+INSERT INTO schedules (vehicle_id, date, start_time, end_time)
 VALUES
-(4, '2024-11-16', '08:00:00', '20:00:00', TRUE), -- booked 
-(4, '2024-12-17', '08:00:00', '20:00:00', FALSE), 
-(4, '2024-12-18', '08:00:00', '20:00:00', FALSE), 
-(4, '2024-12-19', '08:00:00', '20:00:00', FALSE),  
-(4, '2024-12-20', '08:00:00', '20:00:00', FALSE);  
+(4, '2024-11-16', '08:00:00', '20:00:00'), -- booked 
+(4, '2024-12-17', '08:00:00', '20:00:00'), 
+(4, '2024-12-18', '08:00:00', '20:00:00'), 
+(4, '2024-12-19', '08:00:00', '20:00:00'),  
+(4, '2024-12-20', '08:00:00', '20:00:00');  
 
 -- Adding schedules for Vehicle 5 (Mercedes C-Class)
-INSERT INTO schedules (vehicle_id, date, start_time, end_time, is_reserved)
+INSERT INTO schedules (vehicle_id, date, start_time, end_time)
 VALUES
-(5, '2024-12-20', '10:00:00', '14:00:00', FALSE), 
-(5, '2024-11-20', '16:00:00', '20:00:00', TRUE),  -- booked 
-(5, '2024-12-21', '10:00:00', '14:00:00', FALSE), 
-(5, '2024-12-21', '16:00:00', '20:00:00', FALSE),  
-(5, '2024-12-22', '08:00:00', '18:00:00', FALSE);
+(5, '2024-12-20', '10:00:00', '14:00:00'), 
+(5, '2024-11-20', '16:00:00', '20:00:00'),  -- booked 
+(5, '2024-12-21', '10:00:00', '14:00:00'), 
+(5, '2024-12-21', '16:00:00', '20:00:00'),  
+(5, '2024-12-22', '08:00:00', '18:00:00');
 
 
 -- Booking 1: John Doe reserves the Toyota Corolla on 2024-12-04 from 08:00 to 12:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, promo_code, promotion_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, promo_code, promotion_discount, discount_applied, total_amount) 
 VALUES 
-(1, 1, 'Completed', 80.00, 'DECEMBERHOLIDAY', 16.00, 16.00, 64.00);
+(1, 1, 'Completed', '08:00:00', '12:00:00', 80.00, 'DECEMBERHOLIDAY', 16.00, 16.00, 64.00);
 
 
 -- Booking 2: John Doe reserves the Toyota Corolla on 2024-12-10 from 18:00 to 22:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, total_amount) 
 VALUES 
-(5, 1, 'Confirmed', 80.00, 80.00);
+(5, 1, 'Confirmed', '08:00:00', '12:00:00', 80.00, 80.00);
 
 -- Booking 3: John Doe reserves the Honda CR-V on 2024-12-18 from 08:00 to 20:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, promo_code, promotion_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, promo_code, promotion_discount, discount_applied, total_amount) 
 VALUES 
-(9, 1, 'Confirmed', 360.00, 'CHRISTMAS15', 54.00, 54.00, 306.00);
+(9, 1, 'Confirmed', '08:00:00', '20:00:00', 360.00, 'CHRISTMAS15', 54.00, 54.00, 306.00);
 
 
 -- Booking 4: Jane smith reserves the BMW 5 Series on 2024-12-20 from 16:00 to 22:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, membership_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, membership_discount, discount_applied, total_amount) 
 VALUES 
-(12, 2, 'Confirmed', 300.00, 30.00, 30.00, 270.00);
+(12, 2, 'Confirmed', '16:00:00', '22:00:00', 300.00, 30.00, 30.00, 270.00);
 
 -- Booking 5: Jane smith reserves the BMW 5 Series on 2024-12-22 from 16:00 to 18:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, promo_code, membership_discount, promotion_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, promo_code, membership_discount, promotion_discount, discount_applied, total_amount) 
 VALUES 
-(15, 2, 'Confirmed', 300.00, 'CHRISTMAS15', 30.00, 40.50, 70.50, 229.50);
+(15, 2, 'Confirmed', '16:00:00', '18:00:00', 300.00, 'CHRISTMAS15', 30.00, 40.50, 70.50, 229.50);
 
 
 -- Booking 6: Alice reserves the Volkswagen Golf on 2024-11-16 from 08:00 to 20:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, membership_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, membership_discount, discount_applied, total_amount) 
 VALUES 
-(16, 3, 'Completed', 480.00, 96.00, 96.00, 384.00);
+(16, 3, 'Completed', '08:00:00', '20:00:00', 480.00, 96.00, 96.00, 384.00);
 
 -- Booking 7: Alice Johnson reserves the Mercedes C-Class on 2024-11-20 from 16:00 to 20:00
-INSERT INTO bookings (schedule_id, user_id, status, base_cost, membership_discount, discount_applied, total_amount) 
+INSERT INTO bookings (schedule_id, user_id, status, start_time, end_time, base_cost, membership_discount, discount_applied, total_amount) 
 VALUES 
-(22, 3, 'Completed', 240.00, 48.00, 48.00, 192.00);
+(22, 3, 'Completed', '16:00:00', '20:00:00', 240.00, 48.00, 48.00, 192.00);
 